@@ -1,25 +1,33 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/cpu"
+	cpuutil "github.com/danielfoehrkn/better-kube-reserved/pkg/cpu/util"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/disk"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/enforcement"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/histogram"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/process"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/psi"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
 	"github.com/dustin/go-humanize"
-	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/utils/pointer"
 )
 
 const (
@@ -28,8 +36,47 @@ const (
 	defaultContainerdCgroupsHierarchyRoot = "system.slice/containerd.service"
 	defaultKubeletCgroupsHierarchyRoot    = "system.slice/kubelet.service"
 	defaultKubeletDirectory               = "/var/lib/kubelet"
+	defaultKubeletConfigPath              = "/var/lib/kubelet/config/kubelet"
+	defaultKubeletRestartMinInterval      = time.Hour
+	kubeletRestartTimeout                 = 2 * time.Minute
+	defaultKubeletConfigMinMemoryChange   = "100Mi"
+	defaultKubeletConfigMinCPUChange      = "20m"
 	defaultContainerdStateDirectory       = "/run/containerd"
 	defaultContainerdRootDirectory        = "/var/lib/containerd"
+	defaultEnforcementMinMemoryChange     = "50Mi"
+	defaultEnforcementMaxMemoryDecrease   = "200Mi"
+	defaultEnforcementCoolDown            = time.Minute
+	defaultDriftCheckInterval             = time.Second
+	defaultEnforcementMemoryMaxHeadroom   = "500Mi"
+	defaultRecommendationPercentile       = 0.95
+	defaultRecommendationWindow           = 24 * time.Hour
+	defaultRecommendationHalfLife         = 12 * time.Hour
+	defaultMemoryPressureThreshold        = 10
+	defaultMemorySafetyMarginStep         = "100Mi"
+	defaultMemorySafetyMarginMax          = "1Gi"
+	defaultMemorySafetyMarginStrategy     = memory.MarginStrategyAbsolute
+	defaultMemorySafetyMarginPercent      = 1
+	defaultMemorySafetyMarginMultiplier   = 3
+	defaultMemorySafetyMarginStdDevWindow = time.Hour
+	defaultMemoryPressureTriggerStall     = 100 * time.Millisecond
+	defaultMemoryPressureTriggerWindow    = time.Second
+	memoryReconcileInterval               = 5 * time.Second
+	defaultSystemSliceTopUnits            = 5
+	defaultProcessAttributionTop          = 10
+	defaultMemoryPeakWindow               = time.Hour
+)
+
+const (
+	// enforcementStrategyKubepods enforces the recommendation by capping the kubepods cgroup
+	enforcementStrategyKubepods = "kubepods"
+	// enforcementStrategySystem enforces the recommendation by protecting the system.slice cgroup and its kubernetes components
+	enforcementStrategySystem = "system"
+	// enforcementMemoryModeMax enforces the recommended kubepods memory limit as memory.max (memory.limit_in_bytes)
+	enforcementMemoryModeMax = "max"
+	// enforcementMemoryModeHigh enforces the recommended kubepods memory limit as memory.high (cgroupsv2 only)
+	enforcementMemoryModeHigh = "high"
+	// kubeletSystemSliceCPUShares are the CPU shares of system.slice that are not changed by the kubelet
+	kubeletSystemSliceCPUShares = 1024
 )
 
 var (
@@ -46,26 +93,156 @@ var (
 	// kubeletConfigPath is the path to the kubelet's configuration file
 	// defaults to: /var/lib/kubelet/config/kubelet
 	kubeletConfigPath string
+	// kubeletConfigCache caches the kubelet configuration file loaded in every recommendation
+	kubeletConfigCache *kubelet.ConfigurationCache
 	// memorySafetyMarginAbsolute is the additional amount of memory added to the kube-reserved memory compared to what is
 	// actually reserved by other processes + kernel
 	// this is to make sure the cgroup limit hits before the OS OOM in order to safely prevent a global OOM
 	// defaults to 100Mi
 	memorySafetyMarginAbsolute resource.Quantity
+	// memoryPressureThreshold is the memory pressure of system.slice (PSI "some" avg60 in percent) at or above which
+	// the safety margin grows by memorySafetyMarginStep per minute. A value of 0 disables the adjustment.
+	// defaults to 10
+	memoryPressureThreshold float64
+	// memorySafetyMarginStep is the amount the safety margin grows (and shrinks) by per adjustment
+	// defaults to 100Mi
+	memorySafetyMarginStep resource.Quantity
+	// memorySafetyMarginMax is the maximum safety margin (grown under memory pressure and on global OOM kills). 0 does not limit the margin.
+	// defaults to 1Gi (or the absolute safety margin if larger), unlimited with the percent or stddev strategy
+	memorySafetyMarginMax resource.Quantity
+	// memorySafetyMarginStrategy calculates the base safety margin with the comma-separated strategies (absolute, percent, stddev).
+	// With several strategies, the maximum is used.
+	// defaults to absolute
+	memorySafetyMarginStrategy memory.MarginStrategy
+	// memorySafetyMargin is the safety margin starting at the base of the memorySafetyMarginStrategy, adjusted to the memory pressure and global OOM kills
+	memorySafetyMargin *memory.SafetyMargin
+	// memoryPressureAvailable is true if the kernel exposes pressure stall information
+	memoryPressureAvailable bool
+	// memoryPressureTrigger determines if a PSI trigger is registered on /proc/pressure/memory.
+	// When it fires, the memory recommendation is made immediately and the kubepods memory limit is tightened
+	// ignoring the cool-down period and the maximum decrease.
+	memoryPressureTrigger bool
+	// memoryPressureTriggerStall is the stall time of some tasks within the memoryPressureTriggerWindow that fires the trigger
+	// defaults to 100ms
+	memoryPressureTriggerStall time.Duration
+	// memoryPressureTriggerWindow is the window of the memory pressure trigger (between 500ms and 10s)
+	// defaults to 1s
+	memoryPressureTriggerWindow time.Duration
 	// cgroupsHierarchyRoot defines where the root of the cgroup fs is mounted
 	// defaults to "/sys/fs/cgroup"
 	cgroupsHierarchyRoot string
+	// cgroupsV2 is true if the cgroup fs mounted at the cgroupsHierarchyRoot is a cgroupsv2 (unified) hierarchy
+	// detected based on the filesystem type of the mount
+	cgroupsV2 bool
+	// kubepodsCgroupsRoot defines where the kubepods cgroup is located under the cgroups hierarchy root
+	// discovered based on the kubelet's cgroup driver and cgroup root if not set
+	kubepodsCgroupsRoot string
 	// containerdCgroupsRoot defines where the root of the containerd's cgroup fs is mounted under the cgroups hierarchy root
 	// defaults to "system.slice/containerd.service"
 	containerdCgroupsRoot string
 	// kubeletCgroupsRoot defines where the root of the kubelet's cgroup fs is mounted under the cgroups hierarchy root
 	// defaults to "system.slice/kubelet.service"
 	kubeletCgroupsRoot string
+	// systemSliceTopUnits is the number of system.slice units with the highest memory working set and CPU usage shown in the table output
+	// defaults to 5
+	systemSliceTopUnits int
+	// processAttribution determines if the memory and CPU usage of non-pod processes is attributed to processes by walking /proc (requires hostPID)
+	processAttribution bool
+	// processAttributionTop is the number of non-pod processes and cgroups with the highest usage that are reported
+	// defaults to 10
+	processAttributionTop int
+	// processCollector collects the top non-pod processes if processAttribution is set
+	processCollector *process.Collector
+	// memoryPeakRecommendation determines if the memory recommendation covers the peak working set of system.slice
+	// recorded by the kernel (memory.max_usage_in_bytes / memory.peak) instead of only the sampled working set
+	memoryPeakRecommendation bool
+	// memoryPeakWindow is the interval in which the memory peaks are tracked. The recommendation covers the peak
+	// within the current and the previous window.
+	// defaults to 1h
+	memoryPeakWindow time.Duration
+	// memoryPeakTracker tracks the memory peaks of system.slice and its units if memoryPeakRecommendation is set
+	memoryPeakTracker *memory.PeakTracker
 	// period is the measurement period (e.g every 30 seconds).
 	// The recommender also uses this time to check the cpu reservation
 	period time.Duration
 	// enforceRecommendation determines if the recommendations for memory and disk are applied directly to the kubepods/system.slice cgroups
 	// the kubelet's configuration is NOT adjusted and might contain conflicting reservations
 	enforceRecommendation bool
+	// enforceKubepods determines if the recommendation is enforced by capping the kubepods cgroup (memory limit, CPU shares)
+	// defaults to true
+	enforceKubepods bool
+	// enforceSystem determines if the recommendation is enforced by protecting the non-pod processes
+	// (system.slice CPU shares, cgroupsv2 memory protection of system.slice, kubelet and containerd)
+	enforceSystem bool
+	// memoryHighMode determines if the recommended kubepods memory limit is enforced as memory.high instead of memory.max (cgroupsv2 only).
+	// Pods are throttled and pushed into reclaim instead of being OOM killed.
+	memoryHighMode bool
+	// enforcementMemoryMaxHeadroom is the amount of memory memory.max of the kubepods cgroup is set above memory.high in memory.high mode
+	// defaults to 500Mi
+	enforcementMemoryMaxHeadroom resource.Quantity
+	// enforcementDryRun determines if the cgroup writes to enforce the recommendation are only logged and exposed instead of performed
+	// implies enforceRecommendation
+	enforcementDryRun bool
+	// driftCheckInterval is the interval in which the enforced cgroup files are checked for changes by other components (e.g the kubelet)
+	// overwritten values are re-applied. A value of 0 disables the drift detection.
+	// defaults to 1s
+	driftCheckInterval time.Duration
+	// cgroupWriter writes (or in dry-run mode: records) the cgroup files to enforce the recommendation
+	cgroupWriter *enforcement.Writer
+	// enforcementMinMemoryChange is the minimum difference between the current and the target kubepods memory limit
+	// for the target to be enforced
+	// defaults to 50Mi
+	enforcementMinMemoryChange resource.Quantity
+	// enforcementMaxMemoryDecrease is the maximum amount the kubepods memory limit is decreased by a single write
+	// defaults to 200Mi
+	enforcementMaxMemoryDecrease resource.Quantity
+	// enforcementCoolDown is the minimum time between two writes of the kubepods memory limit
+	// defaults to 1m
+	enforcementCoolDown time.Duration
+	// nodeName is the name of the node reported in events
+	// defaults to the hostname
+	nodeName string
+	// eventRecorder logs Kubernetes Event-style entries for the node
+	eventRecorder *enforcement.EventRecorder
+	// memoryStabilizer decides if and which kubepods memory limit is written when enforcing the recommendation
+	memoryStabilizer *enforcement.Stabilizer
+	// evictionHardMemoryAvailable is the hard eviction threshold for memory.available (absolute or in percent)
+	// subtracted from the capacity when calculating the enforced kubepods memory limit
+	// defaults to the threshold configured in the kubelet configuration
+	evictionHardMemoryAvailable string
+	// updateKubeletConfig determines if the recommended kube-reserved and system-reserved for memory and CPU are written
+	// to the kubelet configuration file and the kubelet is restarted (via the systemd D-Bus API) to apply them
+	updateKubeletConfig bool
+	// kubeletUnit is the name of the kubelet's systemd unit
+	// defaults to "kubelet.service"
+	kubeletUnit string
+	// kubeletRestartMinInterval is the minimum time between two kubelet restarts when updating the kubelet configuration
+	// defaults to 1h
+	kubeletRestartMinInterval time.Duration
+	// kubeletConfigMinMemoryChange is the minimum change of the memory reservations that leads to an update of the kubelet configuration
+	// defaults to 100Mi
+	kubeletConfigMinMemoryChange resource.Quantity
+	// kubeletConfigMinCPUChange is the minimum change of the CPU reservations that leads to an update of the kubelet configuration
+	// defaults to 20m
+	kubeletConfigMinCPUChange resource.Quantity
+	// kubeletConfigUpdater updates the kubelet configuration and restarts the kubelet if updateKubeletConfig is set
+	kubeletConfigUpdater *kubelet.ConfigUpdater
+	// smoothRecommendation determines if the recommendations are based on the recommendationPercentile of the samples
+	// within the recommendationWindow instead of the latest sample. The smoothed recommendations are always exposed as metrics.
+	smoothRecommendation bool
+	// recommendationPercentile is the percentile (between 0 and 1) of the samples that is recommended when smoothing
+	// defaults to 0.95
+	recommendationPercentile float64
+	// recommendationWindow is the rolling window of samples considered when smoothing
+	// defaults to 24h
+	recommendationWindow time.Duration
+	// recommendationHalfLife is the time after which the weight of a sample is halved when smoothing
+	// defaults to 12h
+	recommendationHalfLife time.Duration
+	// memoryHistory is the history of target reserved memory samples
+	memoryHistory *histogram.Smoother
+	// cpuHistory is the history of non-pod CPU usage samples
+	cpuHistory *histogram.Smoother
 	// minimumReservedMemory is the minimum amount of memory that will be reserved when enforcing a recommendation
 	// Please note, recommended memory reservations can still be lower than that
 	minimumReservedMemory resource.Quantity
@@ -73,20 +250,61 @@ var (
 
 func init() {
 	kubeletDirectory = os.Getenv("KUBELET_DIRECTORY")
+	kubeletConfigPath = os.Getenv("KUBELET_CONFIG_PATH")
 	containerdStateDirectory = os.Getenv("CONTAINERD_STATE_DIRECTORY")
 	containerdRootDirectory = os.Getenv("CONTAINERD_ROOT_DIRECTORY")
 	memorySafetyMarginString := os.Getenv("MEMORY_SAFETY_MARGIN_ABSOLUTE")
+	pressureThreshold := os.Getenv("MEMORY_PRESSURE_THRESHOLD")
+	marginStep := os.Getenv("MEMORY_SAFETY_MARGIN_STEP")
+	marginMax := os.Getenv("MEMORY_SAFETY_MARGIN_MAX")
+	marginStrategy := os.Getenv("MEMORY_SAFETY_MARGIN_STRATEGY")
+	marginPercent := os.Getenv("MEMORY_SAFETY_MARGIN_PERCENT")
+	marginStdDevMultiplier := os.Getenv("MEMORY_SAFETY_MARGIN_STDDEV_MULTIPLIER")
+	marginStdDevWindow := os.Getenv("MEMORY_SAFETY_MARGIN_STDDEV_WINDOW")
+	trigger := os.Getenv("MEMORY_PRESSURE_TRIGGER")
+	triggerStall := os.Getenv("MEMORY_PRESSURE_TRIGGER_STALL")
+	triggerWindow := os.Getenv("MEMORY_PRESSURE_TRIGGER_WINDOW")
 	cgroupsHierarchyRoot = os.Getenv("CGROUPS_HIERARCHY_ROOT")
+	kubepodsCgroupsRoot = os.Getenv("CGROUPS_KUBEPODS_ROOT")
 	containerdCgroupsRoot = os.Getenv("CGROUPS_CONTAINERD_ROOT")
 	kubeletCgroupsRoot = os.Getenv("CGROUPS_KUBELET_ROOT")
+	topUnits := os.Getenv("SYSTEM_SLICE_TOP_UNITS")
+	attribution := os.Getenv("PROCESS_ATTRIBUTION")
+	attributionTop := os.Getenv("PROCESS_ATTRIBUTION_TOP")
+	peakRecommendation := os.Getenv("MEMORY_PEAK_RECOMMENDATION")
+	peakWindow := os.Getenv("MEMORY_PEAK_WINDOW")
 	periodString := os.Getenv("PERIOD")
 	enforce := os.Getenv("ENFORCE_RECOMMENDATION")
+	dryRun := os.Getenv("ENFORCEMENT_DRY_RUN")
+	strategy := os.Getenv("ENFORCEMENT_STRATEGY")
+	memoryMode := os.Getenv("ENFORCEMENT_MEMORY_MODE")
+	memoryMaxHeadroom := os.Getenv("ENFORCEMENT_MEMORY_MAX_HEADROOM")
+	driftInterval := os.Getenv("DRIFT_CHECK_INTERVAL")
 	minReservedMemory := os.Getenv("MINIMUM_RESERVED_MEMORY")
+	evictionHardMemoryAvailable = os.Getenv("EVICTION_HARD_MEMORY_AVAILABLE")
+	minEnforcedMemoryChange := os.Getenv("ENFORCEMENT_MIN_MEMORY_CHANGE")
+	maxEnforcedMemoryDecrease := os.Getenv("ENFORCEMENT_MAX_MEMORY_DECREASE")
+	coolDown := os.Getenv("ENFORCEMENT_COOL_DOWN")
+	nodeName = os.Getenv("NODE_NAME")
+	updateConfig := os.Getenv("UPDATE_KUBELET_CONFIG")
+	kubeletUnit = os.Getenv("KUBELET_UNIT")
+	restartMinInterval := os.Getenv("KUBELET_RESTART_MIN_INTERVAL")
+	minMemoryChange := os.Getenv("KUBELET_CONFIG_MIN_MEMORY_CHANGE")
+	minCPUChange := os.Getenv("KUBELET_CONFIG_MIN_CPU_CHANGE")
+	smooth := os.Getenv("SMOOTH_RECOMMENDATION")
+	percentile := os.Getenv("RECOMMENDATION_PERCENTILE")
+	window := os.Getenv("RECOMMENDATION_WINDOW")
+	halfLife := os.Getenv("RECOMMENDATION_HALF_LIFE")
 
 	if len(kubeletDirectory) == 0 {
 		kubeletDirectory = defaultKubeletDirectory
 	}
 
+	if len(kubeletConfigPath) == 0 {
+		kubeletConfigPath = defaultKubeletConfigPath
+	}
+	kubeletConfigCache = kubelet.NewConfigurationCache(kubeletConfigPath)
+
 	if len(containerdStateDirectory) == 0 {
 		containerdStateDirectory = defaultContainerdStateDirectory
 	}
@@ -114,6 +332,145 @@ func init() {
 	}
 
 	var err error
+	systemSliceTopUnits = defaultSystemSliceTopUnits
+	if len(topUnits) > 0 {
+		systemSliceTopUnits, err = strconv.Atoi(topUnits)
+		if err != nil || systemSliceTopUnits < 0 {
+			log.Fatalf("The SYSTEM_SLICE_TOP_UNITS env variable is invalid: must be a non-negative number")
+		}
+	}
+
+	if len(attribution) > 0 {
+		processAttribution, err = strconv.ParseBool(attribution)
+		if err != nil {
+			log.Fatalf("The PROCESS_ATTRIBUTION env variable is invalid: must be boolean: %v", err)
+		}
+	}
+
+	processAttributionTop = defaultProcessAttributionTop
+	if len(attributionTop) > 0 {
+		processAttributionTop, err = strconv.Atoi(attributionTop)
+		if err != nil || processAttributionTop <= 0 {
+			log.Fatalf("The PROCESS_ATTRIBUTION_TOP env variable is invalid: must be a positive number")
+		}
+	}
+
+	if len(peakRecommendation) > 0 {
+		memoryPeakRecommendation, err = strconv.ParseBool(peakRecommendation)
+		if err != nil {
+			log.Fatalf("The MEMORY_PEAK_RECOMMENDATION env variable is invalid: must be boolean: %v", err)
+		}
+	}
+
+	memoryPeakWindow = defaultMemoryPeakWindow
+	if len(peakWindow) > 0 {
+		memoryPeakWindow, err = time.ParseDuration(peakWindow)
+		if err != nil || memoryPeakWindow <= 0 {
+			log.Fatalf("The MEMORY_PEAK_WINDOW env variable is invalid: must be a positive duration")
+		}
+	}
+
+	memoryPressureThreshold = defaultMemoryPressureThreshold
+	if len(pressureThreshold) > 0 {
+		memoryPressureThreshold, err = strconv.ParseFloat(pressureThreshold, 64)
+		if err != nil || memoryPressureThreshold < 0 || memoryPressureThreshold > 100 {
+			log.Fatalf("The MEMORY_PRESSURE_THRESHOLD env variable is invalid: must be a percentage in [0, 100]")
+		}
+	}
+
+	if len(marginStep) == 0 {
+		marginStep = defaultMemorySafetyMarginStep
+	}
+	memorySafetyMarginStep, err = resource.ParseQuantity(marginStep)
+	if err != nil {
+		log.Fatalf("The MEMORY_SAFETY_MARGIN_STEP env variable is invalid: %v", err)
+	}
+
+	if len(marginStrategy) == 0 {
+		marginStrategy = defaultMemorySafetyMarginStrategy
+	}
+	memorySafetyMarginStrategy = memory.MarginStrategy{
+		Absolute:         memorySafetyMarginAbsolute,
+		Percent:          defaultMemorySafetyMarginPercent,
+		StdDevMultiplier: defaultMemorySafetyMarginMultiplier,
+		StdDevWindow:     defaultMemorySafetyMarginStdDevWindow,
+	}
+	for _, strategy := range strings.Split(marginStrategy, ",") {
+		strategy = strings.TrimSpace(strategy)
+		valid := false
+		for _, supported := range memory.MarginStrategies {
+			valid = valid || strategy == supported
+		}
+		if !valid {
+			log.Fatalf("The MEMORY_SAFETY_MARGIN_STRATEGY env variable is invalid: %q is not one of %v", strategy, memory.MarginStrategies)
+		}
+		memorySafetyMarginStrategy.Strategies = append(memorySafetyMarginStrategy.Strategies, strategy)
+	}
+
+	if len(marginPercent) > 0 {
+		memorySafetyMarginStrategy.Percent, err = strconv.ParseFloat(marginPercent, 64)
+		if err != nil || memorySafetyMarginStrategy.Percent <= 0 || memorySafetyMarginStrategy.Percent > 100 {
+			log.Fatalf("The MEMORY_SAFETY_MARGIN_PERCENT env variable is invalid: must be a percentage in (0, 100]")
+		}
+	}
+
+	if len(marginStdDevMultiplier) > 0 {
+		memorySafetyMarginStrategy.StdDevMultiplier, err = strconv.ParseFloat(marginStdDevMultiplier, 64)
+		if err != nil || memorySafetyMarginStrategy.StdDevMultiplier <= 0 {
+			log.Fatalf("The MEMORY_SAFETY_MARGIN_STDDEV_MULTIPLIER env variable is invalid: must be a positive number")
+		}
+	}
+
+	if len(marginStdDevWindow) > 0 {
+		memorySafetyMarginStrategy.StdDevWindow, err = time.ParseDuration(marginStdDevWindow)
+		if err != nil || memorySafetyMarginStrategy.StdDevWindow <= 0 {
+			log.Fatalf("The MEMORY_SAFETY_MARGIN_STDDEV_WINDOW env variable is invalid: must be a positive duration")
+		}
+	}
+
+	// the margins of the percent and stddev strategies depend on the node and are not limited by default
+	relativeMargin := memorySafetyMarginStrategy.Enabled(memory.MarginStrategyPercent) || memorySafetyMarginStrategy.Enabled(memory.MarginStrategyStdDev)
+	switch {
+	case len(marginMax) == 0 && relativeMargin:
+		memorySafetyMarginMax = resource.Quantity{}
+	case len(marginMax) == 0:
+		// an existing safety margin above the default maximum must keep working after an upgrade
+		memorySafetyMarginMax = resource.MustParse(defaultMemorySafetyMarginMax)
+		if memorySafetyMarginMax.Cmp(memorySafetyMarginAbsolute) < 0 {
+			memorySafetyMarginMax = memorySafetyMarginAbsolute.DeepCopy()
+		}
+	default:
+		if memorySafetyMarginMax, err = resource.ParseQuantity(marginMax); err != nil {
+			log.Fatalf("The MEMORY_SAFETY_MARGIN_MAX env variable is invalid: %v", err)
+		}
+	}
+	if memorySafetyMarginStrategy.Enabled(memory.MarginStrategyAbsolute) && !memorySafetyMarginMax.IsZero() && memorySafetyMarginMax.Cmp(memorySafetyMarginAbsolute) < 0 {
+		log.Fatalf("The MEMORY_SAFETY_MARGIN_MAX env variable is invalid: must not be lower than the absolute safety margin %s", memorySafetyMarginAbsolute.String())
+	}
+
+	if len(trigger) > 0 {
+		memoryPressureTrigger, err = strconv.ParseBool(trigger)
+		if err != nil {
+			log.Fatalf("The MEMORY_PRESSURE_TRIGGER env variable is invalid: must be boolean: %v", err)
+		}
+	}
+
+	memoryPressureTriggerStall = defaultMemoryPressureTriggerStall
+	if len(triggerStall) > 0 {
+		memoryPressureTriggerStall, err = time.ParseDuration(triggerStall)
+		if err != nil {
+			log.Fatalf("The MEMORY_PRESSURE_TRIGGER_STALL env variable is invalid: %v", err)
+		}
+	}
+
+	memoryPressureTriggerWindow = defaultMemoryPressureTriggerWindow
+	if len(triggerWindow) > 0 {
+		memoryPressureTriggerWindow, err = time.ParseDuration(triggerWindow)
+		if err != nil {
+			log.Fatalf("The MEMORY_PRESSURE_TRIGGER_WINDOW env variable is invalid: %v", err)
+		}
+	}
+
 	if len(enforce) > 0 {
 		enforceRecommendation, err = strconv.ParseBool(enforce)
 		if err != nil {
@@ -121,6 +478,55 @@ func init() {
 		}
 	}
 
+	if len(dryRun) > 0 {
+		enforcementDryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			log.Fatalf("The ENFORCEMENT_DRY_RUN env variable is invalid: must be boolean: %v", err)
+		}
+		if enforcementDryRun {
+			enforceRecommendation = true
+		}
+	}
+
+	if len(strategy) == 0 {
+		strategy = enforcementStrategyKubepods
+	}
+	for _, s := range strings.Split(strategy, ",") {
+		switch strings.TrimSpace(s) {
+		case enforcementStrategyKubepods:
+			enforceKubepods = true
+		case enforcementStrategySystem:
+			enforceSystem = true
+		default:
+			log.Fatalf("The ENFORCEMENT_STRATEGY env variable is invalid: unknown strategy %q (must be a comma separated list of %q, %q)", s, enforcementStrategyKubepods, enforcementStrategySystem)
+		}
+	}
+
+	switch memoryMode {
+	case "", enforcementMemoryModeMax:
+	case enforcementMemoryModeHigh:
+		memoryHighMode = true
+	default:
+		log.Fatalf("The ENFORCEMENT_MEMORY_MODE env variable is invalid: must be %q or %q", enforcementMemoryModeMax, enforcementMemoryModeHigh)
+	}
+
+	if len(memoryMaxHeadroom) == 0 {
+		memoryMaxHeadroom = defaultEnforcementMemoryMaxHeadroom
+	}
+	enforcementMemoryMaxHeadroom, err = resource.ParseQuantity(memoryMaxHeadroom)
+	if err != nil {
+		log.Fatalf("The ENFORCEMENT_MEMORY_MAX_HEADROOM env variable is invalid: %v", err)
+	}
+
+	if len(driftInterval) == 0 {
+		driftCheckInterval = defaultDriftCheckInterval
+	} else {
+		driftCheckInterval, err = time.ParseDuration(driftInterval)
+		if err != nil || driftCheckInterval < 0 {
+			log.Fatalf("The DRIFT_CHECK_INTERVAL env variable is invalid: must be a non-negative duration")
+		}
+	}
+
 	if len(minReservedMemory) != 0 {
 		minimumReservedMemory, err = resource.ParseQuantity(minReservedMemory)
 		if err != nil {
@@ -128,6 +534,111 @@ func init() {
 		}
 	}
 
+	if len(nodeName) == 0 {
+		nodeName, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("The NODE_NAME env variable is not set and the hostname cannot be determined: %v", err)
+		}
+	}
+
+	if len(minEnforcedMemoryChange) == 0 {
+		minEnforcedMemoryChange = defaultEnforcementMinMemoryChange
+	}
+	enforcementMinMemoryChange, err = resource.ParseQuantity(minEnforcedMemoryChange)
+	if err != nil {
+		log.Fatalf("The ENFORCEMENT_MIN_MEMORY_CHANGE env variable is invalid: %v", err)
+	}
+
+	if len(maxEnforcedMemoryDecrease) == 0 {
+		maxEnforcedMemoryDecrease = defaultEnforcementMaxMemoryDecrease
+	}
+	enforcementMaxMemoryDecrease, err = resource.ParseQuantity(maxEnforcedMemoryDecrease)
+	if err != nil {
+		log.Fatalf("The ENFORCEMENT_MAX_MEMORY_DECREASE env variable is invalid: %v", err)
+	}
+
+	if len(coolDown) == 0 {
+		enforcementCoolDown = defaultEnforcementCoolDown
+	} else {
+		enforcementCoolDown, err = time.ParseDuration(coolDown)
+		if err != nil {
+			log.Fatalf("The ENFORCEMENT_COOL_DOWN env variable is invalid: %v", err)
+		}
+	}
+
+	if len(evictionHardMemoryAvailable) != 0 {
+		if _, err := kubelet.ParseThreshold(evictionHardMemoryAvailable, resource.Quantity{}); err != nil {
+			log.Fatalf("The EVICTION_HARD_MEMORY_AVAILABLE env variable is invalid: %v", err)
+		}
+	}
+
+	if len(updateConfig) > 0 {
+		updateKubeletConfig, err = strconv.ParseBool(updateConfig)
+		if err != nil {
+			log.Fatalf("The UPDATE_KUBELET_CONFIG env variable is invalid: must be boolean: %v", err)
+		}
+	}
+
+	if len(kubeletUnit) == 0 {
+		kubeletUnit = kubelet.DefaultKubeletUnit
+	}
+
+	if len(restartMinInterval) == 0 {
+		kubeletRestartMinInterval = defaultKubeletRestartMinInterval
+	} else {
+		kubeletRestartMinInterval, err = time.ParseDuration(restartMinInterval)
+		if err != nil {
+			log.Fatalf("The KUBELET_RESTART_MIN_INTERVAL env variable is invalid: %v", err)
+		}
+	}
+
+	if len(minMemoryChange) == 0 {
+		minMemoryChange = defaultKubeletConfigMinMemoryChange
+	}
+	kubeletConfigMinMemoryChange, err = resource.ParseQuantity(minMemoryChange)
+	if err != nil {
+		log.Fatalf("The KUBELET_CONFIG_MIN_MEMORY_CHANGE env variable is invalid: %v", err)
+	}
+
+	if len(minCPUChange) == 0 {
+		minCPUChange = defaultKubeletConfigMinCPUChange
+	}
+	kubeletConfigMinCPUChange, err = resource.ParseQuantity(minCPUChange)
+	if err != nil {
+		log.Fatalf("The KUBELET_CONFIG_MIN_CPU_CHANGE env variable is invalid: %v", err)
+	}
+
+	if len(smooth) > 0 {
+		smoothRecommendation, err = strconv.ParseBool(smooth)
+		if err != nil {
+			log.Fatalf("The SMOOTH_RECOMMENDATION env variable is invalid: must be boolean: %v", err)
+		}
+	}
+
+	recommendationPercentile = defaultRecommendationPercentile
+	if len(percentile) > 0 {
+		recommendationPercentile, err = strconv.ParseFloat(percentile, 64)
+		if err != nil || recommendationPercentile <= 0 || recommendationPercentile > 1 {
+			log.Fatalf("The RECOMMENDATION_PERCENTILE env variable is invalid: must be a number in (0, 1]")
+		}
+	}
+
+	recommendationWindow = defaultRecommendationWindow
+	if len(window) > 0 {
+		recommendationWindow, err = time.ParseDuration(window)
+		if err != nil || recommendationWindow <= 0 {
+			log.Fatalf("The RECOMMENDATION_WINDOW env variable is invalid: must be a positive duration")
+		}
+	}
+
+	recommendationHalfLife = defaultRecommendationHalfLife
+	if len(halfLife) > 0 {
+		recommendationHalfLife, err = time.ParseDuration(halfLife)
+		if err != nil || recommendationHalfLife <= 0 {
+			log.Fatalf("The RECOMMENDATION_HALF_LIFE env variable is invalid: must be a positive duration")
+		}
+	}
+
 	if len(periodString) == 0 {
 		period = 20 * time.Second
 	} else {
@@ -140,18 +651,110 @@ func init() {
 }
 
 func main() {
+	var err error
+	cgroupsV2, err = cgroupfs.IsUnifiedHierarchy(cgroupsHierarchyRoot)
+	if err != nil {
+		log.Fatalf("fatal - failed to detect the cgroup version: %v", err)
+	}
+
+	if len(kubepodsCgroupsRoot) == 0 {
+		kubeletConfig := loadKubeletConfiguration()
+
+		// for cgroupsv1, the kubepods cgroup is the same for every controller
+		cgroupsHierarchyMemory := cgroupsHierarchyRoot
+		if !cgroupsV2 {
+			cgroupsHierarchyMemory = filepath.Join(cgroupsHierarchyRoot, string(cgroups.Memory))
+		}
+
+		kubepodsCgroupsRoot, err = kubelet.DiscoverKubepodsCgroupName(cgroupsHierarchyMemory, kubeletConfig)
+		if err != nil {
+			log.Fatalf("fatal - failed to discover the kubepods cgroup: %v", err)
+		}
+	}
+
 	log.Infof("Kubelet directory: %s", kubeletDirectory)
-	log.Infof("CgroupsV1 hierarchy root: %s", cgroupsHierarchyRoot)
-	log.Infof("Recommended memory safety margin: %s", memorySafetyMarginAbsolute.String())
+	log.Infof("Kubelet configuration: %s", kubeletConfigPath)
+	log.Infof("Cgroups hierarchy root: %s (cgroupsv2: %v)", cgroupsHierarchyRoot, cgroupsV2)
+	log.Infof("Kubepods cgroup: %s", kubepodsCgroupsRoot)
+	log.Infof("Memory safety margin strategies: %s (absolute: %s | percent: %.2f%% | stddev multiplier: %.2f, window: %s)",
+		strings.Join(memorySafetyMarginStrategy.Strategies, ","),
+		memorySafetyMarginAbsolute.String(),
+		memorySafetyMarginStrategy.Percent,
+		memorySafetyMarginStrategy.StdDevMultiplier,
+		memorySafetyMarginStrategy.StdDevWindow.String())
+	memoryPressureAvailable = psi.Available()
+	if memoryPressureAvailable {
+		log.Infof("Memory pressure threshold (system.slice): %.2f%% | safety margin step: %s, maximum: %s", memoryPressureThreshold, memorySafetyMarginStep.String(), safetyMarginMaxString())
+		if !cgroupsV2 {
+			log.Infof("Memory pressure per cgroup requires cgroupsv2. The safety margin is not adjusted to the memory pressure.")
+		}
+	} else {
+		log.Infof("Pressure stall information is not available. The safety margin is not adjusted to the memory pressure.")
+	}
 	log.Infof("Minimum reserved memory: %s", minimumReservedMemory.String())
+	if len(evictionHardMemoryAvailable) > 0 {
+		log.Infof("Hard eviction threshold memory.available: %s", evictionHardMemoryAvailable)
+	}
 	log.Infof("Period: %s", period.String())
-	log.Infof("Enforce recommendation: %v", enforceRecommendation)
+	log.Infof("Enforce recommendation: %v (dry-run: %v)", enforceRecommendation, enforcementDryRun)
+	if enforceRecommendation {
+		log.Infof("Enforcement strategy: kubepods: %v | system: %v", enforceKubepods, enforceSystem)
+		log.Infof("Memory enforcement: minimum change: %s | maximum decrease: %s | cool-down: %s", enforcementMinMemoryChange.String(), enforcementMaxMemoryDecrease.String(), enforcementCoolDown.String())
+		if memoryHighMode {
+			if !cgroupsV2 {
+				log.Fatalf("fatal - enforcing the kubepods memory limit as memory.high requires cgroupsv2")
+			}
+			log.Infof("Memory enforcement mode: memory.high (memory.max headroom: %s)", enforcementMemoryMaxHeadroom.String())
+		}
+		if enforceSystem && !cgroupsV2 {
+			log.Warnf("Memory protection of the non-pod processes requires cgroupsv2. Only the CPU shares of system.slice are enforced.")
+		}
+	}
+
+	memorySafetyMargin = memory.NewAdaptiveSafetyMargin(memorySafetyMarginStrategy, memorySafetyMarginStep, memorySafetyMarginMax, memoryPressureThreshold)
+	eventRecorder = enforcement.NewEventRecorder(log, nodeName)
+	go memory.NewOOMWatcher(log, cgroupsHierarchyRoot, cgroupsV2, handleOOMKill, kubepodsCgroupsRoot, types.SystemSliceCgroupName).Run(make(chan struct{}))
+	cgroupWriter = enforcement.NewWriter(log, enforcementDryRun)
+	memoryStabilizer = enforcement.NewStabilizer(kubelet.ResourceMemory, enforcementMinMemoryChange.Value(), enforcementMaxMemoryDecrease.Value(), enforcementCoolDown)
+
+	if enforceRecommendation && !enforcementDryRun && driftCheckInterval > 0 {
+		log.Infof("Drift check interval: %s", driftCheckInterval.String())
+		go enforcement.NewDriftDetector(log, cgroupWriter, eventRecorder, driftCheckInterval, guardKubepodsMemoryLimit).Run(make(chan struct{}))
+	}
+
+	log.Infof("Update kubelet configuration: %v", updateKubeletConfig)
+	log.Infof("Smooth recommendation: %v (percentile: %.2f, window: %s, half-life: %s)", smoothRecommendation, recommendationPercentile, recommendationWindow.String(), recommendationHalfLife.String())
 
-	memTotal, _, err := memory.ParseProcMemInfo()
+	memoryHistory = histogram.NewSmoother(memory.HistogramOptions, recommendationWindow, recommendationHalfLife, recommendationPercentile, smoothRecommendation)
+	cpuHistory = histogram.NewSmoother(cpu.HistogramOptions, recommendationWindow, recommendationHalfLife, recommendationPercentile, smoothRecommendation)
+
+	if updateKubeletConfig {
+		log.Infof("Kubelet unit: %s | minimum restart interval: %s | minimum change memory: %s, CPU: %s", kubeletUnit, kubeletRestartMinInterval.String(), kubeletConfigMinMemoryChange.String(), kubeletConfigMinCPUChange.String())
+		if enforceRecommendation {
+			log.Warnf("Both enforcing the recommendation and updating the kubelet configuration is enabled. The kubelet overwrites the enforced values on restart.")
+		}
+
+		kubeletConfigUpdater = kubelet.NewConfigUpdater(kubeletConfigPath, kubeletUnit, kubelet.NewSystemdRestarter(), kubeletRestartMinInterval, map[string]resource.Quantity{
+			kubelet.ResourceMemory: kubeletConfigMinMemoryChange,
+			kubelet.ResourceCPU:    kubeletConfigMinCPUChange,
+		})
+	}
+
+	log.Infof("Process attribution: %v (top: %d)", processAttribution, processAttributionTop)
+	if processAttribution {
+		processCollector = process.NewCollector(log, process.ProcRoot, cgroupsHierarchyRoot, cgroupsV2, kubepodsCgroupsRoot, processAttributionTop)
+	}
+
+	log.Infof("Peak-based memory recommendation: %v (window: %s)", memoryPeakRecommendation, memoryPeakWindow.String())
+	if memoryPeakRecommendation {
+		memoryPeakTracker = memory.NewPeakTracker(log, cgroupsHierarchyRoot, cgroupsV2, memoryPeakWindow)
+	}
+
+	meminfo, err := memory.ParseProcMemInfo()
 	if err != nil {
 		log.Fatalf("fatal -failed to read /proc/meminfo: %v", err)
 	}
-	log.Infof("Memory capacity: %s", humanize.IBytes(uint64(memTotal.Value())))
+	log.Infof("Memory capacity: %s", humanize.IBytes(uint64(meminfo.MemTotal.Value())))
 
 	numCPU := int64(runtime.NumCPU())
 	log.Infof("CPU cores: %d", numCPU)
@@ -159,37 +762,86 @@ func main() {
 	go func() {
 		for {
 			// we measure the CPU consumption as the average CPU consumption over period/2 amount of time
-			if err := recommendCPUReservation(period/2, numCPU); err != nil {
+			kubeletConfig := loadKubeletConfiguration()
+
+			if err := recommendCPUReservation(period/2, numCPU, kubeletConfig); err != nil {
 				log.Warnf("error during reconciliation: %v", err)
 			}
 
+			// the CPU usage of the processes is measured since the previous collection
+			if processCollector != nil {
+				snapshot, err := processCollector.Collect()
+				if err != nil {
+					log.Warnf("failed to collect the non-pod processes: %v", err)
+				} else {
+					process.LogSnapshot(snapshot)
+				}
+			}
+
 			fmt.Println("")
 
 			// we measure the CPU consumption as the average CPU consumption over period/2 amount of time
-			if err := recommendDiskReservation(containerdRootDirectory, containerdStateDirectory, kubeletDirectory); err != nil {
+			if err := recommendDiskReservation(containerdRootDirectory, containerdStateDirectory, kubeletDirectory, kubeletConfig); err != nil {
 				log.Warnf("error during reconciliation: %v", err)
 			}
 
+			if err := reportPIDReservation(kubeletConfig); err != nil {
+				log.Warnf("error during reconciliation: %v", err)
+			}
+
+			if kubeletConfigUpdater != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), kubeletRestartTimeout)
+				if _, err := kubeletConfigUpdater.Reconcile(ctx, log); err != nil {
+					log.Warnf("failed to update the kubelet configuration: %v", err)
+				}
+				cancel()
+			}
+
 			// after the business logic is done, sleep for another period/2
 			// the overall time between executions of business logic will be slightly larger than period
 			time.Sleep(period / 2)
 		}
 	}()
 
+	// a nil channel never receives if the memory pressure trigger is disabled
+	var memoryPressureTriggered chan struct{}
+	if memoryPressureTrigger {
+		trigger, err := psi.NewTrigger(psi.ProcPressureMemory, "some", memoryPressureTriggerStall, memoryPressureTriggerWindow)
+		if err != nil {
+			log.Warnf("Failed to register the memory pressure trigger. Only reconciling every %s: %v", memoryReconcileInterval.String(), err)
+		} else {
+			log.Infof("Memory pressure trigger: stall of %s within %s", memoryPressureTriggerStall.String(), memoryPressureTriggerWindow.String())
+			memoryPressureTriggered = make(chan struct{}, 1)
+			go memory.WatchMemoryPressure(log, trigger, memoryPressureTriggered, make(chan struct{}))
+		}
+	}
+
 	// start a dedicated goroutine for memory reservation + enforcement
 	// this should run with a high frequency to be able to effectively protect the system in case of
 	// system.slice memory usage spikes
+	// In addition, the memory pressure trigger wakes up the goroutine immediately to tighten the kubepods memory limit
 	go func() {
+		emergency := false
 		for {
-			if err := recommendMemoryReservation(); err != nil {
+			if err := recommendMemoryReservation(loadKubeletConfiguration(), emergency); err != nil {
 				log.Warnf("error during reconciliation: %v", err)
 			}
 
-			time.Sleep(5 * time.Second)
+			select {
+			case <-time.After(memoryReconcileInterval):
+				emergency = false
+			case <-memoryPressureTriggered:
+				log.Warnf("Memory pressure trigger fired: stall of %s within %s", memoryPressureTriggerStall.String(), memoryPressureTriggerWindow.String())
+				emergency = true
+			}
 		}
 	}()
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/enforcement/writes", cgroupWriter)
+	if processCollector != nil {
+		http.Handle("/processes", processCollector)
+	}
 	if err := http.ListenAndServe(":16911", nil); err != nil {
 		log.Fatalf("terminating server: %v", err)
 	}
@@ -198,21 +850,204 @@ func main() {
 
 // recommendReservedMemory recommends and optionally enforces kubelet reserved resources.
 // - Memory -> Goal: cgroup limit on the kubepods memory cgroup is set properly preventing a "global" OOM
-func recommendMemoryReservation() error {
-	targetKubepodsMemoryLimitInBytes, err := memory.RecommendReservedMemory(log, minimumReservedMemory, memorySafetyMarginAbsolute, cgroupsHierarchyRoot, containerdCgroupsRoot, kubeletCgroupsRoot)
+// In an emergency (acute memory pressure), the kubepods memory limit is tightened immediately.
+func recommendMemoryReservation(kubeletConfig *kubelet.Configuration, emergency bool) error {
+	if memoryPressureAvailable {
+		observeMemoryPressure()
+	}
+
+	previousSafetyMargin := memorySafetyMargin.Get()
+	recommendation, err := memory.RecommendReservedMemory(log, minimumReservedMemory, memorySafetyMargin, cgroupsHierarchyRoot, cgroupsV2, kubepodsCgroupsRoot, containerdCgroupsRoot, kubeletCgroupsRoot, systemSliceTopUnits, memoryPeakTracker, kubeletConfig, evictionHardMemoryAvailable, memoryHistory)
 	if err != nil {
 		return fmt.Errorf("failed to make memory recommendation: %w", err)
 	}
 
-	if enforceRecommendation {
-		memoryController := cgroups.NewMemory(cgroupsHierarchyRoot)
+	if recommendation.SafetyMarginChanged {
+		eventRecorder.Eventf(enforcement.EventTypeNormal, "SafetyMarginAdjusted", "Memory safety margin changed from %s to %s (strategies: %s)",
+			previousSafetyMargin.String(), recommendation.SafetyMargin.String(), strings.Join(memorySafetyMarginStrategy.Strategies, ","))
+	}
+
+	if kubeletConfigUpdater != nil {
+		kubeletConfigUpdater.SetTarget(kubelet.ResourceMemory, recommendation.Reservations)
+	}
+
+	if !enforceRecommendation {
+		return nil
+	}
 
-		if err := memoryController.Update(types.DefaultkubepodsCgroupName, &specs.LinuxResources{
-			Memory: &specs.LinuxMemory{
-				Limit: pointer.Int64Ptr(targetKubepodsMemoryLimitInBytes.Value()),
-			},
-		}); err != nil {
-			return fmt.Errorf("failed to enforce memory recommendation on the kubepods cgroup: %v", err)
+	if enforceSystem && cgroupsV2 {
+		if err := enforceSystemMemoryProtection(recommendation); err != nil {
+			return fmt.Errorf("failed to enforce memory protection on the non-pod cgroups: %w", err)
+		}
+	}
+
+	if enforceKubepods {
+		return enforceKubepodsMemoryLimit(recommendation, emergency)
+	}
+	return nil
+}
+
+// observeMemoryPressure records the memory pressure and adjusts the safety margin to the memory pressure of system.slice
+func observeMemoryPressure() {
+	pressure, err := memory.RecordMemoryPressure(cgroupsHierarchyRoot, cgroupsV2, types.SystemSliceCgroupName, kubeletCgroupsRoot, containerdCgroupsRoot, kubepodsCgroupsRoot)
+	if err != nil {
+		log.Warnf("%v", err)
+	}
+
+	systemSlicePressure, ok := pressure[types.SystemSliceCgroupName]
+	if !ok {
+		return
+	}
+
+	previous := memorySafetyMargin.Get()
+	if margin, changed := memorySafetyMargin.ObservePressure(systemSlicePressure.Some.Avg60, time.Now()); changed {
+		eventRecorder.Eventf(enforcement.EventTypeNormal, "SafetyMarginAdjusted", "Memory safety margin changed from %s to %s (system.slice memory pressure avg60: %.2f%%)",
+			previous.String(), margin.String(), systemSlicePressure.Some.Avg60)
+	}
+}
+
+// safetyMarginMaxString returns the maximum safety margin for logs and events
+func safetyMarginMaxString() string {
+	if memorySafetyMarginMax.IsZero() {
+		return "unlimited"
+	}
+	return memorySafetyMarginMax.String()
+}
+
+// handleOOMKill logs OOM kills and grows the safety margin on every global OOM kill,
+// as the reservation failed to protect the node
+func handleOOMKill(scope, message string) {
+	if len(message) == 0 {
+		message = "detected via /proc/vmstat"
+	}
+
+	switch scope {
+	case memory.OOMScopeCgroup:
+		log.Infof("Cgroup OOM kill: %s", message)
+		return
+	case memory.OOMScopeUnknown:
+		log.Infof("OOM kill of unknown scope: %s", message)
+		return
+	}
+
+	previous := memorySafetyMargin.Get()
+	margin, _ := memorySafetyMargin.GrowOnOOM()
+	eventRecorder.Eventf(enforcement.EventTypeWarning, "GlobalOOMKill", "Global OOM kill (%s). Memory safety margin changed from %s to %s (maximum: %s)",
+		message, previous.String(), margin.String(), safetyMarginMaxString())
+}
+
+// enforceKubepodsMemoryLimit enforces the recommended memory limit on the kubepods cgroup.
+// In an emergency, the limit is only tightened, but ignoring the cool-down period and the maximum decrease.
+func enforceKubepodsMemoryLimit(recommendation memory.Recommendation, emergency bool) error {
+	targetKubepodsMemoryLimitInBytes := recommendation.TargetKubepodsLimitInBytes
+
+	// read the working set right before writing to never lower the limit below what the pods currently use.
+	// The usage includes the inactive page cache which the kernel reclaims when the limit is lowered.
+	kubepodsMemoryWorkingSet, err := memory.GetMemoryWorkingSet(cgroupsHierarchyRoot, kubepodsCgroupsRoot, cgroupsV2)
+	if err != nil {
+		return fmt.Errorf("failed to read the kubepods memory working set before enforcing the memory recommendation: %w", err)
+	}
+
+	// in memory.high mode, the recommended limit is enforced as memory.high
+	limitFile := kubepodsMemoryLimitFile()
+	currentKubepodsMemoryLimitInBytes := recommendation.CurrentKubepodsLimitInBytes
+	if memoryHighMode {
+		limitFile = kubepodsMemoryHighFile()
+		high, err := cgroupfs.ReadLimit(limitFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", limitFile, err)
+		}
+
+		// without memory.high set, the kubepods cgroup is effectively throttled at the capacity
+		currentKubepodsMemoryLimitInBytes = *resource.NewQuantity(high, resource.BinarySI)
+		if currentKubepodsMemoryLimitInBytes.Cmp(recommendation.Capacity) > 0 {
+			currentKubepodsMemoryLimitInBytes = recommendation.Capacity.DeepCopy()
+		}
+	}
+
+	// prevent a jittering kubepods memory limit and sharp drops caused by single samples
+	var decision enforcement.Decision
+	if emergency {
+		decision = memoryStabilizer.DecideEmergency(currentKubepodsMemoryLimitInBytes.Value(), targetKubepodsMemoryLimitInBytes.Value(), kubepodsMemoryWorkingSet.Value())
+	} else {
+		decision = memoryStabilizer.Decide(currentKubepodsMemoryLimitInBytes.Value(), targetKubepodsMemoryLimitInBytes.Value(), kubepodsMemoryWorkingSet.Value())
+	}
+	if decision.UsageConflict {
+		eventRecorder.Eventf(enforcement.EventTypeWarning, "KubepodsMemoryLimitBelowUsage", "Target kubepods memory limit %s is below the kubepods memory working set %s (current limit: %s): %s",
+			targetKubepodsMemoryLimitInBytes.String(), kubepodsMemoryWorkingSet.String(), currentKubepodsMemoryLimitInBytes.String(), decision.Outcome)
+	}
+	if !decision.Write {
+		log.Infof("Not enforcing the kubepods memory limit %q (current: %q, file: %s): %s", targetKubepodsMemoryLimitInBytes.String(), currentKubepodsMemoryLimitInBytes.String(), filepath.Base(limitFile), decision.Outcome)
+		return nil
+	}
+	log.Infof("Enforcing the kubepods memory limit %q (target: %q, current: %q, file: %s): %s", resource.NewQuantity(decision.Value, resource.BinarySI).String(), targetKubepodsMemoryLimitInBytes.String(), currentKubepodsMemoryLimitInBytes.String(), filepath.Base(limitFile), decision.Outcome)
+
+	write, err := cgroupWriter.Write(kubelet.ResourceMemory, limitFile, strconv.FormatInt(decision.Value, 10))
+	if err != nil {
+		return fmt.Errorf("failed to enforce memory recommendation on the kubepods cgroup: %w", err)
+	}
+	if emergency {
+		eventRecorder.Eventf(enforcement.EventTypeWarning, "KubepodsMemoryLimitTightened", "Tightened the kubepods memory limit from %s to %s (target: %s, file: %s) due to acute memory pressure: %s",
+			currentKubepodsMemoryLimitInBytes.String(), resource.NewQuantity(decision.Value, resource.BinarySI).String(), targetKubepodsMemoryLimitInBytes.String(), filepath.Base(limitFile), decision.Outcome)
+	}
+
+	if memoryHighMode {
+		// pods are throttled and reclaimed at memory.high. Only beyond memory.max, pods are OOM killed.
+		kubepodsMemoryMax := decision.Value + enforcementMemoryMaxHeadroom.Value()
+		if _, err := cgroupWriter.Write(kubelet.ResourceMemory, kubepodsMemoryLimitFile(), strconv.FormatInt(kubepodsMemoryMax, 10)); err != nil {
+			return fmt.Errorf("failed to enforce memory recommendation on the kubepods cgroup: %w", err)
+		}
+	}
+
+	// the cool-down only starts with a change of the limit. In dry-run mode, the limit is never changed.
+	if write != nil && !write.DryRun {
+		memoryStabilizer.Written(decision.Value)
+	}
+	return nil
+}
+
+// enforceSystemMemoryProtection protects the memory of the non-pod processes from reclaim (requires cgroupsv2).
+// The kubelet and containerd are guaranteed their working set (memory.min).
+// System.slice is guaranteed the sum of both, as the protection of a cgroup is limited by its parent's protection,
+// and gets a best-effort protection (memory.low) of its working set.
+func enforceSystemMemoryProtection(recommendation memory.Recommendation) error {
+	systemSliceMin := recommendation.KubeletWorkingSetBytes.DeepCopy()
+	systemSliceMin.Add(recommendation.ContainerdWorkingSetBytes)
+
+	systemSliceLow := recommendation.SystemSliceWorkingSetBytes.DeepCopy()
+	if systemSliceLow.Cmp(systemSliceMin) < 0 {
+		systemSliceLow = systemSliceMin.DeepCopy()
+	}
+
+	protections := []struct {
+		cgroup string
+		file   string
+		value  resource.Quantity
+	}{
+		{types.SystemSliceCgroupName, memory.CgroupV2MemoryMin, systemSliceMin},
+		{types.SystemSliceCgroupName, memory.CgroupV2MemoryLow, systemSliceLow},
+		{kubeletCgroupsRoot, memory.CgroupV2MemoryMin, recommendation.KubeletWorkingSetBytes},
+		{containerdCgroupsRoot, memory.CgroupV2MemoryMin, recommendation.ContainerdWorkingSetBytes},
+	}
+
+	for _, protection := range protections {
+		path := filepath.Join(cgroupsHierarchyRoot, protection.cgroup, protection.file)
+		current, err := cgroupfs.ReadLimit(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		// the working sets change constantly. Only write sufficient changes.
+		change := current - protection.value.Value()
+		if change < 0 {
+			change = -change
+		}
+		if change < enforcementMinMemoryChange.Value() {
+			continue
+		}
+
+		if _, err := cgroupWriter.Write(kubelet.ResourceMemory, path, strconv.FormatInt(protection.value.Value(), 10)); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -220,30 +1055,125 @@ func recommendMemoryReservation() error {
 
 // recommendCPUReservation recommends and optionally enforces kubelet reserved resources.
 // - CPU -> Goal: Give fair amount of CPU shares to kubepods cgroup still leaving enough CPU time for non-pod processes (container runtime, kubelet, ...) to operate.
-func recommendCPUReservation(reconciliationPeriod time.Duration, numCPU int64) error {
-	targetKubepodsCPUShares, err := cpu.RecommendCPUReservations(log, reconciliationPeriod, cgroupsHierarchyRoot, numCPU)
+func recommendCPUReservation(reconciliationPeriod time.Duration, numCPU int64, kubeletConfig *kubelet.Configuration) error {
+	recommendation, err := cpu.RecommendCPUReservations(log, reconciliationPeriod, cgroupsHierarchyRoot, cgroupsV2, kubepodsCgroupsRoot, systemSliceTopUnits, numCPU, kubeletConfig, cpuHistory)
 	if err != nil {
 		return fmt.Errorf("failed to make CPU recommendation: %w", err)
 	}
+	targetKubepodsCPUShares := recommendation.TargetKubepodsCPUShares
 
-	if enforceRecommendation {
-		cpuController := cgroups.NewCpu(cgroupsHierarchyRoot)
+	if kubeletConfigUpdater != nil {
+		kubeletConfigUpdater.SetTarget(kubelet.ResourceCPU, recommendation.Reservations)
+	}
 
-		shares := uint64(targetKubepodsCPUShares)
-		cpuController.Update(types.DefaultkubepodsCgroupName, &specs.LinuxResources{
-			CPU: &specs.LinuxCPU{
-				Shares: &shares,
-			},
-		})
+	if !enforceRecommendation {
+		return nil
+	}
+
+	if enforceKubepods {
+		file, value := cpuSharesFile(kubepodsCgroupsRoot, targetKubepodsCPUShares)
+		if _, err := cgroupWriter.Write(kubelet.ResourceCPU, file, value); err != nil {
+			return fmt.Errorf("failed to enforce CPU recommendation on the kubepods cgroup: %w", err)
+		}
+	}
+
+	if enforceSystem {
+		kubepodsCPUShares := recommendation.CurrentKubepodsCPUShares
+		if enforceKubepods {
+			kubepodsCPUShares = targetKubepodsCPUShares
+		}
+
+		// give system.slice enough CPU shares relative to kubepods and the other siblings of kubepods to guarantee the CPU time required by the non-pod processes
+		// the kubelet does not change the CPU shares of system.slice. Hence, they are only raised.
+		systemSliceCPUShares := cpuutil.CPUSharesForCPUTime(recommendation.NonPodCPUTime, kubepodsCPUShares+recommendation.OtherSiblingCPUShares, numCPU)
+		if systemSliceCPUShares < kubeletSystemSliceCPUShares {
+			systemSliceCPUShares = kubeletSystemSliceCPUShares
+		}
+
+		file, value := cpuSharesFile(types.SystemSliceCgroupName, systemSliceCPUShares)
+		if _, err := cgroupWriter.Write(kubelet.ResourceCPU, file, value); err != nil {
+			return fmt.Errorf("failed to enforce CPU recommendation on the system.slice cgroup: %w", err)
+		}
+	}
+	return nil
+}
+
+// guardKubepodsMemoryLimit prevents re-applying an overwritten kubepods memory limit that is below the current kubepods memory working set
+func guardKubepodsMemoryLimit(write enforcement.Write) error {
+	if write.File != kubepodsMemoryLimitFile() && write.File != kubepodsMemoryHighFile() {
+		return nil
+	}
+
+	limit, err := strconv.ParseInt(write.New, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	// the inactive page cache is reclaimed when the limit is lowered
+	workingSet, err := memory.GetMemoryWorkingSet(cgroupsHierarchyRoot, kubepodsCgroupsRoot, cgroupsV2)
+	if err != nil {
+		return err
+	}
+
+	if limit < workingSet.Value()+enforcementMinMemoryChange.Value() {
+		return fmt.Errorf("the kubepods memory working set %q plus the minimum change %q exceeds the memory limit", workingSet.String(), enforcementMinMemoryChange.String())
 	}
 	return nil
 }
 
+// kubepodsMemoryHighFile returns the path of the cgroupsv2 file containing the memory throttle limit of the kubepods cgroup
+func kubepodsMemoryHighFile() string {
+	return filepath.Join(cgroupsHierarchyRoot, kubepodsCgroupsRoot, memory.CgroupV2MemoryHigh)
+}
+
+// kubepodsMemoryLimitFile returns the path of the cgroup file containing the memory limit of the kubepods cgroup
+func kubepodsMemoryLimitFile() string {
+	if cgroupsV2 {
+		return filepath.Join(cgroupsHierarchyRoot, kubepodsCgroupsRoot, memory.CgroupV2MemoryMax)
+	}
+	return filepath.Join(cgroupsHierarchyRoot, string(cgroups.Memory), kubepodsCgroupsRoot, memory.CgroupV1MemoryLimit)
+}
+
+// cpuSharesFile returns the path of the cgroup file containing the CPU shares of the given cgroup
+// and the value to write for the given CPU shares
+func cpuSharesFile(cgroup string, cpuShares int64) (string, string) {
+	if cgroupsV2 {
+		// the kubelet converts the CPU shares to a cpu.weight on cgroupsv2
+		weight := cpuutil.CPUSharesToCPUWeight(uint64(cpuShares))
+		return filepath.Join(cgroupsHierarchyRoot, cgroup, cpu.CgroupV2CPUWeight), strconv.FormatUint(weight, 10)
+	}
+	return filepath.Join(cgroupsHierarchyRoot, string(cgroups.Cpu), cgroup, cpu.CgroupV1CPUShares), strconv.FormatInt(cpuShares, 10)
+}
+
 // recommendDiskReservation recommends kubelet reserved resources.
 // - Disk -> Goal: Accurate disk reservations allows good scheduling decisions for pods with ephemeral size requests
-func recommendDiskReservation(containerdRootDirectory, containerdStateDirectory, kubeletDirectory string) error {
-	if err := disk.RecommendDiskReservation(log, containerdRootDirectory, containerdStateDirectory, kubeletDirectory); err != nil {
+func recommendDiskReservation(containerdRootDirectory, containerdStateDirectory, kubeletDirectory string, kubeletConfig *kubelet.Configuration) error {
+	if _, err := disk.RecommendDiskReservation(log, containerdRootDirectory, containerdStateDirectory, kubeletDirectory, kubeletConfig); err != nil {
 		return fmt.Errorf("failed to make disk recommendation: %w", err)
 	}
 	return nil
 }
+
+// reportPIDReservation reports the PID reservations configured in the kubelet configuration.
+// The PID consumption is not measured, hence the current reservations are also recommended.
+func reportPIDReservation(kubeletConfig *kubelet.Configuration) error {
+	pidCapacity, err := kubelet.PIDCapacity()
+	if err != nil {
+		return err
+	}
+
+	reservations, err := kubeletConfig.Reservations(kubelet.ResourcePID, pidCapacity)
+	if err != nil {
+		return fmt.Errorf("failed to read the pid reservations from the kubelet configuration: %w", err)
+	}
+
+	kubelet.RecordReservations(kubelet.ResourcePID, reservations, reservations)
+	log.Infof("PID reservations (kubelet config): %s", reservations.String())
+	return nil
+}
+
+// loadKubeletConfiguration loads the kubelet configuration file. The file is only read again if it changed.
+// If the configuration cannot be loaded, nil is returned and the kubelet defaults are assumed.
+func loadKubeletConfiguration() *kubelet.Configuration {
+	return kubeletConfigCache.Load(log)
+}
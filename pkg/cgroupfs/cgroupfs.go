@@ -0,0 +1,126 @@
+package cgroupfs
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// unlimited is the value written by the kernel to cgroupsv2 limit files (e.g. memory.max) in case no limit is set
+const unlimited = "max"
+
+// IsUnifiedHierarchy determines if the cgroup filesystem mounted at the given root is
+// a cgroupsv2 (unified) hierarchy by checking the filesystem type of the mount.
+// Hybrid setups (cgroupsv1 controllers with an additional cgroupsv2 mount at <root>/unified) are treated as cgroupsv1.
+func IsUnifiedHierarchy(root string) (bool, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(root, &stat); err != nil {
+		return false, fmt.Errorf("failed to stat cgroup hierarchy root %q: %w", root, err)
+	}
+	return stat.Type == unix.CGROUP2_SUPER_MAGIC, nil
+}
+
+// ReadUint reads a single numerical value from a cgroup file
+func ReadUint(path string) (uint64, error) {
+	v, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(v)), 10, 64)
+}
+
+// ReadLimit reads a cgroupsv2 limit file such as memory.max.
+// If no limit is set ("max"), math.MaxInt64 is returned.
+func ReadLimit(path string) (int64, error) {
+	v, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	value := strings.TrimSpace(string(v))
+	if value == unlimited {
+		return math.MaxInt64, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// ReadFlatKeyed reads the value of the given key from a flat keyed cgroup file
+// such as memory.stat or cpu.stat (one "<key> <value>" pair per line)
+func ReadFlatKeyed(path, key string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != key {
+			continue
+		}
+		return strconv.ParseUint(fields[1], 10, 64)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("key %q not found in %s", key, path)
+}
+
+// ReadFlatKeyedAll reads all key value pairs of a flat keyed cgroup file
+// such as memory.events (one "<key> <value>" pair per line)
+func ReadFlatKeyedAll(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for key %q in %s: %w", fields[0], path, err)
+		}
+		values[fields[0]] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// ListChildren returns the names of the child cgroups (sub-directories) of the cgroup at the given path
+func ListChildren(path string) ([]string, error) {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			children = append(children, entry.Name())
+		}
+	}
+	return children, nil
+}
+
+// WriteValue writes a value to a cgroup file
+func WriteValue(path, value string) error {
+	return ioutil.WriteFile(path, []byte(value), 0)
+}
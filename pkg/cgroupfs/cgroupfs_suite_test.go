@@ -0,0 +1,13 @@
+package cgroupfs_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCgroupfs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cgroupfs Suite")
+}
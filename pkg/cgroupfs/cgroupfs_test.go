@@ -0,0 +1,91 @@
+package cgroupfs_test
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cgroupfs", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cgroupfs")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		return path
+	}
+
+	Describe("ReadLimit", func() {
+		It("should return the limit", func() {
+			limit, err := cgroupfs.ReadLimit(writeFile("memory.max", "1073741824\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(limit).To(Equal(int64(1073741824)))
+		})
+
+		It("should return MaxInt64 if no limit is set", func() {
+			limit, err := cgroupfs.ReadLimit(writeFile("memory.max", "max\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(limit).To(Equal(int64(math.MaxInt64)))
+		})
+	})
+
+	Describe("ReadFlatKeyed", func() {
+		It("should return the value of the key", func() {
+			path := writeFile("memory.stat", "anon 4096\nfile 8192\ninactive_file 1024\nactive_file 2048\n")
+
+			value, err := cgroupfs.ReadFlatKeyed(path, "inactive_file")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value).To(Equal(uint64(1024)))
+		})
+
+		It("should return an error if the key does not exist", func() {
+			path := writeFile("cpu.stat", "usage_usec 100\n")
+
+			_, err := cgroupfs.ReadFlatKeyed(path, "user_usec")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("ReadFlatKeyedAll", func() {
+		It("should return all values", func() {
+			path := writeFile("memory.events", "low 0\nhigh 12\nmax 3\noom 1\noom_kill 1\n")
+
+			values, err := cgroupfs.ReadFlatKeyedAll(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values).To(Equal(map[string]uint64{"low": 0, "high": 12, "max": 3, "oom": 1, "oom_kill": 1}))
+		})
+
+		It("should return an error for invalid values", func() {
+			path := writeFile("memory.events", "high abc\n")
+
+			_, err := cgroupfs.ReadFlatKeyedAll(path)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ListChildren", func() {
+		It("should return the child cgroups", func() {
+			Expect(os.Mkdir(filepath.Join(dir, "kubelet.service"), 0755)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(dir, "sshd.service"), 0755)).To(Succeed())
+			writeFile("memory.current", "1024\n")
+
+			children, err := cgroupfs.ListChildren(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(children).To(ConsistOf("kubelet.service", "sshd.service"))
+		})
+	})
+})
@@ -8,25 +8,39 @@ import (
 	"time"
 
 	linuxproc "github.com/c9s/goprocinfo/linux"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/cpu/util"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/histogram"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 const (
-	// cgroupStatCPUShares is the name of the file setting the amount of cpu shares for a particular cgroup
-	cgroupStatCPUShares = "cpu.shares"
+	// CgroupV1CPUShares is the name of the cgroupsv1 file setting the amount of cpu shares for a particular cgroup
+	CgroupV1CPUShares = "cpu.shares"
 	// cgroupStatCPUUsage is the name of the cpu usage file in the cgroup filesystem
 	cgroupStatCPUUsage = "cpuacct.usage"
+	// CgroupV2CPUWeight is the name of the cgroupsv2 file setting the cpu weight for a particular cgroup (replaces cpu.shares)
+	// see: https://utcc.utoronto.ca/~cks/space/blog/linux/CgroupV2FairShareScheduling
+	CgroupV2CPUWeight = "cpu.weight"
+	// cgroupV2CPUStat is the name of the cgroupsv2 file containing the cpu statistics of a cgroup
+	cgroupV2CPUStat = "cpu.stat"
+	// cgroupV2CPUStatUsage is the key in the cgroupsv2 cpu.stat file for the total cpu usage in microseconds
+	cgroupV2CPUStatUsage = "usage_usec"
 )
 
-// TODO: update to work with cgroupsv2 ---> nore more cpu.shares file, but cpu.weight in each cgroup with cpu controller enabled
-//  - https://utcc.utoronto.ca/~cks/space/blog/linux/CgroupV2FairShareScheduling
-// root@shoot--cs-core--ghrunner-app-z1-54b5c-6lvcs:/# cat /sys/fs/cgroup/kubepods/cpu.weight
-// 622
+// HistogramOptions are the bucket options for the history of the CPU usage of non-pod processes (in cores).
+// Buckets grow by 2 percent starting at 1m, up to 1024 cores.
+var HistogramOptions = histogram.Options{
+	MaxValue:        1024,
+	FirstBucketSize: 0.001,
+	Ratio:           1.02,
+}
 
 var (
 	metricSystemSliceMinGuaranteedCPU = promauto.NewGauge(prometheus.GaugeOpts{
@@ -64,6 +78,11 @@ var (
 		Help: "The target kubelet reserved CPU",
 	})
 
+	metricTargetReservedCPUSmoothed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kubelet_target_reserved_cpu_smoothed",
+		Help: "The target kubelet reserved CPU based on the percentile of the non-pod CPU usage over the recommendation window",
+	})
+
 	metricTargetReservedCPUMachineType = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "kubelet_target_reserved_cpu_machine_type",
 		Help: "The target kubelet reserved CPU based on the machine type",
@@ -75,27 +94,67 @@ var (
 	})
 )
 
+// Recommendation is a CPU recommendation
+type Recommendation struct {
+	// TargetKubepodsCPUShares are the desired CPU shares of the kubepods cgroup
+	TargetKubepodsCPUShares int64
+	// Reservations is the recommended reservation split across kube-reserved and system-reserved
+	Reservations kubelet.Reservations
+	// NonPodCPUTime is the (smoothed if enabled) CPU time required by non-pod processes in cores
+	NonPodCPUTime float64
+	// CurrentKubepodsCPUShares are the current CPU shares of the kubepods cgroup
+	CurrentKubepodsCPUShares int64
+	// OtherSiblingCPUShares are the total CPU shares of the siblings of kubepods besides system.slice (e.g. user.slice)
+	OtherSiblingCPUShares int64
+}
+
 // RecommendCPUReservations recommends kubelet CPU reservations by
 // measuring overall, kubepods and system.slice CPU consumption and comparing those measurements against current CPU reservations (based on CPU shares of the cgroups)
-func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Duration, cgroupsHierarchyRoot string, numCPU int64) (int64, error) {
+// With cgroupsV2 set, the cpu.weight of the cgroups is converted to CPU shares using the same conversion as the kubelet.
+// The returned target kubepods CPU shares have to be converted back to a cpu.weight for enforcement on cgroupsv2.
+// Every measured non-pod CPU usage is added to the given history. If smoothing is enabled, the recommendation is
+// based on the percentile of the history instead of the latest measurement.
+// The CPU usage of every child cgroup of system.slice is recorded, the systemSliceTopUnits largest are shown in the table output.
+// All siblings of kubepods (system.slice, user.slice, init.scope, ...) compete with kubepods for CPU time
+// and are considered in the target kubepods CPU shares.
+func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Duration, cgroupsHierarchyRoot string, cgroupsV2 bool, kubepodsCgroupName string, systemSliceTopUnits int, numCPU int64, kubeletConfig *kubelet.Configuration, history *histogram.Smoother) (Recommendation, error) {
 	cgroupsHierarchyCPU := fmt.Sprintf("%s/cpu", cgroupsHierarchyRoot)
+	if cgroupsV2 {
+		// unified hierarchy: there is no dedicated hierarchy per controller
+		cgroupsHierarchyCPU = cgroupsHierarchyRoot
+	}
 
-	systemSliceCPUShares, err := getCPUStat(cgroupsHierarchyCPU, types.SystemSliceCgroupName, cgroupStatCPUShares)
+	systemSliceCPUShares, err := getCPUShares(cgroupsHierarchyCPU, types.SystemSliceCgroupName, cgroupsV2)
 	if err != nil {
-		return 0, err
+		return Recommendation{}, err
 	}
 
-	kubepodsCPUShares, err := getCPUStat(cgroupsHierarchyCPU, types.DefaultkubepodsCgroupName, cgroupStatCPUShares)
+	kubepodsCPUShares, err := getCPUShares(cgroupsHierarchyCPU, kubepodsCgroupName, cgroupsV2)
 	if err != nil {
-		return 0, err
+		return Recommendation{}, err
 	}
 
+	// the breakdown per QoS class is informational only (e.g. not available with --cgroups-per-qos=false)
+	qosCPUShares, err := GetQoSCPUShares(cgroupsHierarchyCPU, kubepodsCgroupName, cgroupsV2)
+	if err != nil {
+		log.Warnf("failed to read the CPU shares per QoS class: %v", err)
+	}
+
+	// besides system.slice, processes in the other siblings of kubepods (e.g. user.slice, init.scope, machine.slice) compete with kubepods for CPU time.
+	// If kubepods is nested, its siblings are the other children of its parent.
+	siblingCgroupNames, err := kubelet.KubepodsSiblingCgroupNames(cgroupsHierarchyCPU, kubepodsCgroupName)
+	if err != nil {
+		log.Warnf("failed to list the siblings of the kubepods cgroup: %v", err)
+	}
+	siblingCPUSharesByCgroup := GetKubepodsSiblingCPUShares(cgroupsHierarchyCPU, siblingCgroupNames, cgroupsV2)
+	siblingCPUShares := SiblingCPUShares(siblingCPUSharesByCgroup, systemSliceCPUShares)
+
 	// System.slice's relative CPU time for ALL cores = (Active cgroup CPU shares) / (sum of all possible CPU shares of the cgroup SIBLINGS)
 	// System.slice's relative CPU time for ONE core = Total CPU time for all cores * number of cores
-	systemSliceGuaranteedCPUTimePercent := ((float64(systemSliceCPUShares) / (float64(systemSliceCPUShares) + float64(kubepodsCPUShares))) * float64(numCPU)) * 100
-	kubepodsGuaranteedCPUTimePercent := ((float64(kubepodsCPUShares) / (float64(systemSliceCPUShares) + float64(kubepodsCPUShares))) * float64(numCPU)) * 100
+	systemSliceGuaranteedCPUTimePercent := ((float64(systemSliceCPUShares) / (float64(siblingCPUShares) + float64(kubepodsCPUShares))) * float64(numCPU)) * 100
+	kubepodsGuaranteedCPUTimePercent := ((float64(kubepodsCPUShares) / (float64(siblingCPUShares) + float64(kubepodsCPUShares))) * float64(numCPU)) * 100
 
-	log.Debugf("Guaranteed CPU time: system.slice:  %.2f percent (%d shares) | kubepods:  %.2f percent (%d shares). \n", systemSliceGuaranteedCPUTimePercent, systemSliceCPUShares, kubepodsGuaranteedCPUTimePercent, kubepodsCPUShares)
+	log.Debugf("Guaranteed CPU time: system.slice:  %.2f percent (%d shares) | kubepods:  %.2f percent (%d shares) | all siblings of kubepods: %d shares. \n", systemSliceGuaranteedCPUTimePercent, systemSliceCPUShares, kubepodsGuaranteedCPUTimePercent, kubepodsCPUShares, siblingCPUShares)
 
 	// Measure overall CPU usage using `/proc/stats` and cpu usage of cgroups using the cgroupfs
 	// For Linux, to determine the overall CPU usage, use the info exposed by the kernel in `/proc/stats` instead of
@@ -107,9 +166,24 @@ func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Dura
 	//   - Example: cat /dev/zero > /dev/null   --> will not be account for in system.slice because it is in users.slice (check `ps -o cgroup <pid>`)
 	// - CPU accounting information in cgroups v1 was not designed to be absolutely precise and can be way off.
 	// Please refer to the following URL for more information: https://www.idnt.net/en-US/kb/941772
-	overallCPUNonIdleTime, systemSliceCPUTime, kubepodsCPUTime, err := measureAverageCPUUsage(log, cgroupsHierarchyCPU, reconciliationPeriod, numCPU)
+	unitCgroupNames, err := SystemSliceUnitCgroupNames(cgroupsHierarchyCPU)
+	if err != nil {
+		log.Warnf("failed to list the system.slice units: %v", err)
+	}
+	additionalCgroupNames := append(append([]string{}, unitCgroupNames...), siblingCgroupNames...)
+
+	overallCPUNonIdleTime, systemSliceCPUTime, kubepodsCPUTime, qosCPUTime, additionalCPUTime, err := measureAverageCPUUsage(log, cgroupsHierarchyCPU, cgroupsV2, kubepodsCgroupName, QoSCgroupNames(kubepodsCgroupName), additionalCgroupNames, reconciliationPeriod, numCPU)
 	if err != nil {
-		return 0, fmt.Errorf("failed to measure relative CPU time: %w", err)
+		return Recommendation{}, fmt.Errorf("failed to measure relative CPU time: %w", err)
+	}
+	qosCPUTime = QoSCPUUsage(kubepodsCPUTime, qosCPUTime)
+	systemSliceUnits := SystemSliceUnitsCPUUsage(unitCgroupNames, additionalCPUTime)
+	siblings := KubepodsSiblings(siblingCgroupNames, siblingCPUSharesByCgroup, additionalCPUTime)
+
+	// the CPU usage of all siblings of kubepods (falls back to system.slice if not measured)
+	siblingsCPUTime := systemSliceCPUTime
+	if measured, ok := sumSiblingsCPUUsage(siblings); ok {
+		siblingsCPUTime = measured
 	}
 
 	// Calculation:
@@ -123,70 +197,36 @@ func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Dura
 	kubepodsCPUTimePercent := kubepodsCPUTime * 100
 	systemSliceCPUTimePercent := systemSliceCPUTime * 100
 
-	log.Debugf("CPU total via /proc/stat: %.2f percent| non-pod processes: %.2f percent | system.slice via cgroupfs: %.2f percent | kubepods via cgroupfs: %.2f percent", overallCPUNonIdleTimePercent, cpuUsageNonPodProcesses*100, systemSliceCPUTimePercent, kubepodsCPUTimePercent)
+	log.Debugf("CPU total via /proc/stat: %.2f percent| non-pod processes: %.2f percent | system.slice via cgroupfs: %.2f percent | all siblings of kubepods via cgroupfs: %.2f percent | kubepods via cgroupfs: %.2f percent", overallCPUNonIdleTimePercent, cpuUsageNonPodProcesses*100, systemSliceCPUTimePercent, siblingsCPUTime*100, kubepodsCPUTimePercent)
 
-	// For the calculation, take the higher of the two cpu utilisations reported for system.slice
+	// For the calculation, take the higher of the two cpu utilisations reported for the non-pod processes
 	//  -> They should in theory be identical, but are mostly a bit different probably due to best-effort accounting on the cgroup
+	//     and processes in the root cgroup itself (not accounted in any top-level cgroup)
 	//  -> this might cause a slight over-reservation
-	cpuTimeNonPodProcesses := systemSliceCPUTime
-	if cpuUsageNonPodProcesses > systemSliceCPUTime {
+	cpuTimeNonPodProcesses := siblingsCPUTime
+	if cpuUsageNonPodProcesses > siblingsCPUTime {
 		cpuTimeNonPodProcesses = cpuUsageNonPodProcesses
 	}
 
-	// Uses the same formula from above (just resolved to the target kubepodsCPUShares and not using percent (not multiplied by 100)).
-	// We know the:
-	// - systemSliceCPUShares -> from cgroupfs (sibling of kubepods)
-	// - cpuUsageNonPodProcesses (like systemSliceCPUTime in above formula, only precisely measure via /proc/stats and as if it would be the total CPU usage)
-
-	// Caveat: in this formula, system.slice is the only cgroup sibling of kubepods that is considered to consume any CPU shares (measured via /proc/stats - kubepods consumption).
-	// This can lead to inaccurate target cpu shares for kubepods if  there are other cgroups that consume much CPU time
-	//   - the ratio between the kubepods cpu shares and the other cgroups will be off (because we calculate as if there are only 2 cgroups)
-	// Hierarchically, we assume:
-	// L0: root
-	// L1 - system.slice(usually 1024 shares) , kubepods (to be calculated)
-	// Example:
-	//  - system.slice: 1024 shares
-	//  - CPU usage non-pod processes according to /proc/stat: 37.69% (calculated via total from /proc/stat - measurement for kubepods from cgroup)
-	//  - kubepods cpu usage via cgroupfs: 206.99 percent
-	//  - numCores = 16
-	// Goal: we want that system.slice gets only 37.69% CPU time via CPU Shares
-	// 42446 shares = ((1024 * 16) / 0.3769) - 1024
-	// This makes sense (surprisingly) as that means that system.slice only gets 2.5% (42446 / 1024) of total CPU time. Which over all cores is 38.5 % (that's what we want).
-	// Of course, if kubepods requires much more CPU it might also be that system.slice requires more than only 38.5 %, then this will be visible when executing the recommender again.
-	kubepodsTargetCPUShares := int64(((float64(systemSliceCPUShares) * float64(numCPU)) / cpuTimeNonPodProcesses) - float64(systemSliceCPUShares))
-	log.Debugf("CPU shares: kubepods current: %d | kubepods target: %d | system.slice current: %d", kubepodsCPUShares, kubepodsTargetCPUShares, systemSliceCPUShares)
-
-	// kubernetesTotalCPUSharesForNCores set by the kubelet based on the amount of cores (not a Linux requirement)
-	kubernetesTotalCPUSharesForNCores := numCPU * 1024
+	rawKubepodsTargetCPUShares, rawTargetKubeReservedCPU := calculateTargetReservedCPU(siblingCPUShares, numCPU, cpuTimeNonPodProcesses)
 
-	var targetKubeReservedCPU int64
-	if kubepodsTargetCPUShares < kubernetesTotalCPUSharesForNCores {
-		// While we set CPU shares on the cgroup (Binary SI), we also want to report the target reserved memory in milli-CPU cores (Decimal SI)
-		// Kube reserved is given in decimal SI (see: https://kubernetes.io/docs/concepts/configuration/manage-resources-containers/#meaning-of-cpu)
-		// --> conversion is needed
-		// 1 core = 1024 CPU shares in the kubernetes world
-		// 1024=2^10=1 in Binary Si  which equals 1000m = 1 core in Decimal SI
-		targetKubeReservedCPU = util.DecimalSIForBinarySi(kubernetesTotalCPUSharesForNCores - kubepodsTargetCPUShares)
-	} else {
-		// kubepodsTargetCPUShares can be > kubernetesTotalCPUSharesForNCores
-		// However, Kubernetes decided that the maximum CPU shares it  sets for the
-		// kubepods cgroup = amount of cpus * 1024
-		// Hence, if we want to give more than the K8s possible total amount of shares to the kubepods cgroup
-		// (system.slice does not use a lot of CPU), then we could set the kube/system-reserved for CPU to 0
-		// We set a low default amount of 80m instead, as over reserving CPU resources for system.slice
-		// is not problematic (kubepods can exceed "fair share" of CPU time in case system.slice does not need it).
+	// a single measurement is prone to spikes. The percentile over the recommendation window is more stable.
+	smoothedCPUTimeNonPodProcesses := history.Smooth(cpuTimeNonPodProcesses, time.Now())
+	smoothedKubepodsTargetCPUShares, smoothedTargetKubeReservedCPU := calculateTargetReservedCPU(siblingCPUShares, numCPU, smoothedCPUTimeNonPodProcesses)
+	log.Debugf("Smoothed CPU usage non-pod processes: %.2f percent | smoothed reserved CPU: %dm (enabled: %v)", smoothedCPUTimeNonPodProcesses*100, smoothedTargetKubeReservedCPU, history.Enabled())
 
-		// Please also note: Kubernetes STATICALLY SETS (or: does not change) the systems.slice cpu.shares to 1024
-		// this is a problem, as cpu.shares work as a ratio against its siblings
-		// targetKubeReservedCPU = defaultMinimumReservedCPU
-		// Hence, unfortunately, enforcing CPU reservations does not make any sense at this point
-		// - Please see: https://github.com/kubernetes/kubernetes/issues/72881#issuecomment-897217732
-		// - Problem: By reserving 5 cores on a 94 core machine, Linux actually only granted 0.1 cores more in relation to system.slice.
-		// => the scheduler prevents actual workload of 5 cores to be scheduled which makes it not usable -,-
-		targetKubeReservedCPU = 0
+	kubepodsTargetCPUShares, targetKubeReservedCPU := rawKubepodsTargetCPUShares, rawTargetKubeReservedCPU
+	if history.Enabled() {
+		kubepodsTargetCPUShares, targetKubeReservedCPU = smoothedKubepodsTargetCPUShares, smoothedTargetKubeReservedCPU
+	}
+	log.Debugf("CPU shares: kubepods current: %d | kubepods target: %d | system.slice current: %d | all siblings of kubepods current: %d", kubepodsCPUShares, kubepodsTargetCPUShares, systemSliceCPUShares, siblingCPUShares)
+	if targetKubeReservedCPU == 0 {
 		log.Debugf("defaulting reserved CPU to minimum")
 	}
 
+	// kubernetesTotalCPUSharesForNCores set by the kubelet based on the amount of cores (not a Linux requirement)
+	kubernetesTotalCPUSharesForNCores := numCPU * 1024
+
 	// for comparison, also calculate target CPU reservation based on GKE's formula which uses a function of the capacity (num cores)
 	targetKubeReservedCPUMachineType := util.CalculateCPUReservationBasedOnCapacity(numCPU)
 
@@ -194,7 +234,23 @@ func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Dura
 	// it can be deduced by looking at the kubepods cpu.shares
 	currentKubeReservedCPU := kubernetesTotalCPUSharesForNCores - kubepodsCPUShares
 
-	log.Debugf("Recommended reserved CPU: %dm (current: %dm). Reason: reserving %.2f percent CPU for non-pod processes requires %d CPU shares for kubepods with system.slice having %d CPU shares.", targetKubeReservedCPU, currentKubeReservedCPU, cpuUsageNonPodProcesses*100, kubepodsTargetCPUShares, systemSliceCPUShares)
+	// the CPU shares of the guaranteed and burstable QoS class are the CPU requests of the pods.
+	// Requests above the target kubepods CPU shares cannot be guaranteed if the recommendation is enforced.
+	if qosCPUShares != nil && qosCPUShares[kubelet.QoSGuaranteed]+qosCPUShares[kubelet.QoSBurstable] > kubepodsTargetCPUShares {
+		log.Debugf("The CPU shares of the guaranteed and burstable QoS classes (%d) exceed the target kubepods CPU shares (%d)", qosCPUShares[kubelet.QoSGuaranteed]+qosCPUShares[kubelet.QoSBurstable], kubepodsTargetCPUShares)
+	}
+
+	log.Debugf("Recommended reserved CPU: %dm (current: %dm). Reason: reserving %.2f percent CPU for non-pod processes requires %d CPU shares for kubepods with the siblings of kubepods having %d CPU shares.", targetKubeReservedCPU, currentKubeReservedCPU, cpuUsageNonPodProcesses*100, kubepodsTargetCPUShares, siblingCPUShares)
+
+	currentReservations, err := kubeletConfig.Reservations(kubelet.ResourceCPU, *resource.NewQuantity(numCPU, resource.DecimalSI))
+	if err != nil {
+		return Recommendation{}, fmt.Errorf("failed to read the CPU reservations from the kubelet configuration: %w", err)
+	}
+
+	// there is no way to measure how much CPU is required by the kubernetes components compared to other non-pod processes
+	// solely based on the cpu.shares. Hence, the configured system-reserved is kept.
+	targetReservations := kubelet.SplitKeepingSystemReserved(*resource.NewMilliQuantity(targetKubeReservedCPU, resource.DecimalSI), currentReservations)
+	kubelet.RecordReservations(kubelet.ResourceCPU, currentReservations, targetReservations)
 
 	logRecommendation(
 		overallCPUNonIdleTimePercent,
@@ -205,9 +261,18 @@ func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Dura
 		systemSliceCPUTimePercent,
 		kubepodsCPUTimePercent,
 		targetKubeReservedCPU,
+		smoothedTargetKubeReservedCPU,
+		history.Enabled(),
 		currentKubeReservedCPU,
 		kubepodsTargetCPUShares,
-		systemSliceCPUShares)
+		systemSliceCPUShares,
+		currentReservations,
+		targetReservations,
+		qosCPUTime,
+		qosCPUShares,
+		systemSliceUnits,
+		systemSliceTopUnits,
+		siblings)
 
 	// record prometheus metrics
 	recordMetrics(
@@ -217,9 +282,13 @@ func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Dura
 		systemSliceCPUTimePercent,
 		overallCPUNonIdleTimePercent,
 		currentKubeReservedCPU,
-		targetKubeReservedCPU,
+		rawTargetKubeReservedCPU,
+		smoothedTargetKubeReservedCPU,
 		targetKubeReservedCPUMachineType,
 		kubepodsGuaranteedCPUTimePercent)
+	recordQoSMetrics(qosCPUTime, qosCPUShares)
+	recordSystemSliceUnitsCPUUsage(systemSliceUnits)
+	recordKubepodsSiblings(siblings)
 
 	// Do not enforce kubepods CPU shares that would exceed the maximum CPU shares set by the kubelet
 	// this effectively makes sure that system.slice has the same minimum guaranteed CPU time as if the kubelet does not reserve any CPU for system processes
@@ -232,7 +301,68 @@ func RecommendCPUReservations(log *logrus.Logger, reconciliationPeriod time.Dura
 		kubepodsTargetCPUShares = kubernetesTotalCPUSharesForNCores
 	}
 
-	return kubepodsTargetCPUShares, nil
+	return Recommendation{
+		TargetKubepodsCPUShares:  kubepodsTargetCPUShares,
+		Reservations:             targetReservations,
+		NonPodCPUTime:            cpuTimeNonPodProcesses,
+		CurrentKubepodsCPUShares: kubepodsCPUShares,
+		OtherSiblingCPUShares:    OtherSiblingCPUShares(siblingCPUSharesByCgroup),
+	}, nil
+}
+
+// calculateTargetReservedCPU calculates the target CPU shares of the kubepods cgroup and the resulting target reserved CPU (in millicores)
+// so that the non-pod processes are guaranteed the given CPU time (in cores) relative to the total CPU shares of the siblings of kubepods.
+func calculateTargetReservedCPU(siblingCPUShares, numCPU int64, cpuTimeNonPodProcesses float64) (int64, int64) {
+	// Uses the same formula as for the guaranteed CPU time in RecommendCPUReservations (just resolved to the target kubepodsCPUShares and not using percent (not multiplied by 100)).
+	// We know the:
+	// - siblingCPUShares -> from cgroupfs (sum of all siblings of kubepods)
+	// - cpuUsageNonPodProcesses (like systemSliceCPUTime in above formula, only precisely measure via /proc/stats and as if it would be the total CPU usage)
+
+	// All siblings of kubepods (system.slice, user.slice, init.scope, ...) are treated as one cgroup with the sum of their CPU shares.
+	// Caveat: processes in the root cgroup itself are not part of any sibling, but compete for CPU time as well.
+	// Hierarchically, we assume:
+	// L0: root
+	// L1 - system.slice(usually 1024 shares), other siblings (e.g user.slice with 1024 shares), kubepods (to be calculated)
+	// The example below only has system.slice as sibling.
+	// Example:
+	//  - system.slice: 1024 shares
+	//  - CPU usage non-pod processes according to /proc/stat: 37.69% (calculated via total from /proc/stat - measurement for kubepods from cgroup)
+	//  - kubepods cpu usage via cgroupfs: 206.99 percent
+	//  - numCores = 16
+	// Goal: we want that system.slice gets only 37.69% CPU time via CPU Shares
+	// 42446 shares = ((1024 * 16) / 0.3769) - 1024
+	// This makes sense (surprisingly) as that means that system.slice only gets 2.5% (42446 / 1024) of total CPU time. Which over all cores is 38.5 % (that's what we want).
+	// Of course, if kubepods requires much more CPU it might also be that system.slice requires more than only 38.5 %, then this will be visible when executing the recommender again.
+	kubepodsTargetCPUShares := int64(((float64(siblingCPUShares) * float64(numCPU)) / cpuTimeNonPodProcesses) - float64(siblingCPUShares))
+
+	// kubernetesTotalCPUSharesForNCores set by the kubelet based on the amount of cores (not a Linux requirement)
+	kubernetesTotalCPUSharesForNCores := numCPU * 1024
+
+	if kubepodsTargetCPUShares >= kubernetesTotalCPUSharesForNCores {
+		// kubepodsTargetCPUShares can be > kubernetesTotalCPUSharesForNCores
+		// However, Kubernetes decided that the maximum CPU shares it  sets for the
+		// kubepods cgroup = amount of cpus * 1024
+		// Hence, if we want to give more than the K8s possible total amount of shares to the kubepods cgroup
+		// (system.slice does not use a lot of CPU), then we could set the kube/system-reserved for CPU to 0
+		// We set a low default amount of 80m instead, as over reserving CPU resources for system.slice
+		// is not problematic (kubepods can exceed "fair share" of CPU time in case system.slice does not need it).
+
+		// Please also note: Kubernetes STATICALLY SETS (or: does not change) the systems.slice cpu.shares to 1024
+		// this is a problem, as cpu.shares work as a ratio against its siblings
+		// targetKubeReservedCPU = defaultMinimumReservedCPU
+		// Hence, unfortunately, enforcing CPU reservations does not make any sense at this point
+		// - Please see: https://github.com/kubernetes/kubernetes/issues/72881#issuecomment-897217732
+		// - Problem: By reserving 5 cores on a 94 core machine, Linux actually only granted 0.1 cores more in relation to system.slice.
+		// => the scheduler prevents actual workload of 5 cores to be scheduled which makes it not usable -,-
+		return kubepodsTargetCPUShares, 0
+	}
+
+	// While we set CPU shares on the cgroup (Binary SI), we also want to report the target reserved memory in milli-CPU cores (Decimal SI)
+	// Kube reserved is given in decimal SI (see: https://kubernetes.io/docs/concepts/configuration/manage-resources-containers/#meaning-of-cpu)
+	// --> conversion is needed
+	// 1 core = 1024 CPU shares in the kubernetes world
+	// 1024=2^10=1 in Binary Si  which equals 1000m = 1 core in Decimal SI
+	return kubepodsTargetCPUShares, util.DecimalSIForBinarySi(kubernetesTotalCPUSharesForNCores - kubepodsTargetCPUShares)
 }
 
 func recordMetrics(numCPU int64,
@@ -242,6 +372,7 @@ func recordMetrics(numCPU int64,
 	overallCPUNonIdleTimePercent float64,
 	currentKubeReservedCPU int64,
 	targetKubeReservedCPU int64,
+	smoothedTargetKubeReservedCPU int64,
 	targetKubeReservedCPUMachineType int64,
 	kubepodsGuaranteedCPUTimePercent float64) {
 	metricCores.Set(float64(numCPU))
@@ -252,6 +383,7 @@ func recordMetrics(numCPU int64,
 	metricOverallCPUUsagePercent.Set(math.Round(overallCPUNonIdleTimePercent))
 	metricCurrentReservedCPU.Set(float64(currentKubeReservedCPU))
 	metricTargetReservedCPU.Set(float64(targetKubeReservedCPU))
+	metricTargetReservedCPUSmoothed.Set(float64(smoothedTargetKubeReservedCPU))
 	metricTargetReservedCPUMachineType.Set(float64(targetKubeReservedCPUMachineType))
 }
 
@@ -264,9 +396,18 @@ func logRecommendation(
 	systemSliceCPUTimePercent float64,
 	kubepodsCPUTimePercent float64,
 	targetKubeReservedCPU int64,
+	smoothedTargetKubeReservedCPU int64,
+	smoothingEnabled bool,
 	currentKubeReservedCPU int64,
 	kubepodsTargetCPUShares int64,
-	systemSliceCPUShares int64) {
+	systemSliceCPUShares int64,
+	currentReservations kubelet.Reservations,
+	targetReservations kubelet.Reservations,
+	qosCPUTime map[string]float64,
+	qosCPUShares map[string]int64,
+	systemSliceUnits []UnitCPUUsage,
+	systemSliceTopUnits int,
+	siblings []TopLevelCgroup) {
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
 	t.AppendHeader(table.Row{"CPU Metric", "Value"})
@@ -278,11 +419,58 @@ func logRecommendation(
 		{"CPU usage non-pod processes", fmt.Sprintf("%.2f%%", cpuUsageNonPodProcesses)},
 		{"CPU usage system.slice (cgroupfs)", fmt.Sprintf("%.2f%%", systemSliceCPUTimePercent)},
 		{"CPU usage kubepods (cgroupfs)", fmt.Sprintf("%.2f%%", kubepodsCPUTimePercent)},
+	})
+
+	for _, qosClass := range kubelet.QoSClasses {
+		usage, ok := qosCPUTime[qosClass]
+		if !ok {
+			continue
+		}
+		shares := "n/a"
+		if value, ok := qosCPUShares[qosClass]; ok {
+			shares = fmt.Sprintf("%d", value)
+		}
+		t.AppendRow(table.Row{fmt.Sprintf(" - %s (CPU shares)", qosClass), fmt.Sprintf("%.2f%% (%s)", usage*100, shares)})
+	}
+
+	if len(siblings) > 0 {
+		t.AppendRow(table.Row{"Siblings of kubepods", "CPU usage (CPU shares)"})
+		for _, sibling := range siblings {
+			usage, shares := "n/a", "n/a"
+			if sibling.Usage >= 0 {
+				usage = fmt.Sprintf("%.2f%%", sibling.Usage*100)
+			}
+			if sibling.CPUShares > 0 {
+				shares = fmt.Sprintf("%d", sibling.CPUShares)
+			}
+			t.AppendRow(table.Row{fmt.Sprintf(" - %s", sibling.Name), fmt.Sprintf("%s (%s)", usage, shares)})
+		}
+	}
+
+	topUnits := systemSliceUnits
+	if len(topUnits) > systemSliceTopUnits {
+		topUnits = topUnits[:systemSliceTopUnits]
+	}
+	if len(topUnits) > 0 {
+		t.AppendRow(table.Row{"Top system.slice units (CPU usage)", fmt.Sprintf("%d of %d units", len(topUnits), len(systemSliceUnits))})
+		for _, unit := range topUnits {
+			t.AppendRow(table.Row{fmt.Sprintf(" - %s", unit.Name), fmt.Sprintf("%.2f%%", unit.Usage*100)})
+		}
+	}
+
+	t.AppendRows([]table.Row{
 		{"Current reservation", fmt.Sprintf("%dm", currentKubeReservedCPU)},
+		{" - kube-reserved (kubelet config)", fmt.Sprintf("%dm", currentReservations.KubeReserved.MilliValue())},
+		{" - system-reserved (kubelet config)", fmt.Sprintf("%dm", currentReservations.SystemReserved.MilliValue())},
 	})
 
 	t.AppendSeparator()
 	t.AppendRow(table.Row{"RECOMMENDATION", fmt.Sprintf("%dm (kubepods CPU shares: %d)", targetKubeReservedCPU, kubepodsTargetCPUShares)})
+	t.AppendRows([]table.Row{
+		{" - smoothed", fmt.Sprintf("%dm (used: %v)", smoothedTargetKubeReservedCPU, smoothingEnabled)},
+		{" - kube-reserved", fmt.Sprintf("%dm", targetReservations.KubeReserved.MilliValue())},
+		{" - system-reserved", fmt.Sprintf("%dm", targetReservations.SystemReserved.MilliValue())},
+	})
 	t.Render()
 }
 
@@ -297,46 +485,124 @@ func getCPUStat(cgroupsHierarchyCPU, cgroup, cpuStat string) (int64, error) {
 	return int64(value), nil
 }
 
+// getCPUShares returns the CPU shares of the given cgroup.
+// For cgroupsv2, the cpu.weight is converted to CPU shares.
+func getCPUShares(cgroupsHierarchyCPU, cgroup string, cgroupsV2 bool) (int64, error) {
+	if !cgroupsV2 {
+		return getCPUStat(cgroupsHierarchyCPU, cgroup, CgroupV1CPUShares)
+	}
+
+	weight, err := cgroupfs.ReadUint(filepath.Join(cgroupsHierarchyCPU, cgroup, CgroupV2CPUWeight))
+	if err != nil {
+		return 0, err
+	}
+	return int64(util.CPUWeightToCPUShares(weight)), nil
+}
+
+// getCPUUsage returns the total CPU time consumed by the given cgroup in nanoseconds
+func getCPUUsage(cgroupsHierarchyCPU, cgroup string, cgroupsV2 bool) (int64, error) {
+	if !cgroupsV2 {
+		return getCPUStat(cgroupsHierarchyCPU, cgroup, cgroupStatCPUUsage)
+	}
+
+	usageMicroSeconds, err := cgroupfs.ReadFlatKeyed(filepath.Join(cgroupsHierarchyCPU, cgroup, cgroupV2CPUStat), cgroupV2CPUStatUsage)
+	if err != nil {
+		return 0, err
+	}
+	return int64(usageMicroSeconds) * int64(time.Microsecond), nil
+}
+
+// cpuUsageSample is the total CPU time consumed by a cgroup in nanoseconds at a point in time
+type cpuUsageSample struct {
+	usage     int64
+	timestamp int64
+}
+
+// readCPUUsageSamples reads the total CPU time consumed by the given cgroups.
+// Cgroups that cannot be read are omitted.
+func readCPUUsageSamples(cgroupsHierarchyCPU string, cgroupNames []string, cgroupsV2 bool) map[string]cpuUsageSample {
+	samples := map[string]cpuUsageSample{}
+	for _, cgroupName := range cgroupNames {
+		usage, err := getCPUUsage(cgroupsHierarchyCPU, cgroupName, cgroupsV2)
+		if err != nil {
+			continue
+		}
+		samples[cgroupName] = cpuUsageSample{usage: usage, timestamp: time.Now().UnixNano()}
+	}
+	return samples
+}
+
+// relativeCPUUsage returns the CPU usage per cgroup between the start and stop samples relative to one core
+func relativeCPUUsage(start, stop map[string]cpuUsageSample) map[string]float64 {
+	usage := map[string]float64{}
+	for cgroupName, startSample := range start {
+		stopSample, ok := stop[cgroupName]
+		if !ok || stopSample.timestamp <= startSample.timestamp {
+			continue
+		}
+		usage[cgroupName] = float64(stopSample.usage-startSample.usage) / float64(stopSample.timestamp-startSample.timestamp)
+	}
+	return usage
+}
+
 // measureAverageCPUUsage measures the relative CPU usage of the kubepods and system.slice cgroup over a period of time
 // compared to the overall CPU time of all CPU cores.
 // A return value of 1.1 means that the cgroup has used 110% of the CPU time of one core
-func measureAverageCPUUsage(log *logrus.Logger, cgroupsHierarchyCPU string, period time.Duration, numCPU int64) (float64, float64, float64, error) {
+// The CPU usage of the given QoS cgroups (QoS class -> cgroup name) is measured over the same period.
+// If a QoS cgroup cannot be read, no CPU usage per QoS class is returned.
+// The CPU usage of the given additional cgroups (e.g. the system.slice units) is measured over the same period and returned by cgroup name.
+// Additional cgroups that cannot be read (e.g. removed during the period) are omitted.
+func measureAverageCPUUsage(log *logrus.Logger, cgroupsHierarchyCPU string, cgroupsV2 bool, kubepodsCgroupName string, qosCgroupNames map[string]string, additionalCgroupNames []string, period time.Duration, numCPU int64) (float64, float64, float64, map[string]float64, map[string]float64, error) {
 	startSystemSlice := time.Now().UnixNano()
-	startSystemSliceCPUUsage, err := getCPUStat(cgroupsHierarchyCPU, types.SystemSliceCgroupName, cgroupStatCPUUsage)
+	startSystemSliceCPUUsage, err := getCPUUsage(cgroupsHierarchyCPU, types.SystemSliceCgroupName, cgroupsV2)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, nil, nil, err
 	}
 
 	startKubepods := time.Now().UnixNano()
-	startKubepodsCPUUsage, err := getCPUStat(cgroupsHierarchyCPU, types.DefaultkubepodsCgroupName, cgroupStatCPUUsage)
+	startKubepodsCPUUsage, err := getCPUUsage(cgroupsHierarchyCPU, kubepodsCgroupName, cgroupsV2)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, nil, nil, err
 	}
 
+	startQoS := readQoSCPUUsage(cgroupsHierarchyCPU, qosCgroupNames, cgroupsV2)
+	startAdditional := readCPUUsageSamples(cgroupsHierarchyCPU, additionalCgroupNames, cgroupsV2)
+
 	// measure CPU usage outside kubepods with /proc/stats
 	startTotalCPUTime, startIdleCPUTime, err := readProcStats(err)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, nil, nil, err
 	}
 
 	time.Sleep(period)
 
-	stopSystemSliceCPUUsage, err := getCPUStat(cgroupsHierarchyCPU, types.SystemSliceCgroupName, cgroupStatCPUUsage)
+	stopSystemSliceCPUUsage, err := getCPUUsage(cgroupsHierarchyCPU, types.SystemSliceCgroupName, cgroupsV2)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, nil, nil, err
 	}
 	stopSystemSlice := time.Now().UnixNano()
 
-	stopKubepodsCPUUsage, err := getCPUStat(cgroupsHierarchyCPU, types.DefaultkubepodsCgroupName, cgroupStatCPUUsage)
+	stopKubepodsCPUUsage, err := getCPUUsage(cgroupsHierarchyCPU, kubepodsCgroupName, cgroupsV2)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, nil, nil, err
 	}
 	stopKubepods := time.Now().UnixNano()
 
+	var qosRelativeCPUUsage map[string]float64
+	if startQoS != nil {
+		if stopQoS := readQoSCPUUsage(cgroupsHierarchyCPU, qosCgroupNames, cgroupsV2); stopQoS != nil {
+			qosRelativeCPUUsage = relativeCPUUsage(startQoS, stopQoS)
+		}
+	}
+	if qosRelativeCPUUsage == nil {
+		log.Debugf("Not measuring the CPU usage per QoS class: the QoS cgroups cannot be read")
+	}
+	additionalRelativeCPUUsage := relativeCPUUsage(startAdditional, readCPUUsageSamples(cgroupsHierarchyCPU, additionalCgroupNames, cgroupsV2))
+
 	// measure CPU usage outside kubepods with /proc/stats
 	stopTotalCPUTime, stopIdleCPUTime, err := readProcStats(err)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, nil, nil, err
 	}
 
 	// For more information on CPU usage calculation using /proc/stats, please refer to: https://rosettacode.org/wiki/Linux_CPU_utilization
@@ -357,7 +623,7 @@ func measureAverageCPUUsage(log *logrus.Logger, cgroupsHierarchyCPU string, peri
 
 	systemSliceRelativeCPUUsage := (float64(stopSystemSliceCPUUsage) - float64(startSystemSliceCPUUsage)) / elapsedTimeSystemSlice
 	kubepodsRelativeCPUUsage := (float64(stopKubepodsCPUUsage) - float64(startKubepodsCPUUsage)) / elapsedTimeKubepods
-	return procStatOverallCPUUsage, systemSliceRelativeCPUUsage, kubepodsRelativeCPUUsage, nil
+	return procStatOverallCPUUsage, systemSliceRelativeCPUUsage, kubepodsRelativeCPUUsage, qosRelativeCPUUsage, additionalRelativeCPUUsage, nil
 }
 
 // readProcStats reads from /proc/stat and returns
@@ -0,0 +1,13 @@
+package cpu_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCPU(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CPU Suite")
+}
@@ -0,0 +1,106 @@
+package cpu
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricQoSCPUConsumptionPercent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_kubepods_qos_cpu_percent",
+		Help: "The CPU consumption of the pods of a QoS class (guaranteed, burstable, besteffort) in percent",
+	}, []string{"qos"})
+
+	metricQoSCPUShares = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_kubepods_qos_cpu_shares",
+		Help: "The CPU shares of the pods of a QoS class (guaranteed: sum of the pod cgroups)",
+	}, []string{"qos"})
+)
+
+// QoSCgroupNames returns the names of the burstable and besteffort cgroups below the kubepods cgroup by QoS class.
+// Guaranteed pods do not have a QoS cgroup.
+func QoSCgroupNames(kubepodsCgroupName string) map[string]string {
+	return map[string]string{
+		kubelet.QoSBurstable:  kubelet.QoSCgroupName(kubepodsCgroupName, kubelet.QoSBurstable),
+		kubelet.QoSBestEffort: kubelet.QoSCgroupName(kubepodsCgroupName, kubelet.QoSBestEffort),
+	}
+}
+
+// GetQoSCPUShares returns the CPU shares per QoS class.
+// Guaranteed pods are placed directly below the kubepods cgroup, their shares are the sum of the shares of the pod cgroups.
+func GetQoSCPUShares(cgroupsHierarchyCPU, kubepodsCgroupName string, cgroupsV2 bool) (map[string]int64, error) {
+	shares := map[string]int64{}
+	for qosClass, cgroupName := range QoSCgroupNames(kubepodsCgroupName) {
+		value, err := getCPUShares(cgroupsHierarchyCPU, cgroupName, cgroupsV2)
+		if err != nil {
+			return nil, err
+		}
+		shares[qosClass] = value
+	}
+
+	podCgroupNames, err := kubelet.GuaranteedPodCgroupNames(cgroupsHierarchyCPU, kubepodsCgroupName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the guaranteed pod cgroups: %w", err)
+	}
+
+	for _, podCgroupName := range podCgroupNames {
+		value, err := getCPUShares(cgroupsHierarchyCPU, podCgroupName, cgroupsV2)
+		if err != nil {
+			// the pod has been deleted in the meantime
+			continue
+		}
+		shares[kubelet.QoSGuaranteed] += value
+	}
+	return shares, nil
+}
+
+// QoSCPUUsage adds the CPU usage of the guaranteed QoS class to the CPU usage of the burstable and besteffort cgroups.
+// The guaranteed usage is the kubepods usage minus the usage of all other QoS classes.
+func QoSCPUUsage(kubepodsCPUUsage float64, qosCPUUsage map[string]float64) map[string]float64 {
+	if qosCPUUsage == nil {
+		return nil
+	}
+
+	usage := map[string]float64{}
+	guaranteed := kubepodsCPUUsage
+	for qosClass, value := range qosCPUUsage {
+		usage[qosClass] = value
+		guaranteed -= value
+	}
+
+	// the cgroups are not read at the same time
+	if guaranteed < 0 {
+		guaranteed = 0
+	}
+	usage[kubelet.QoSGuaranteed] = guaranteed
+	return usage
+}
+
+// readQoSCPUUsage reads the total CPU time consumed by the given QoS cgroups by QoS class.
+// Returns nil if a QoS cgroup cannot be read.
+func readQoSCPUUsage(cgroupsHierarchyCPU string, qosCgroupNames map[string]string, cgroupsV2 bool) map[string]cpuUsageSample {
+	usage := map[string]cpuUsageSample{}
+	for qosClass, cgroupName := range qosCgroupNames {
+		value, err := getCPUUsage(cgroupsHierarchyCPU, cgroupName, cgroupsV2)
+		if err != nil {
+			return nil
+		}
+		usage[qosClass] = cpuUsageSample{usage: value, timestamp: time.Now().UnixNano()}
+	}
+	return usage
+}
+
+// recordQoSMetrics records the CPU usage (relative to one core) and CPU shares per QoS class
+func recordQoSMetrics(qosCPUUsage map[string]float64, qosCPUShares map[string]int64) {
+	for qosClass, usage := range qosCPUUsage {
+		metricQoSCPUConsumptionPercent.WithLabelValues(qosClass).Set(math.Round(usage * 100))
+	}
+	for qosClass, shares := range qosCPUShares {
+		metricQoSCPUShares.WithLabelValues(qosClass).Set(float64(shares))
+	}
+}
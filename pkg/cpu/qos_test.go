@@ -0,0 +1,57 @@
+package cpu_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cpu"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("QoS classes", func() {
+	It("should attribute the remaining kubepods CPU usage to the guaranteed QoS class", func() {
+		usage := cpu.QoSCPUUsage(2, map[string]float64{kubelet.QoSBurstable: 0.5, kubelet.QoSBestEffort: 0.25})
+		Expect(usage).To(Equal(map[string]float64{
+			kubelet.QoSBurstable:  0.5,
+			kubelet.QoSBestEffort: 0.25,
+			kubelet.QoSGuaranteed: 1.25,
+		}))
+	})
+
+	It("should not attribute a negative CPU usage to the guaranteed QoS class", func() {
+		usage := cpu.QoSCPUUsage(0.5, map[string]float64{kubelet.QoSBurstable: 0.5, kubelet.QoSBestEffort: 0.25})
+		Expect(usage).To(HaveKeyWithValue(kubelet.QoSGuaranteed, float64(0)))
+	})
+
+	It("should not return a CPU usage per QoS class if the QoS cgroups have not been measured", func() {
+		Expect(cpu.QoSCPUUsage(2, nil)).To(BeNil())
+	})
+
+	It("should read the CPU shares per QoS class", func() {
+		cgroupRoot, err := ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(cgroupRoot)
+
+		for name, shares := range map[string]string{
+			"kubepods/burstable":  "1024",
+			"kubepods/besteffort": "2",
+			"kubepods/pod1":       "2048",
+			"kubepods/pod2":       "512",
+		} {
+			dir := filepath.Join(cgroupRoot, name)
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, cpu.CgroupV1CPUShares), []byte(shares+"\n"), 0644)).To(Succeed())
+		}
+
+		shares, err := cpu.GetQoSCPUShares(cgroupRoot, "kubepods", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(shares).To(Equal(map[string]int64{
+			kubelet.QoSBurstable:  1024,
+			kubelet.QoSBestEffort: 2,
+			kubelet.QoSGuaranteed: 2560,
+		}))
+	})
+})
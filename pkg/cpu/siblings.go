@@ -0,0 +1,121 @@
+package cpu
+
+import (
+	"math"
+	"sort"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/metrics"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricTopLevelCPUConsumptionPercent = metrics.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_top_level_cpu_percent",
+		Help: "The CPU consumption of the siblings of kubepods (the top-level cgroups besides kubepods unless it is nested, e.g. system.slice, user.slice, init.scope) in percent",
+	}, "cgroup")
+
+	metricTopLevelCPUShares = metrics.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_top_level_cpu_shares",
+		Help: "The CPU shares of the siblings of kubepods (the top-level cgroups besides kubepods unless it is nested, e.g. system.slice, user.slice, init.scope)",
+	}, "cgroup")
+)
+
+// TopLevelCgroup is a sibling of kubepods competing for CPU time (a top-level cgroup unless kubepods is nested)
+type TopLevelCgroup struct {
+	// Name is the name of the cgroup (e.g. user.slice)
+	Name string
+	// CPUShares are the CPU shares of the cgroup. 0 if the cgroup has no CPU shares (e.g. the cpu controller is not enabled).
+	CPUShares int64
+	// Usage is the CPU usage relative to one core. -1 if not measured.
+	Usage float64
+}
+
+// GetKubepodsSiblingCPUShares returns the CPU shares of the given siblings of kubepods by cgroup name.
+// Cgroups without CPU shares (e.g. the cpu controller is not enabled for the cgroup) are omitted.
+func GetKubepodsSiblingCPUShares(cgroupsHierarchyCPU string, siblingCgroupNames []string, cgroupsV2 bool) map[string]int64 {
+	shares := map[string]int64{}
+	for _, cgroupName := range siblingCgroupNames {
+		value, err := getCPUShares(cgroupsHierarchyCPU, cgroupName, cgroupsV2)
+		if err != nil {
+			continue
+		}
+		shares[cgroupName] = value
+	}
+	return shares
+}
+
+// KubepodsSiblings combines the CPU shares and the CPU usage of the given siblings of kubepods sorted by CPU usage (descending)
+func KubepodsSiblings(siblingCgroupNames []string, shares map[string]int64, cgroupCPUUsage map[string]float64) []TopLevelCgroup {
+	siblings := make([]TopLevelCgroup, 0, len(siblingCgroupNames))
+	for _, cgroupName := range siblingCgroupNames {
+		usage, ok := cgroupCPUUsage[cgroupName]
+		if !ok {
+			usage = -1
+		}
+		siblings = append(siblings, TopLevelCgroup{Name: cgroupName, CPUShares: shares[cgroupName], Usage: usage})
+	}
+
+	sort.SliceStable(siblings, func(i, j int) bool {
+		return siblings[i].Usage > siblings[j].Usage
+	})
+	return siblings
+}
+
+// SiblingCPUShares returns the total CPU shares of the siblings of kubepods (including system.slice unless kubepods is nested).
+// Falls back to the given CPU shares of system.slice if no sibling has CPU shares.
+func SiblingCPUShares(shares map[string]int64, systemSliceCPUShares int64) int64 {
+	var sum int64
+	for _, value := range shares {
+		sum += value
+	}
+	if sum == 0 {
+		return systemSliceCPUShares
+	}
+	return sum
+}
+
+// OtherSiblingCPUShares returns the total CPU shares of the siblings of kubepods besides system.slice
+func OtherSiblingCPUShares(shares map[string]int64) int64 {
+	var sum int64
+	for cgroupName, value := range shares {
+		if cgroupName != types.SystemSliceCgroupName {
+			sum += value
+		}
+	}
+	return sum
+}
+
+// sumSiblingsCPUUsage returns the total CPU usage of the given siblings of kubepods.
+// Returns false if the CPU usage of none of the cgroups has been measured.
+func sumSiblingsCPUUsage(siblings []TopLevelCgroup) (float64, bool) {
+	var (
+		sum      float64
+		measured bool
+	)
+	for _, sibling := range siblings {
+		if sibling.Usage < 0 {
+			continue
+		}
+		sum += sibling.Usage
+		measured = true
+	}
+	return sum, measured
+}
+
+// recordKubepodsSiblings records the CPU usage and CPU shares per sibling of kubepods.
+// Cgroups that no longer exist are removed from the metrics.
+func recordKubepodsSiblings(siblings []TopLevelCgroup) {
+	usage := map[string]float64{}
+	shares := map[string]float64{}
+	for _, sibling := range siblings {
+		if sibling.Usage >= 0 {
+			usage[sibling.Name] = math.Round(sibling.Usage * 100)
+		}
+		if sibling.CPUShares > 0 {
+			shares[sibling.Name] = float64(sibling.CPUShares)
+		}
+	}
+	metricTopLevelCPUConsumptionPercent.Update(usage)
+	metricTopLevelCPUShares.Update(shares)
+}
@@ -0,0 +1,53 @@
+package cpu_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cpu"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Kubepods siblings", func() {
+	It("should read the CPU shares of the siblings", func() {
+		cgroupRoot, err := ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(cgroupRoot)
+
+		for name, shares := range map[string]string{"system.slice": "1024", "user.slice": "512"} {
+			dir := filepath.Join(cgroupRoot, name)
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, cpu.CgroupV1CPUShares), []byte(shares+"\n"), 0644)).To(Succeed())
+		}
+		// the cpu controller is not enabled for init.scope
+		Expect(os.MkdirAll(filepath.Join(cgroupRoot, "init.scope"), 0755)).To(Succeed())
+
+		shares := cpu.GetKubepodsSiblingCPUShares(cgroupRoot, []string{"system.slice", "user.slice", "init.scope"}, false)
+		Expect(shares).To(Equal(map[string]int64{"system.slice": 1024, "user.slice": 512}))
+		Expect(cpu.SiblingCPUShares(shares, 1024)).To(Equal(int64(1536)))
+		Expect(cpu.OtherSiblingCPUShares(shares)).To(Equal(int64(512)))
+	})
+
+	It("should fall back to the CPU shares of system.slice", func() {
+		Expect(cpu.SiblingCPUShares(map[string]int64{}, 1024)).To(Equal(int64(1024)))
+		Expect(cpu.SiblingCPUShares(nil, 2048)).To(Equal(int64(2048)))
+	})
+
+	It("should not subtract the CPU shares of system.slice if it is no sibling of a nested kubepods cgroup", func() {
+		Expect(cpu.OtherSiblingCPUShares(map[string]int64{"custom.slice/custom-other.slice": 512})).To(Equal(int64(512)))
+	})
+
+	It("should combine the CPU shares and usage sorted by usage", func() {
+		siblings := cpu.KubepodsSiblings(
+			[]string{"system.slice", "user.slice", "init.scope"},
+			map[string]int64{"system.slice": 1024, "user.slice": 512},
+			map[string]float64{"system.slice": 0.3, "user.slice": 0.6})
+		Expect(siblings).To(Equal([]cpu.TopLevelCgroup{
+			{Name: "user.slice", CPUShares: 512, Usage: 0.6},
+			{Name: "system.slice", CPUShares: 1024, Usage: 0.3},
+			{Name: "init.scope", Usage: -1},
+		}))
+	})
+})
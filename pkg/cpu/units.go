@@ -0,0 +1,70 @@
+package cpu
+
+import (
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/metrics"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricSystemSliceUnitCPUConsumptionPercent = metrics.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_system_slice_unit_cpu_percent",
+		Help: "The CPU consumption of the child cgroups of system.slice (e.g. journald.service) in percent",
+	}, "unit")
+)
+
+// UnitCPUUsage is the CPU usage of a child cgroup of system.slice (usually a systemd unit)
+type UnitCPUUsage struct {
+	// Name is the name of the child cgroup (e.g. systemd-journald.service)
+	Name string
+	// Usage is the CPU usage relative to one core
+	Usage float64
+}
+
+// SystemSliceUnitCgroupNames returns the names of the child cgroups of system.slice relative to the CPU hierarchy
+func SystemSliceUnitCgroupNames(cgroupsHierarchyCPU string) ([]string, error) {
+	children, err := cgroupfs.ListChildren(filepath.Join(cgroupsHierarchyCPU, types.SystemSliceCgroupName))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(children))
+	for _, child := range children {
+		names = append(names, path.Join(types.SystemSliceCgroupName, child))
+	}
+	return names, nil
+}
+
+// SystemSliceUnitsCPUUsage returns the CPU usage of the given system.slice unit cgroups sorted by usage (descending).
+// Units without a measured CPU usage (e.g. stopped during the measurement) are omitted.
+func SystemSliceUnitsCPUUsage(unitCgroupNames []string, cgroupCPUUsage map[string]float64) []UnitCPUUsage {
+	var units []UnitCPUUsage
+	for _, cgroupName := range unitCgroupNames {
+		usage, ok := cgroupCPUUsage[cgroupName]
+		if !ok {
+			continue
+		}
+		units = append(units, UnitCPUUsage{Name: path.Base(cgroupName), Usage: usage})
+	}
+
+	sort.SliceStable(units, func(i, j int) bool {
+		return units[i].Usage > units[j].Usage
+	})
+	return units
+}
+
+// recordSystemSliceUnitsCPUUsage records the CPU usage per system.slice unit.
+// Units that no longer exist are removed from the metric.
+func recordSystemSliceUnitsCPUUsage(units []UnitCPUUsage) {
+	usage := make(map[string]float64, len(units))
+	for _, unit := range units {
+		usage[unit.Name] = math.Round(unit.Usage * 100)
+	}
+	metricSystemSliceUnitCPUConsumptionPercent.Update(usage)
+}
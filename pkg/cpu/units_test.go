@@ -0,0 +1,42 @@
+package cpu_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cpu"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("System.slice units", func() {
+	It("should list the child cgroups of system.slice", func() {
+		cgroupRoot, err := ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(cgroupRoot)
+
+		for _, name := range []string{"system.slice/containerd.service", "system.slice/systemd-journald.service", "kubepods.slice"} {
+			Expect(os.MkdirAll(filepath.Join(cgroupRoot, name), 0755)).To(Succeed())
+		}
+		Expect(ioutil.WriteFile(filepath.Join(cgroupRoot, "system.slice", cpu.CgroupV2CPUWeight), []byte("100\n"), 0644)).To(Succeed())
+
+		names, err := cpu.SystemSliceUnitCgroupNames(cgroupRoot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(ConsistOf("system.slice/containerd.service", "system.slice/systemd-journald.service"))
+	})
+
+	It("should sort the units by CPU usage and omit units without a measured CPU usage", func() {
+		units := cpu.SystemSliceUnitsCPUUsage(
+			[]string{"system.slice/containerd.service", "system.slice/systemd-journald.service", "system.slice/stopped.service"},
+			map[string]float64{
+				"system.slice/containerd.service":       0.2,
+				"system.slice/systemd-journald.service": 0.5,
+				"user.slice":                            1,
+			})
+		Expect(units).To(Equal([]cpu.UnitCPUUsage{
+			{Name: "systemd-journald.service", Usage: 0.5},
+			{Name: "containerd.service", Usage: 0.2},
+		}))
+	})
+})
@@ -1,14 +1,25 @@
 package util
 
-
 // COPIED FROM https://github.com/containerd/cgroups/blob/main/utils.go
 
 import (
 	"io/ioutil"
+	"math"
 	"strconv"
 	"strings"
 )
 
+const (
+	// minShares is the minimum cgroupsv1 cpu.shares value
+	minShares = 2
+	// maxShares is the maximum cgroupsv1 cpu.shares value
+	maxShares = 262144
+	// minWeight is the minimum cgroupsv2 cpu.weight value
+	minWeight = 1
+	// maxWeight is the maximum cgroupsv2 cpu.weight value
+	maxWeight = 10000
+)
+
 func ReadUint(path string) (uint64, error) {
 	v, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -40,6 +51,60 @@ func DecimalSIForBinarySi(binarySi int64) int64 {
 	return int64(float64(binarySi) / 1024 * 1000)
 }
 
+// CPUSharesToCPUWeight converts cgroupsv1 CPU shares ([2-262144]) to a cgroupsv2 cpu.weight ([1-10000])
+// This is the same conversion as done by the kubelet and runc.
+// see: https://github.com/kubernetes/enhancements/tree/master/keps/sig-node/2254-cgroup-v2#phase-1-convert-from-cgroups-v1-settings-to-v2
+func CPUSharesToCPUWeight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	if shares < minShares {
+		shares = minShares
+	}
+	if shares > maxShares {
+		shares = maxShares
+	}
+	return 1 + ((shares-minShares)*(maxWeight-minWeight))/(maxShares-minShares)
+}
+
+// CPUWeightToCPUShares converts a cgroupsv2 cpu.weight ([1-10000]) to cgroupsv1 CPU shares ([2-262144])
+// This is the inverse of CPUSharesToCPUWeight. The result is rounded up so that converting the
+// CPU shares back to a cpu.weight yields the original cpu.weight.
+func CPUWeightToCPUShares(weight uint64) uint64 {
+	if weight == 0 {
+		return 0
+	}
+	if weight < minWeight {
+		weight = minWeight
+	}
+	if weight > maxWeight {
+		weight = maxWeight
+	}
+	return minShares + ((weight-minWeight)*(maxShares-minShares)+(maxWeight-minWeight)-1)/(maxWeight-minWeight)
+}
+
+// CPUSharesForCPUTime returns the CPU shares a cgroup requires to be guaranteed the given CPU time (in cores)
+// on a machine with numCPU cores when competing with a sibling cgroup having siblingShares CPU shares.
+// Resolves cpuTime = shares / (shares + siblingShares) * numCPU to the shares.
+// Returns the maximum CPU shares if the CPU time cannot be guaranteed.
+func CPUSharesForCPUTime(cpuTime float64, siblingShares, numCPU int64) int64 {
+	if cpuTime <= 0 {
+		return minShares
+	}
+	if cpuTime >= float64(numCPU) {
+		return maxShares
+	}
+
+	shares := int64(math.Ceil(cpuTime * float64(siblingShares) / (float64(numCPU) - cpuTime)))
+	if shares < minShares {
+		return minShares
+	}
+	if shares > maxShares {
+		return maxShares
+	}
+	return shares
+}
+
 // CalculateCPUReservationBasedOnCapacity calculates the target CPU memory as a function of the node's capacity (#cpu_cores)
 // 6% of the first core
 // 1% of the next core (up to 2 cores)
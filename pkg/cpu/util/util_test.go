@@ -10,7 +10,7 @@ var _ = Describe("CalculateCPUReservationBasedOnCapacity", func() {
 	It("should return the correct reservation for <= 1 Core", func() {
 		result := util.CalculateCPUReservationBasedOnCapacity(1)
 
-		Expect(result).To(Equal(60))
+		Expect(result).To(Equal(int64(60)))
 	})
 
 	It("should return the correct reservation for <= 2 Cores", func() {
@@ -18,7 +18,7 @@ var _ = Describe("CalculateCPUReservationBasedOnCapacity", func() {
 
 		// 6% of 1 core => 60m
 		// 1% of 1 core => 10m
-		Expect(result).To(Equal(70))
+		Expect(result).To(Equal(int64(70)))
 	})
 
 	It("should return the correct reservation for < 4 Cores", func() {
@@ -27,7 +27,7 @@ var _ = Describe("CalculateCPUReservationBasedOnCapacity", func() {
 		// 6% of 1 core => 60m
 		// 1% of 1 core => 10m
 		// 0.5% of 1 core => 5m
-		Expect(result).To(Equal(75))
+		Expect(result).To(Equal(int64(75)))
 	})
 
 	It("should return the correct reservation for > 4 Cores", func() {
@@ -37,7 +37,7 @@ var _ = Describe("CalculateCPUReservationBasedOnCapacity", func() {
 		// 1% of 1 core => 10m
 		// 0.5% of 2 cores => 10m
 		// 0.25% of 12 cores => 30m
-		Expect(result).To(Equal(110))
+		Expect(result).To(Equal(int64(110)))
 	})
 })
 
@@ -48,3 +48,44 @@ var _ = Describe("DecimalSIForBinarySi", func() {
 		Expect(result).To(Equal(int64(1000)))
 	})
 })
+
+var _ = Describe("CPUSharesToCPUWeight", func() {
+	It("should convert the minimum and maximum CPU shares", func() {
+		Expect(util.CPUSharesToCPUWeight(2)).To(Equal(uint64(1)))
+		Expect(util.CPUSharesToCPUWeight(262144)).To(Equal(uint64(10000)))
+	})
+
+	It("should convert the default CPU shares", func() {
+		// 1 + ((1024 - 2) * 9999) / 262142 = 39
+		Expect(util.CPUSharesToCPUWeight(1024)).To(Equal(uint64(39)))
+	})
+})
+
+var _ = Describe("CPUWeightToCPUShares", func() {
+	It("should convert the minimum and maximum cpu.weight", func() {
+		Expect(util.CPUWeightToCPUShares(1)).To(Equal(uint64(2)))
+		Expect(util.CPUWeightToCPUShares(10000)).To(Equal(uint64(262144)))
+	})
+
+	It("should invert CPUSharesToCPUWeight", func() {
+		// 2 + ceil(((622 - 1) * 262142) / 9999) = 16283
+		Expect(util.CPUWeightToCPUShares(622)).To(Equal(uint64(16283)))
+		Expect(util.CPUSharesToCPUWeight(16283)).To(Equal(uint64(622)))
+	})
+})
+
+var _ = Describe("CPUSharesForCPUTime", func() {
+	It("should calculate the CPU shares guaranteeing the CPU time", func() {
+		// ceil(0.3769 * 42446 / (16 - 0.3769)) = ceil(1023.99) = 1024
+		Expect(util.CPUSharesForCPUTime(0.3769, 42446, 16)).To(Equal(int64(1024)))
+		// 2 * 14336 / (16 - 2) = 2048
+		Expect(util.CPUSharesForCPUTime(2, 14336, 16)).To(Equal(int64(2048)))
+	})
+
+	It("should respect the minimum and maximum CPU shares", func() {
+		Expect(util.CPUSharesForCPUTime(0, 16384, 16)).To(Equal(int64(2)))
+		Expect(util.CPUSharesForCPUTime(0.0001, 2, 16)).To(Equal(int64(2)))
+		Expect(util.CPUSharesForCPUTime(16, 16384, 16)).To(Equal(int64(262144)))
+		Expect(util.CPUSharesForCPUTime(15.99, 262144, 16)).To(Equal(int64(262144)))
+	})
+})
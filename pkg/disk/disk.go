@@ -8,11 +8,13 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
 	"github.com/dustin/go-humanize"
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
@@ -145,7 +147,7 @@ var (
 // Caveat:
 //  - assumes directories mounted under `/` are mounted on the root disk (this is not necessarely the case - e.g the kubelet directory /var/lib/kubelet could be mounted on a non-root disk in which case the recommendation is incorrect)
 //  - hostPath volumes are not considered. You have to manually check the disk usage for pods mounting host path volumes and adjust the recommendation accordingly.
-func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string, containerdStateDirectory string, kubeletDirectory string) error {
+func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string, containerdStateDirectory string, kubeletDirectory string, kubeletConfig *kubelet.Configuration) (kubelet.Reservations, error) {
 	// We are only interested in the mounts as seen from the host (we do not want to access them)
 	// However, the container this go application executes in is in a dedicated mount namespace, hence we see different mounts than the host.
 	// As a trick, we can setup the container (or the pod in k8s) to run in the host PID namespace.
@@ -160,14 +162,14 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 	//  - using nerdctl: `nerdctl run --pid=host`
 	rootDiskPartitionNameBytes, err := exec.Command("sh", "-c", cmdGetRootDiskPartitionName).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 	rootDiskPartitionName := sanitize(string(rootDiskPartitionNameBytes))
 	log.Debugf("Root disk partition name: %s", rootDiskPartitionName)
 
 	directoriesToIgnore, err := getMountpointsForNonRootBlockDevices(log, rootDiskPartitionName)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	// requires mounting the host devices from the /dev directory
@@ -176,24 +178,24 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 	// - nerdctl run --privileged
 	capacity, err := exec.Command("sh", "-c", fmt.Sprintf("%s %s", cmdGetRootDiskPartitionSizeBytes, rootDiskPartitionName)).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	rootDiskPartitionCapacityBytes, err := strconv.ParseInt(sanitize(string(capacity)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	log.Debugf("Root disk partition size in bytes: %s", humanize.IBytes(uint64(rootDiskPartitionCapacityBytes)))
 
 	available, err := exec.Command("sh", "-c", fmt.Sprintf("df %s | tr -s ' ' | cut -d\" \" -f 4  | tail -1", rootDiskPartitionName)).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	rootDiskPartitionAvailableKiloBytes, err := strconv.ParseInt(sanitize(string(available)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	rootDiskPartitionAvailableBytes := rootDiskPartitionAvailableKiloBytes * 1024
@@ -201,12 +203,12 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 
 	used, err := exec.Command("sh", "-c", fmt.Sprintf("df %s | tr -s ' ' | cut -d\" \" -f 3  | tail -1", rootDiskPartitionName)).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	rootDiskPartitionUsedKiloBytes, err := strconv.ParseInt(sanitize(string(used)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	rootDiskPartitionUsedBytes := rootDiskPartitionUsedKiloBytes * 1024
@@ -217,48 +219,48 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 
 	contentStore, err := exec.Command("sh", "-c", fmt.Sprintf("du -sb %s/io.containerd.content.v1.content/ | awk '{ print $1 }'", containerdRootDirectory)).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	containerdContentStoreBytes, err := strconv.ParseInt(sanitize(string(contentStore)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	log.Debugf("Containerd content store bytes: %s", humanize.IBytes(uint64(containerdContentStoreBytes)))
 
 	snapshotStore, err := exec.Command("sh", "-c", fmt.Sprintf("du -sb %s/io.containerd.snapshotter.v1.overlayfs | awk '{ print $1 }'", containerdRootDirectory)).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	containerdSnapshotStoreBytes, err := strconv.ParseInt(sanitize(string(snapshotStore)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	log.Debugf("Containerd snapshot store size (snapshots including working directories of containers): %s", humanize.IBytes(uint64(containerdSnapshotStoreBytes)))
 
 	containerdState, err := exec.Command("sh", "-c", fmt.Sprintf("du -sb --exclude=\"rootfs\" %s | awk '{ print $1 }'", containerdStateDirectory)).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	containerdStateBytes, err := strconv.ParseInt(sanitize(string(containerdState)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	log.Debugf("Containerd state size (%s) without rootfs: %s", containerdStateDirectory, humanize.IBytes(uint64(containerdStateBytes)))
 
 	logs, err := exec.Command("sh", "-c", "du -sb /var/log/pods | awk '{ print $1 }'").Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	podLogsBytes, err := strconv.ParseInt(sanitize(string(logs)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	log.Debugf("Size of container logs: %s", humanize.IBytes(uint64(podLogsBytes)))
@@ -278,24 +280,24 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 
 	volumeSize, err := exec.Command("sh", "-c", podVolumeSizeCommand).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	podVolumeSizeBytes, err := strconv.ParseInt(sanitize(string(volumeSize)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	log.Debugf("Size of pod volumes (only on root disk): %s", humanize.IBytes(uint64(podVolumeSizeBytes)))
 
 	pluginsSize, err := exec.Command("sh", "-c", fmt.Sprintf("du -sb --exclude=\"csi\" %s/plugins | awk '{ print $1 }'", kubeletDirectory)).Output()
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	kubeletPluginsSizeBytes, err := strconv.ParseInt(sanitize(string(pluginsSize)), 10, 64)
 	if err != nil {
-		return err
+		return kubelet.Reservations{}, err
 	}
 
 	log.Debugf("Size of kubelet plugins: %s", humanize.IBytes(uint64(kubeletPluginsSizeBytes)))
@@ -304,6 +306,20 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 
 	log.Debugf("Disk reservation recommendation: %s", humanize.IBytes(uint64(diskReservationRecommendation)))
 
+	currentReservations, err := kubeletConfig.Reservations(kubelet.ResourceEphemeralStorage, *resource.NewQuantity(rootDiskPartitionCapacityBytes, resource.BinarySI))
+	if err != nil {
+		return kubelet.Reservations{}, fmt.Errorf("failed to read the ephemeral-storage reservations from the kubelet configuration: %w", err)
+	}
+
+	// the disk usage of the kubernetes components cannot be separated from the disk usage of other non-pod processes
+	// Hence, the configured system-reserved is kept.
+	targetReservedDisk := diskReservationRecommendation
+	if targetReservedDisk < 0 {
+		targetReservedDisk = 0
+	}
+	targetReservations := kubelet.SplitKeepingSystemReserved(*resource.NewQuantity(targetReservedDisk, resource.BinarySI), currentReservations)
+	kubelet.RecordReservations(kubelet.ResourceEphemeralStorage, currentReservations, targetReservations)
+
 	logRecommendation(
 		rootDiskPartitionName,
 		humanize.IBytes(uint64(rootDiskPartitionCapacityBytes)),
@@ -328,6 +344,8 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 		humanize.IBytes(uint64(diskReservationRecommendation)),
 		diskReservationRecommendation,
 		int64(math.Round(float64(diskReservationRecommendation)/float64(rootDiskPartitionCapacityBytes)*100)),
+		currentReservations,
+		targetReservations,
 	)
 
 	// record metrics
@@ -351,7 +369,7 @@ func RecommendDiskReservation(log *logrus.Logger, containerdRootDirectory string
 	metricKubeletPluginSizePercent.Set(float64(kubeletPluginsSizeBytes)/float64(rootDiskPartitionCapacityBytes)*100)
 	metricKubeletTargetReservedDiskBytes.Set(float64(diskReservationRecommendation))
 	metricKubeletTargetReservedDiskPercent.Set(float64(diskReservationRecommendation)/float64(rootDiskPartitionCapacityBytes)*100)
-	return nil
+	return targetReservations, nil
 }
 
 // getMountpointsForNonRootBlockDevices gets mountpoints that are not mounted on the root disk
@@ -453,7 +471,9 @@ func logRecommendation(
 	kubeletPluginSizePercentTotal int64,
 	targetReservedDisk string,
 	targetReservedDiskPrecise int64,
-	targetReservedDiskPercentTotal int64) {
+	targetReservedDiskPercentTotal int64,
+	currentReservations kubelet.Reservations,
+	targetReservations kubelet.Reservations) {
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
 	t.AppendHeader(table.Row{"Disk Metric", "Value"})
@@ -470,10 +490,18 @@ func logRecommendation(
 		{"Size of container logs (/var/log/pods)", fmt.Sprintf("%s (%d%%)", podLogsSize, podLogsSizePercentTotal)},
 		{"Size of pod volumes (/var/lib/kubelet/pods, excluding CSI, hostPath, tmpfs emptyDir)", fmt.Sprintf("%s (%d%%)", podVolumesSize, podVolumesSizePercentTotal)},
 		{"Size of kubelet plugins (/var/lib/kubelet/plugins)", fmt.Sprintf("%s (%d%%)", kubeletPluginSize, kubeletPluginSizePercentTotal)},
+		{"Current kube-reserved (kubelet config)", humanize.IBytes(uint64(currentReservations.KubeReserved.Value()))},
+		{"Current system-reserved (kubelet config)", humanize.IBytes(uint64(currentReservations.SystemReserved.Value()))},
+		{"Current eviction-hard nodefs.available (kubelet config)", humanize.IBytes(uint64(currentReservations.EvictionHard.Value()))},
 	})
 
 	t.AppendSeparator()
 	t.AppendRow(table.Row{"RECOMMENDATION", fmt.Sprintf("%s (%d bytes, %d%%)", targetReservedDisk, targetReservedDiskPrecise, targetReservedDiskPercentTotal)})
+	t.AppendRows([]table.Row{
+		{" - kube-reserved", humanize.IBytes(uint64(targetReservations.KubeReserved.Value()))},
+		{" - system-reserved", humanize.IBytes(uint64(targetReservations.SystemReserved.Value()))},
+		{" - eviction-hard", humanize.IBytes(uint64(targetReservations.EvictionHard.Value()))},
+	})
 	t.Render()
 }
 
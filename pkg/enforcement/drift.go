@@ -0,0 +1,126 @@
+package enforcement
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	metricDriftOverrides = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enforcement_drift_overrides_total",
+		Help: "The number of times an enforced value has been overwritten by another component (e.g the kubelet) by resource and file",
+	}, []string{"resource", "file"})
+
+	metricDriftReapplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enforcement_drift_reapplied_total",
+		Help: "The number of times an overwritten enforced value has been re-applied by resource and file",
+	}, []string{"resource", "file"})
+)
+
+// DriftGuard decides if an overwritten write may be re-applied. Returns an error if not.
+type DriftGuard func(write Write) error
+
+// DriftDetector polls the cgroup files written by a Writer and re-applies the last written value
+// if the file has been changed by another component.
+// The kubelet, for instance, resets the kubepods cgroup when it restarts or updates the QoS cgroups.
+// Polling is used, because the cgroupfs does not emit inotify events when a limit file is written.
+type DriftDetector struct {
+	log      *logrus.Logger
+	writer   *Writer
+	recorder *EventRecorder
+	interval time.Duration
+	guard    DriftGuard
+	// overwritten contains the overwriting value per file that has already been reported,
+	// so that a value that is not re-applied is only reported once
+	overwritten map[string]string
+}
+
+// NewDriftDetector creates a new DriftDetector checking the files every interval.
+// Before re-applying a value, the guard is consulted (if not nil).
+func NewDriftDetector(log *logrus.Logger, writer *Writer, recorder *EventRecorder, interval time.Duration, guard DriftGuard) *DriftDetector {
+	return &DriftDetector{
+		log:      log,
+		writer:   writer,
+		recorder: recorder,
+		interval: interval,
+		guard:    guard,
+
+		overwritten: map[string]string{},
+	}
+}
+
+// Run checks for drift every interval until the stop channel is closed
+func (d *DriftDetector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.Check()
+		}
+	}
+}
+
+// Check compares the cgroup files with the last written values and re-applies overwritten values.
+// Returns the number of re-applied values.
+func (d *DriftDetector) Check() int {
+	reapplied := 0
+	for _, write := range d.writer.Writes() {
+		if d.checkFile(write.File) {
+			reapplied++
+		}
+	}
+	return reapplied
+}
+
+// checkFile checks a single file for drift and re-applies the last written value.
+// Returns true if the value has been re-applied.
+func (d *DriftDetector) checkFile(file string) bool {
+	// no write must happen between reading the last write and re-applying it
+	d.writer.writeMu.Lock()
+	defer d.writer.writeMu.Unlock()
+
+	write, ok := d.writer.lastWrite(file)
+	if !ok || write.DryRun {
+		return false
+	}
+
+	current, err := readValue(file)
+	if err != nil {
+		d.log.Warnf("failed to check %s for drift: %v", file, err)
+		return false
+	}
+
+	if current == write.Effective {
+		delete(d.overwritten, file)
+		return false
+	}
+
+	if d.overwritten[file] != current {
+		metricDriftOverrides.WithLabelValues(write.Resource, write.File).Inc()
+		d.recorder.Eventf(EventTypeWarning, "EnforcedValueOverwritten", "Enforced value %q of %s has been overwritten with %q", write.Effective, file, current)
+		d.overwritten[file] = current
+	}
+
+	if d.guard != nil {
+		if err := d.guard(write); err != nil {
+			d.log.Warnf("Not re-applying %q to %s: %v", write.New, file, err)
+			return false
+		}
+	}
+
+	if _, err := d.writer.write(write.Resource, file, write.New); err != nil {
+		d.log.Warnf("failed to re-apply %q to %s: %v", write.New, file, err)
+		return false
+	}
+
+	delete(d.overwritten, file)
+	metricDriftReapplied.WithLabelValues(write.Resource, write.File).Inc()
+	return true
+}
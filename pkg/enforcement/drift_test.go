@@ -0,0 +1,84 @@
+package enforcement_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/enforcement"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("DriftDetector", func() {
+	var (
+		dir      string
+		file     string
+		log      = logrus.New()
+		recorder = enforcement.NewEventRecorder(log, "node")
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "drift")
+		Expect(err).ToNot(HaveOccurred())
+
+		file = filepath.Join(dir, "cpu.shares")
+		Expect(ioutil.WriteFile(file, []byte("16384\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	overwrite := func(value string) {
+		Expect(ioutil.WriteFile(file, []byte(value), 0644)).To(Succeed())
+	}
+
+	readFile := func() string {
+		content, err := ioutil.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		return string(content)
+	}
+
+	It("should re-apply an overwritten value", func() {
+		writer := enforcement.NewWriter(log, false)
+		_, err := writer.Write("cpu", file, "20000")
+		Expect(err).ToNot(HaveOccurred())
+
+		detector := enforcement.NewDriftDetector(log, writer, recorder, time.Second, nil)
+		Expect(detector.Check()).To(Equal(0))
+
+		overwrite("16384")
+		Expect(detector.Check()).To(Equal(1))
+		Expect(readFile()).To(Equal("20000"))
+		Expect(detector.Check()).To(Equal(0))
+	})
+
+	It("should not re-apply the value if the guard rejects it", func() {
+		writer := enforcement.NewWriter(log, false)
+		_, err := writer.Write("cpu", file, "20000")
+		Expect(err).ToNot(HaveOccurred())
+
+		detector := enforcement.NewDriftDetector(log, writer, recorder, time.Second, func(enforcement.Write) error {
+			return fmt.Errorf("rejected")
+		})
+
+		overwrite("16384")
+		Expect(detector.Check()).To(Equal(0))
+		Expect(readFile()).To(Equal("16384"))
+	})
+
+	It("should ignore planned writes in dry-run mode", func() {
+		writer := enforcement.NewWriter(log, true)
+		_, err := writer.Write("cpu", file, "20000")
+		Expect(err).ToNot(HaveOccurred())
+
+		detector := enforcement.NewDriftDetector(log, writer, recorder, time.Second, nil)
+		Expect(detector.Check()).To(Equal(0))
+		Expect(readFile()).To(Equal("16384\n"))
+	})
+})
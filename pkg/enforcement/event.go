@@ -0,0 +1,46 @@
+package enforcement
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// EventTypeNormal is the type of Kubernetes Events for informational messages
+	EventTypeNormal = "Normal"
+	// EventTypeWarning is the type of Kubernetes Events for unexpected situations
+	EventTypeWarning = "Warning"
+	// eventSource is the component reported as the source of the events
+	eventSource = "reserved-resources-recommender"
+)
+
+// EventRecorder logs Kubernetes Event-style entries with the node as involved object.
+// The entries are not sent to the API server, but can be picked up by log based alerting.
+type EventRecorder struct {
+	log      *logrus.Logger
+	nodeName string
+}
+
+// NewEventRecorder creates a new EventRecorder for the given node
+func NewEventRecorder(log *logrus.Logger, nodeName string) *EventRecorder {
+	return &EventRecorder{
+		log:      log,
+		nodeName: nodeName,
+	}
+}
+
+// Eventf logs an event with the given type, reason and message
+func (r *EventRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	entry := r.log.WithFields(logrus.Fields{
+		"kind":           "Event",
+		"type":           eventType,
+		"reason":         reason,
+		"involvedObject": "Node/" + r.nodeName,
+		"source":         eventSource,
+	})
+
+	if eventType == EventTypeWarning {
+		entry.Warnf(messageFmt, args...)
+		return
+	}
+	entry.Infof(messageFmt, args...)
+}
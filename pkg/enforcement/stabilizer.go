@@ -0,0 +1,173 @@
+package enforcement
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// OutcomeApplied means that the target is written as is
+	OutcomeApplied = "applied"
+	// OutcomeStepLimited means that the target is lower than allowed by the maximum decrease and
+	// the current value lowered by the maximum decrease is written instead
+	OutcomeStepLimited = "step-limited"
+	// OutcomeBelowMinChange means that nothing is written, because the target differs too little from the current value
+	OutcomeBelowMinChange = "below-min-change"
+	// OutcomeCoolDown means that nothing is written, because the last write happened within the cool-down period
+	OutcomeCoolDown = "cool-down"
+	// OutcomeClampedToUsage means that the value to write is below the current usage and
+	// the current usage plus the minimum change is written instead
+	OutcomeClampedToUsage = "clamped-to-usage"
+	// OutcomeDeferredByUsage means that nothing is written, because the value to write is below the current usage
+	// and the current value is not above the current usage plus the minimum change
+	OutcomeDeferredByUsage = "deferred-by-usage"
+	// OutcomeEmergency means that the target is written as is in an emergency, ignoring the cool-down period and the maximum decrease
+	OutcomeEmergency = "emergency"
+)
+
+var (
+	metricDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enforcement_decisions_total",
+		Help: "The number of enforcement decisions for the kubepods cgroup by resource and outcome",
+	}, []string{"resource", "outcome"})
+
+	metricUsageConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enforcement_usage_conflicts_total",
+		Help: "The number of times the value to enforce on the kubepods cgroup was below the current usage of the kubepods cgroup by resource",
+	}, []string{"resource"})
+
+	metricEnforcedValue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enforcement_enforced_value",
+		Help: "The last value written (in dry-run mode: planned to be written) to the kubepods cgroup by resource (memory in bytes)",
+	}, []string{"resource"})
+)
+
+// Decision is the result of stabilizing a target value
+type Decision struct {
+	// Outcome is one of applied, step-limited, below-min-change, cool-down, clamped-to-usage, deferred-by-usage or emergency
+	Outcome string
+	// Value is the value to write. Only set if Write is true.
+	Value int64
+	// Write is true if the value should be written to the cgroup
+	Write bool
+	// UsageConflict is true if the value to write would have been below the current usage
+	UsageConflict bool
+}
+
+// Stabilizer prevents a jittering cgroup limit when enforcing the latest recommendation.
+// A new value is only written if it differs by at least the minimum change from the current value
+// and the last write is longer ago than the cool-down period.
+// A single write never decreases the value by more than the maximum decrease and never below the current usage
+// (otherwise the kernel immediately reclaims memory from or OOM kills processes in the cgroup).
+type Stabilizer struct {
+	mu sync.Mutex
+
+	resourceName string
+	minChange    int64
+	maxDecrease  int64
+	coolDown     time.Duration
+	lastWrite    time.Time
+	now          func() time.Time
+}
+
+// NewStabilizer creates a new Stabilizer for the given resource.
+// A maxDecrease <= 0 does not limit decreases.
+func NewStabilizer(resourceName string, minChange, maxDecrease int64, coolDown time.Duration) *Stabilizer {
+	return &Stabilizer{
+		resourceName: resourceName,
+		minChange:    minChange,
+		maxDecrease:  maxDecrease,
+		coolDown:     coolDown,
+		now:          time.Now,
+	}
+}
+
+// Decide decides if and which value should be written to move the current value towards the target.
+// The value written is at least the given usage plus the minimum change.
+// The decision is recorded as metric.
+func (s *Stabilizer) Decide(current, target, usage int64) Decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decision := s.decide(current, target)
+	if decision.Write {
+		decision = s.protectUsage(decision, current, usage)
+	}
+
+	s.record(decision)
+	return decision
+}
+
+// DecideEmergency decides if and which value should be written to tighten the current value towards the target
+// in an emergency (e.g. under acute memory pressure).
+// Only decreases by at least the minimum change are written. The cool-down period and the maximum decrease are ignored,
+// but the value written is still at least the given usage plus the minimum change.
+// The decision is recorded as metric.
+func (s *Stabilizer) DecideEmergency(current, target, usage int64) Decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decision := Decision{Outcome: OutcomeBelowMinChange}
+	if current-target >= s.minChange {
+		decision = s.protectUsage(Decision{Outcome: OutcomeEmergency, Value: target, Write: true}, current, usage)
+	}
+
+	s.record(decision)
+	return decision
+}
+
+// record records the decision as metric
+func (s *Stabilizer) record(decision Decision) {
+	metricDecisions.WithLabelValues(s.resourceName, decision.Outcome).Inc()
+	if decision.UsageConflict {
+		metricUsageConflicts.WithLabelValues(s.resourceName).Inc()
+	}
+}
+
+// protectUsage clamps the value to write to the usage plus the minimum change.
+// Defers the write if that would not lower the current value.
+func (s *Stabilizer) protectUsage(decision Decision, current, usage int64) Decision {
+	lowerBound := usage + s.minChange
+	if decision.Value >= lowerBound {
+		return decision
+	}
+
+	if lowerBound >= current {
+		return Decision{Outcome: OutcomeDeferredByUsage, UsageConflict: true}
+	}
+	return Decision{Outcome: OutcomeClampedToUsage, Value: lowerBound, Write: true, UsageConflict: true}
+}
+
+func (s *Stabilizer) decide(current, target int64) Decision {
+	change := target - current
+	if change < 0 {
+		change = -change
+	}
+
+	if change < s.minChange {
+		return Decision{Outcome: OutcomeBelowMinChange}
+	}
+
+	if !s.lastWrite.IsZero() && s.now().Sub(s.lastWrite) < s.coolDown {
+		return Decision{Outcome: OutcomeCoolDown}
+	}
+
+	if s.maxDecrease > 0 && current-target > s.maxDecrease {
+		return Decision{Outcome: OutcomeStepLimited, Value: current - s.maxDecrease, Write: true}
+	}
+
+	return Decision{Outcome: OutcomeApplied, Value: target, Write: true}
+}
+
+// Written records that the given value has been written to the cgroup.
+// Starts the cool-down period.
+func (s *Stabilizer) Written(value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastWrite = s.now()
+	metricEnforcedValue.WithLabelValues(s.resourceName).Set(float64(value))
+}
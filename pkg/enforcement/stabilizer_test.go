@@ -0,0 +1,114 @@
+package enforcement_test
+
+import (
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/enforcement"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stabilizer", func() {
+	const (
+		mi          = int64(1024 * 1024)
+		minChange   = 50 * mi
+		maxDecrease = 200 * mi
+		usage       = 4000 * mi
+	)
+
+	It("should not write changes below the minimum change", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+		decision := stabilizer.Decide(8000*mi, 8040*mi, usage)
+		Expect(decision.Write).To(BeFalse())
+		Expect(decision.Outcome).To(Equal(enforcement.OutcomeBelowMinChange))
+
+		decision = stabilizer.Decide(8000*mi, 7960*mi, usage)
+		Expect(decision.Write).To(BeFalse())
+		Expect(decision.Outcome).To(Equal(enforcement.OutcomeBelowMinChange))
+	})
+
+	It("should apply the target", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+		decision := stabilizer.Decide(8000*mi, 9000*mi, usage)
+		Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeApplied, Value: 9000 * mi, Write: true}))
+
+		decision = stabilizer.Decide(8000*mi, 7900*mi, usage)
+		Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeApplied, Value: 7900 * mi, Write: true}))
+	})
+
+	It("should limit the decrease per write", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+		decision := stabilizer.Decide(8000*mi, 6000*mi, usage)
+		Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeStepLimited, Value: 7800 * mi, Write: true}))
+	})
+
+	It("should not limit the decrease without maximum decrease", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, 0, 0)
+
+		decision := stabilizer.Decide(8000*mi, 6000*mi, usage)
+		Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeApplied, Value: 6000 * mi, Write: true}))
+	})
+
+	It("should not write within the cool-down period", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, time.Hour)
+
+		decision := stabilizer.Decide(8000*mi, 9000*mi, usage)
+		Expect(decision.Write).To(BeTrue())
+		stabilizer.Written(decision.Value)
+
+		decision = stabilizer.Decide(9000*mi, 8000*mi, usage)
+		Expect(decision.Write).To(BeFalse())
+		Expect(decision.Outcome).To(Equal(enforcement.OutcomeCoolDown))
+	})
+
+	It("should clamp the value to the usage", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+		decision := stabilizer.Decide(8000*mi, 7000*mi, 7850*mi)
+		Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeClampedToUsage, Value: 7900 * mi, Write: true, UsageConflict: true}))
+	})
+
+	It("should defer the write if the usage is above the current value", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+		decision := stabilizer.Decide(8000*mi, 7900*mi, 7990*mi)
+		Expect(decision.Write).To(BeFalse())
+		Expect(decision.UsageConflict).To(BeTrue())
+		Expect(decision.Outcome).To(Equal(enforcement.OutcomeDeferredByUsage))
+	})
+
+	It("should not be restricted by the usage when increasing the value", func() {
+		stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+		decision := stabilizer.Decide(8000*mi, 9000*mi, 8500*mi)
+		Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeApplied, Value: 9000 * mi, Write: true}))
+	})
+
+	Context("emergency", func() {
+		It("should tighten to the target ignoring the cool-down period and the maximum decrease", func() {
+			stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, time.Hour)
+			stabilizer.Written(8000 * mi)
+
+			decision := stabilizer.DecideEmergency(8000*mi, 6000*mi, usage)
+			Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeEmergency, Value: 6000 * mi, Write: true}))
+		})
+
+		It("should not raise the value", func() {
+			stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+			decision := stabilizer.DecideEmergency(8000*mi, 9000*mi, usage)
+			Expect(decision.Write).To(BeFalse())
+			Expect(decision.Outcome).To(Equal(enforcement.OutcomeBelowMinChange))
+		})
+
+		It("should not tighten below the usage", func() {
+			stabilizer := enforcement.NewStabilizer("memory", minChange, maxDecrease, 0)
+
+			decision := stabilizer.DecideEmergency(8000*mi, 6000*mi, 7000*mi)
+			Expect(decision).To(Equal(enforcement.Decision{Outcome: enforcement.OutcomeClampedToUsage, Value: 7050 * mi, Write: true, UsageConflict: true}))
+		})
+	})
+})
@@ -0,0 +1,186 @@
+package enforcement
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	metricWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enforcement_cgroup_writes_total",
+		Help: "The number of (in dry-run mode: planned) writes to cgroup files by resource",
+	}, []string{"resource", "dry_run"})
+
+	metricWriteOldValue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enforcement_cgroup_write_old_value",
+		Help: "The value of the cgroup file before the last (in dry-run mode: planned) write by resource and file",
+	}, []string{"resource", "file"})
+
+	metricWriteNewValue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enforcement_cgroup_write_new_value",
+		Help: "The value written (in dry-run mode: planned to be written) to the cgroup file by the last write by resource and file",
+	}, []string{"resource", "file"})
+)
+
+// Write is a write of a value to a cgroup file
+type Write struct {
+	// Resource is the resource (memory, cpu) the write enforces
+	Resource string `json:"resource"`
+	// File is the path of the cgroup file
+	File string `json:"file"`
+	// Old is the value of the file before the write
+	Old string `json:"old"`
+	// New is the value written to the file
+	New string `json:"new"`
+	// Effective is the value of the file read back after the write (the kernel might e.g round memory limits to the page size).
+	// Not set in dry-run mode.
+	Effective string `json:"effective,omitempty"`
+	// DryRun is true if the write has only been planned and not performed
+	DryRun bool `json:"dryRun"`
+	// Time is the time of the write
+	Time time.Time `json:"time"`
+}
+
+// Writer writes values to cgroup files.
+// In dry-run mode, the writes are only logged and recorded, but the cgroup files are not touched.
+// The last write per file is exposed as metrics and via HTTP.
+type Writer struct {
+	// writeMu serializes the writes to the cgroup files
+	writeMu sync.Mutex
+	// mu guards the writes
+	mu sync.Mutex
+
+	log    *logrus.Logger
+	dryRun bool
+	// writes are the last writes by file
+	writes map[string]Write
+	now    func() time.Time
+}
+
+// NewWriter creates a new Writer
+func NewWriter(log *logrus.Logger, dryRun bool) *Writer {
+	return &Writer{
+		log:    log,
+		dryRun: dryRun,
+		writes: map[string]Write{},
+		now:    time.Now,
+	}
+}
+
+// Write writes the value to the given cgroup file enforcing the given resource.
+// Nothing is written if the file already contains the value.
+// Returns the performed (in dry-run mode: planned) write or nil.
+func (w *Writer) Write(resourceName, file, value string) (*Write, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	return w.write(resourceName, file, value)
+}
+
+// write writes the value to the given cgroup file. Must be called with the writeMu held.
+func (w *Writer) write(resourceName, file, value string) (*Write, error) {
+	old, err := readValue(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if old == value {
+		w.log.Debugf("Not writing %q to %s: value is already set", value, file)
+		return nil, nil
+	}
+
+	write := Write{
+		Resource: resourceName,
+		File:     file,
+		Old:      old,
+		New:      value,
+		DryRun:   w.dryRun,
+		Time:     w.now(),
+	}
+
+	if w.dryRun {
+		w.log.Infof("[dry-run] Would write %s: %q -> %q", file, old, value)
+	} else {
+		if err := cgroupfs.WriteValue(file, value); err != nil {
+			return nil, fmt.Errorf("failed to write %q to %s: %w", value, file, err)
+		}
+
+		write.Effective, err = readValue(file)
+		if err != nil {
+			return nil, err
+		}
+		w.log.Infof("Wrote %s: %q -> %q (effective: %q)", file, old, value, write.Effective)
+	}
+
+	w.record(write)
+	return &write, nil
+}
+
+// lastWrite returns the last write to the given file
+func (w *Writer) lastWrite(file string) (Write, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	write, ok := w.writes[file]
+	return write, ok
+}
+
+// record records the write as the last write to the file
+func (w *Writer) record(write Write) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writes[write.File] = write
+
+	metricWrites.WithLabelValues(write.Resource, strconv.FormatBool(write.DryRun)).Inc()
+	if old, err := strconv.ParseFloat(write.Old, 64); err == nil {
+		metricWriteOldValue.WithLabelValues(write.Resource, write.File).Set(old)
+	}
+	if value, err := strconv.ParseFloat(write.New, 64); err == nil {
+		metricWriteNewValue.WithLabelValues(write.Resource, write.File).Set(value)
+	}
+}
+
+// Writes returns the last write per file sorted by file
+func (w *Writer) Writes() []Write {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	writes := make([]Write, 0, len(w.writes))
+	for _, write := range w.writes {
+		writes = append(writes, write)
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].File < writes[j].File
+	})
+	return writes
+}
+
+// readValue reads the (trimmed) value of a cgroup file
+func readValue(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the current value of %s: %w", file, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// ServeHTTP serves the last write per file as JSON
+func (w *Writer) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(w.Writes()); err != nil {
+		w.log.Warnf("failed to serve the cgroup writes: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package enforcement_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/enforcement"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Writer", func() {
+	var (
+		dir  string
+		file string
+		log  = logrus.New()
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "enforcement")
+		Expect(err).ToNot(HaveOccurred())
+
+		file = filepath.Join(dir, "memory.max")
+		Expect(ioutil.WriteFile(file, []byte("8589934592\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	readFile := func() string {
+		content, err := ioutil.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		return string(content)
+	}
+
+	It("should write the value", func() {
+		writer := enforcement.NewWriter(log, false)
+
+		write, err := writer.Write("memory", file, "7516192768")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(write).ToNot(BeNil())
+		Expect(write.Old).To(Equal("8589934592"))
+		Expect(write.New).To(Equal("7516192768"))
+		Expect(write.DryRun).To(BeFalse())
+		Expect(readFile()).To(Equal("7516192768"))
+	})
+
+	It("should not touch the file in dry-run mode", func() {
+		writer := enforcement.NewWriter(log, true)
+
+		write, err := writer.Write("memory", file, "7516192768")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(write.DryRun).To(BeTrue())
+		Expect(readFile()).To(Equal("8589934592\n"))
+
+		Expect(writer.Writes()).To(HaveLen(1))
+		Expect(writer.Writes()[0].New).To(Equal("7516192768"))
+	})
+
+	It("should not write a value that is already set", func() {
+		writer := enforcement.NewWriter(log, false)
+
+		write, err := writer.Write("memory", file, "8589934592")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(write).To(BeNil())
+		Expect(writer.Writes()).To(BeEmpty())
+	})
+
+	It("should fail for a missing file", func() {
+		writer := enforcement.NewWriter(log, true)
+
+		_, err := writer.Write("memory", filepath.Join(dir, "missing"), "1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should serve the last writes", func() {
+		writer := enforcement.NewWriter(log, true)
+		_, err := writer.Write("memory", file, "7516192768")
+		Expect(err).ToNot(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		writer.ServeHTTP(recorder, httptest.NewRequest("GET", "/enforcement/writes", nil))
+
+		var writes []enforcement.Write
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &writes)).To(Succeed())
+		Expect(writes).To(HaveLen(1))
+		Expect(writes[0].File).To(Equal(file))
+		Expect(writes[0].Old).To(Equal("8589934592"))
+		Expect(writes[0].New).To(Equal("7516192768"))
+	})
+})
@@ -0,0 +1,172 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// maxDecayExponent is the maximum exponent of the decay factor of a sample before the reference timestamp
+	// of the histogram is shifted. Prevents the sample weights from growing towards infinity (2^100 is still safe for float64).
+	maxDecayExponent = 100
+	// epsilon is the minimum total weight for a histogram to be considered non-empty
+	epsilon = 1e-10
+)
+
+// Options define the exponential bucketing of a histogram.
+// The first bucket is [0, FirstBucketSize). Every following bucket is Ratio times larger than the previous one.
+// Samples larger than MaxValue are added to the last bucket.
+type Options struct {
+	// MaxValue is the largest value that can be distinguished by the histogram
+	MaxValue float64
+	// FirstBucketSize is the size of the first bucket
+	FirstBucketSize float64
+	// Ratio is the ratio between the sizes of two consecutive buckets (must be > 1)
+	Ratio float64
+}
+
+// Validate validates the histogram options
+func (o Options) Validate() error {
+	if o.MaxValue <= 0 || o.FirstBucketSize <= 0 {
+		return fmt.Errorf("max value (%v) and first bucket size (%v) must be positive", o.MaxValue, o.FirstBucketSize)
+	}
+	if o.Ratio <= 1 {
+		return fmt.Errorf("ratio (%v) must be larger than 1", o.Ratio)
+	}
+	return nil
+}
+
+// numBuckets returns the number of buckets required to cover [0, MaxValue]
+func (o Options) numBuckets() int {
+	n := int(math.Ceil(math.Log(o.MaxValue*(o.Ratio-1)/o.FirstBucketSize+1) / math.Log(o.Ratio)))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// bucketStart returns the lower bound of the given bucket
+// Sum of the geometric series: FirstBucketSize * (Ratio^bucket - 1) / (Ratio - 1)
+func (o Options) bucketStart(bucket int) float64 {
+	return o.FirstBucketSize * (math.Pow(o.Ratio, float64(bucket)) - 1) / (o.Ratio - 1)
+}
+
+// findBucket returns the bucket the given value belongs to
+func (o Options) findBucket(value float64, numBuckets int) int {
+	if value < o.FirstBucketSize {
+		return 0
+	}
+
+	bucket := int(math.Floor(math.Log(value*(o.Ratio-1)/o.FirstBucketSize+1) / math.Log(o.Ratio)))
+	if bucket >= numBuckets {
+		return numBuckets - 1
+	}
+	return bucket
+}
+
+// DecayingHistogram is a histogram with exponential buckets where the weight of a sample decays over time
+// with the given half-life (similar to the histograms of the Kubernetes vertical pod autoscaler).
+// A sample added one half-life later has twice the weight of the earlier sample.
+// Instead of decreasing the weight of all existing samples, the weight of new samples grows relative to a reference timestamp.
+type DecayingHistogram struct {
+	options    Options
+	numBuckets int
+	halfLife   time.Duration
+	// weights contains the (not normalized) weight of each bucket
+	weights     []float64
+	totalWeight float64
+	// referenceTimestamp is the time at which a sample has a decay factor of 1
+	referenceTimestamp time.Time
+}
+
+// NewDecayingHistogram returns a new empty decaying histogram
+func NewDecayingHistogram(options Options, halfLife time.Duration) *DecayingHistogram {
+	numBuckets := options.numBuckets()
+	return &DecayingHistogram{
+		options:    options,
+		numBuckets: numBuckets,
+		halfLife:   halfLife,
+		weights:    make([]float64, numBuckets),
+	}
+}
+
+// AddSample adds a sample with the given weight observed at time t
+func (h *DecayingHistogram) AddSample(value, weight float64, t time.Time) {
+	if h.referenceTimestamp.IsZero() {
+		h.referenceTimestamp = t
+	}
+
+	if h.decayExponent(t) > maxDecayExponent {
+		h.shiftReferenceTimestamp(t)
+	}
+
+	decayedWeight := weight * math.Exp2(h.decayExponent(t))
+	bucket := h.options.findBucket(value, h.numBuckets)
+	h.weights[bucket] += decayedWeight
+	h.totalWeight += decayedWeight
+}
+
+// Merge adds the samples of the other histogram to this histogram.
+// Both histograms must have been created with the same options and half-life.
+func (h *DecayingHistogram) Merge(other *DecayingHistogram) {
+	if other.IsEmpty() {
+		return
+	}
+
+	if h.referenceTimestamp.IsZero() {
+		h.referenceTimestamp = other.referenceTimestamp
+	}
+
+	// express the weights of the other histogram relative to the reference timestamp of this histogram
+	factor := math.Exp2(h.decayExponent(other.referenceTimestamp))
+	for bucket, weight := range other.weights {
+		h.weights[bucket] += weight * factor
+	}
+	h.totalWeight += other.totalWeight * factor
+}
+
+// Percentile returns an approximation of the given percentile (between 0 and 1) of the samples.
+// The end of the bucket containing the percentile is returned, hence the percentile is over-estimated by at most
+// the size of that bucket. Returns 0 for an empty histogram.
+func (h *DecayingHistogram) Percentile(percentile float64) float64 {
+	if h.IsEmpty() {
+		return 0
+	}
+
+	threshold := percentile * h.totalWeight
+	var partialSum float64
+	bucket := 0
+	for ; bucket < h.numBuckets-1; bucket++ {
+		partialSum += h.weights[bucket]
+		if partialSum >= threshold {
+			break
+		}
+	}
+
+	if bucket == h.numBuckets-1 {
+		// the last bucket has no upper bound
+		return h.options.bucketStart(bucket)
+	}
+	return h.options.bucketStart(bucket + 1)
+}
+
+// IsEmpty returns true if the histogram does not contain any samples
+func (h *DecayingHistogram) IsEmpty() bool {
+	return h.totalWeight < epsilon
+}
+
+// decayExponent returns the exponent of the decay factor for a sample observed at time t
+func (h *DecayingHistogram) decayExponent(t time.Time) float64 {
+	return float64(t.Sub(h.referenceTimestamp)) / float64(h.halfLife)
+}
+
+// shiftReferenceTimestamp moves the reference timestamp to t and scales down the existing weights accordingly
+func (h *DecayingHistogram) shiftReferenceTimestamp(t time.Time) {
+	factor := math.Exp2(-h.decayExponent(t))
+	for bucket := range h.weights {
+		h.weights[bucket] *= factor
+	}
+	h.totalWeight *= factor
+	h.referenceTimestamp = t
+}
@@ -0,0 +1,13 @@
+package histogram_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestHistogram(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Histogram Suite")
+}
@@ -0,0 +1,121 @@
+package histogram_test
+
+import (
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/histogram"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Histogram", func() {
+	options := histogram.Options{
+		MaxValue:        1000,
+		FirstBucketSize: 1,
+		Ratio:           1.05,
+	}
+	start := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	Describe("#Options", func() {
+		It("should reject invalid options", func() {
+			Expect(options.Validate()).To(Succeed())
+			Expect(histogram.Options{MaxValue: 1000, FirstBucketSize: 0, Ratio: 1.05}.Validate()).ToNot(Succeed())
+			Expect(histogram.Options{MaxValue: 1000, FirstBucketSize: 1, Ratio: 1}.Validate()).ToNot(Succeed())
+		})
+	})
+
+	Describe("#DecayingHistogram", func() {
+		It("should return 0 for an empty histogram", func() {
+			h := histogram.NewDecayingHistogram(options, time.Hour)
+			Expect(h.IsEmpty()).To(BeTrue())
+			Expect(h.Percentile(0.95)).To(Equal(float64(0)))
+		})
+
+		It("should approximate the percentile from above", func() {
+			h := histogram.NewDecayingHistogram(options, time.Hour)
+			for i := 1; i <= 100; i++ {
+				h.AddSample(float64(i), 1, start)
+			}
+
+			Expect(h.Percentile(0.95)).To(BeNumerically(">=", 95))
+			Expect(h.Percentile(0.95)).To(BeNumerically("<=", 95*options.Ratio+options.FirstBucketSize))
+			Expect(h.Percentile(1)).To(BeNumerically(">=", 100))
+		})
+
+		It("should add samples above the max value to the last bucket", func() {
+			h := histogram.NewDecayingHistogram(options, time.Hour)
+			h.AddSample(5000, 1, start)
+			Expect(h.Percentile(0.5)).To(BeNumerically("<=", options.MaxValue))
+			Expect(h.Percentile(0.5)).To(BeNumerically(">", options.MaxValue/options.Ratio))
+		})
+
+		It("should weigh recent samples higher", func() {
+			h := histogram.NewDecayingHistogram(options, time.Hour)
+			// the older sample weighs 2^10 times less
+			h.AddSample(10, 100, start)
+			h.AddSample(100, 1, start.Add(10*time.Hour))
+
+			Expect(h.Percentile(0.5)).To(BeNumerically("~", 100, 5))
+		})
+
+		It("should keep the relative weights when shifting the reference timestamp", func() {
+			h := histogram.NewDecayingHistogram(options, time.Minute)
+			h.AddSample(10, 1, start)
+			// exceeds the maximum decay exponent
+			h.AddSample(100, 1, start.Add(200*time.Minute))
+			h.AddSample(10, 1, start.Add(200*time.Minute))
+
+			Expect(h.Percentile(0.5)).To(BeNumerically("~", 10, 1.5))
+			Expect(h.Percentile(0.6)).To(BeNumerically("~", 100, 5))
+		})
+
+		It("should merge histograms with different reference timestamps", func() {
+			older := histogram.NewDecayingHistogram(options, time.Hour)
+			older.AddSample(10, 1, start)
+
+			newer := histogram.NewDecayingHistogram(options, time.Hour)
+			newer.AddSample(100, 1, start.Add(time.Hour))
+
+			merged := histogram.NewDecayingHistogram(options, time.Hour)
+			merged.Merge(older)
+			merged.Merge(newer)
+
+			// the newer sample weighs twice as much
+			Expect(merged.Percentile(0.3)).To(BeNumerically("~", 10, 1.5))
+			Expect(merged.Percentile(0.4)).To(BeNumerically("~", 100, 5))
+		})
+	})
+
+	Describe("#WindowedHistogram", func() {
+		It("should drop samples that left the window", func() {
+			h := histogram.NewWindowedHistogram(options, 24*time.Hour, 24*time.Hour)
+			h.AddSample(500, start)
+			h.AddSample(10, start.Add(time.Hour))
+
+			Expect(h.Percentile(0.95, start.Add(2*time.Hour))).To(BeNumerically("~", 500, 25))
+			Expect(h.Percentile(0.95, start.Add(25*time.Hour))).To(BeNumerically("~", 10, 1.5))
+			Expect(h.Percentile(0.95, start.Add(48*time.Hour))).To(Equal(float64(0)))
+		})
+	})
+
+	Describe("#Smoother", func() {
+		It("should return the percentile of the samples within the window", func() {
+			s := histogram.NewSmoother(options, time.Hour, time.Hour, 0.95, true)
+			Expect(s.Enabled()).To(BeTrue())
+
+			var smoothed float64
+			for i := 0; i < 100; i++ {
+				smoothed = s.Smooth(10, start.Add(time.Duration(i)*time.Second))
+			}
+			// a single spike does not drive the recommendation
+			smoothed = s.Smooth(800, start.Add(100*time.Second))
+			Expect(smoothed).To(BeNumerically("~", 10, 1.5))
+		})
+
+		It("should not smooth if nil", func() {
+			var s *histogram.Smoother
+			Expect(s.Enabled()).To(BeFalse())
+			Expect(s.Smooth(42, start)).To(Equal(float64(42)))
+		})
+	})
+})
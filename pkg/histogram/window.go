@@ -0,0 +1,113 @@
+package histogram
+
+import (
+	"time"
+)
+
+// numWindowSlices is the number of slices a window is split into.
+// Samples are discarded slice by slice once a slice has left the window.
+const numWindowSlices = 24
+
+// slice holds the samples observed during one slice of a window
+type slice struct {
+	start     time.Time
+	histogram *DecayingHistogram
+}
+
+// WindowedHistogram is a decaying histogram that only considers samples observed within a rolling window.
+// The window is split into slices, each with its own decaying histogram, so that old samples can be dropped.
+// Not safe for concurrent use.
+type WindowedHistogram struct {
+	options       Options
+	halfLife      time.Duration
+	window        time.Duration
+	sliceDuration time.Duration
+	slices        []slice
+}
+
+// NewWindowedHistogram returns a new empty histogram over the given window
+func NewWindowedHistogram(options Options, window, halfLife time.Duration) *WindowedHistogram {
+	sliceDuration := window / numWindowSlices
+	if sliceDuration <= 0 {
+		sliceDuration = window
+	}
+
+	return &WindowedHistogram{
+		options:       options,
+		halfLife:      halfLife,
+		window:        window,
+		sliceDuration: sliceDuration,
+	}
+}
+
+// AddSample adds a sample observed at time t
+func (w *WindowedHistogram) AddSample(value float64, t time.Time) {
+	w.prune(t)
+
+	if len(w.slices) == 0 || !t.Before(w.slices[len(w.slices)-1].start.Add(w.sliceDuration)) {
+		w.slices = append(w.slices, slice{
+			start:     t,
+			histogram: NewDecayingHistogram(w.options, w.halfLife),
+		})
+	}
+
+	w.slices[len(w.slices)-1].histogram.AddSample(value, 1, t)
+}
+
+// Percentile returns an approximation of the given percentile (between 0 and 1) of the samples observed within the window ending at now.
+// Returns 0 if there are no samples within the window.
+func (w *WindowedHistogram) Percentile(percentile float64, now time.Time) float64 {
+	w.prune(now)
+
+	merged := NewDecayingHistogram(w.options, w.halfLife)
+	for _, s := range w.slices {
+		merged.Merge(s.histogram)
+	}
+	return merged.Percentile(percentile)
+}
+
+// prune drops all slices that ended before the window ending at now
+func (w *WindowedHistogram) prune(now time.Time) {
+	windowStart := now.Add(-w.window)
+
+	i := 0
+	for ; i < len(w.slices); i++ {
+		if w.slices[i].start.Add(w.sliceDuration).After(windowStart) {
+			break
+		}
+	}
+	w.slices = w.slices[i:]
+}
+
+// Smoother recommends a percentile of the samples observed within a rolling window instead of the latest sample.
+// A nil Smoother does not smooth.
+type Smoother struct {
+	histogram  *WindowedHistogram
+	percentile float64
+	enabled    bool
+}
+
+// NewSmoother returns a new Smoother recommending the given percentile (between 0 and 1) over the window.
+// If enabled is false, the smoothed value is still calculated (e.g. for metrics), but should not be used for the recommendation.
+func NewSmoother(options Options, window, halfLife time.Duration, percentile float64, enabled bool) *Smoother {
+	return &Smoother{
+		histogram:  NewWindowedHistogram(options, window, halfLife),
+		percentile: percentile,
+		enabled:    enabled,
+	}
+}
+
+// Smooth adds the sample observed at time t and returns the percentile of all samples within the window
+func (s *Smoother) Smooth(sample float64, t time.Time) float64 {
+	if s == nil {
+		return sample
+	}
+
+	s.histogram.AddSample(sample, t)
+	return s.histogram.Percentile(s.percentile, t)
+}
+
+// Enabled returns true if the smoothed value should be used for the recommendation instead of the latest sample
+func (s *Smoother) Enabled() bool {
+	return s != nil && s.enabled
+}
@@ -0,0 +1,153 @@
+package kubelet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
+)
+
+const (
+	// cgroupDriverSystemd is the kubelet's systemd cgroup driver
+	cgroupDriverSystemd = "systemd"
+	// cgroupDriverCgroupfs is the kubelet's cgroupfs cgroup driver
+	cgroupDriverCgroupfs = "cgroupfs"
+	// systemdSliceSuffix is the suffix of systemd slice units
+	systemdSliceSuffix = ".slice"
+	// podCgroupPrefix is the prefix of the pod cgroups created by the kubelet (pod<uid>)
+	podCgroupPrefix = "pod"
+
+	// QoSGuaranteed is the guaranteed QoS class. The pods are placed directly below the kubepods cgroup.
+	QoSGuaranteed = "guaranteed"
+	// QoSBurstable is the burstable QoS class
+	QoSBurstable = "burstable"
+	// QoSBestEffort is the besteffort QoS class
+	QoSBestEffort = "besteffort"
+)
+
+// QoSClasses are the QoS classes of pods
+var QoSClasses = []string{QoSGuaranteed, QoSBurstable, QoSBestEffort}
+
+// KubepodsCgroupName returns the name of the kubepods cgroup relative to the cgroup hierarchy root
+// the kubelet creates for the given cgroup driver and cgroup root.
+// Examples:
+//   - cgroupfs, "/" -> kubepods
+//   - cgroupfs, "/custom" -> custom/kubepods
+//   - systemd, "/" -> kubepods.slice
+//   - systemd, "/custom.slice" -> custom.slice/custom-kubepods.slice
+func KubepodsCgroupName(cgroupDriver, cgroupRoot string) (string, error) {
+	switch cgroupDriver {
+	case cgroupDriverCgroupfs:
+		return path.Join(strings.Trim(cgroupRoot, "/"), types.DefaultkubepodsCgroupName), nil
+	case cgroupDriverSystemd:
+		// the systemd cgroup driver expands each component of the cgroup name to a nested slice
+		// where the name of each slice is prefixed with the names of its parents (see systemd.slice(5))
+		var components []string
+		if root := path.Base(strings.Trim(cgroupRoot, "/")); root != "." && root != "" {
+			components = strings.Split(strings.TrimSuffix(root, systemdSliceSuffix), "-")
+		}
+		components = append(components, types.DefaultkubepodsCgroupName)
+
+		slices := make([]string, 0, len(components))
+		for i := range components {
+			slices = append(slices, strings.Join(components[:i+1], "-")+systemdSliceSuffix)
+		}
+		return path.Join(slices...), nil
+	default:
+		return "", fmt.Errorf("unknown cgroup driver %q", cgroupDriver)
+	}
+}
+
+// DiscoverKubepodsCgroupName discovers the name of the kubepods cgroup relative to the cgroup hierarchy root.
+// The cgroupsHierarchy is the directory containing the kubepods cgroup (for cgroupsv1, the hierarchy of a particular controller).
+// If a kubelet configuration is given, the kubepods cgroup is derived from the configured cgroupDriver and cgroupRoot.
+// Otherwise, or if the derived cgroup does not exist, the cgroup hierarchy is probed for the kubepods cgroup of the
+// systemd and the cgroupfs cgroup driver.
+func DiscoverKubepodsCgroupName(cgroupsHierarchy string, config *Configuration) (string, error) {
+	if config != nil && len(config.CgroupDriver) > 0 {
+		name, err := KubepodsCgroupName(config.CgroupDriver, config.CgroupRoot)
+		if err != nil {
+			return "", err
+		}
+
+		if exists(filepath.Join(cgroupsHierarchy, name)) {
+			return name, nil
+		}
+	}
+
+	for _, name := range []string{types.SystemdKubepodsCgroupName, types.DefaultkubepodsCgroupName} {
+		if exists(filepath.Join(cgroupsHierarchy, name)) {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to find the kubepods cgroup in %q", cgroupsHierarchy)
+}
+
+func exists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// QoSCgroupName returns the name of the cgroup the kubelet creates for the burstable or besteffort QoS class below the kubepods cgroup.
+// Examples:
+//   - kubepods, burstable -> kubepods/burstable
+//   - kubepods.slice, burstable -> kubepods.slice/kubepods-burstable.slice
+func QoSCgroupName(kubepodsCgroupName, qosClass string) string {
+	base := path.Base(kubepodsCgroupName)
+	if strings.HasSuffix(base, systemdSliceSuffix) {
+		return path.Join(kubepodsCgroupName, strings.TrimSuffix(base, systemdSliceSuffix)+"-"+qosClass+systemdSliceSuffix)
+	}
+	return path.Join(kubepodsCgroupName, qosClass)
+}
+
+// GuaranteedPodCgroupNames returns the names of the pod cgroups directly below the kubepods cgroup (the pods of the guaranteed QoS class)
+// relative to the cgroup hierarchy root.
+// The cgroupsHierarchy is the directory containing the kubepods cgroup (for cgroupsv1, the hierarchy of a particular controller).
+func GuaranteedPodCgroupNames(cgroupsHierarchy, kubepodsCgroupName string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(cgroupsHierarchy, kubepodsCgroupName))
+	if err != nil {
+		return nil, err
+	}
+
+	// cgroupfs: pod<uid>, systemd: kubepods-pod<uid>.slice
+	prefix := podCgroupPrefix
+	if base := path.Base(kubepodsCgroupName); strings.HasSuffix(base, systemdSliceSuffix) {
+		prefix = strings.TrimSuffix(base, systemdSliceSuffix) + "-" + podCgroupPrefix
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			names = append(names, path.Join(kubepodsCgroupName, entry.Name()))
+		}
+	}
+	return names, nil
+}
+
+// KubepodsSiblingCgroupNames returns the names of the sibling cgroups of the kubepods cgroup (the cgroups competing with kubepods
+// for resources) relative to the cgroup hierarchy root.
+// For a top-level kubepods cgroup, these are the other top-level cgroups (e.g. system.slice, user.slice, init.scope, machine.slice).
+// For a nested kubepods cgroup (e.g. custom.slice/custom-kubepods.slice), these are the other children of its parent (e.g. custom.slice/custom-other.slice).
+// The cgroupsHierarchy is the root of the hierarchy (for cgroupsv1, the hierarchy of a particular controller).
+func KubepodsSiblingCgroupNames(cgroupsHierarchy, kubepodsCgroupName string) ([]string, error) {
+	kubepodsCgroupName = strings.Trim(kubepodsCgroupName, "/")
+	parent := path.Dir(kubepodsCgroupName)
+
+	entries, err := ioutil.ReadDir(filepath.Join(cgroupsHierarchy, parent))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != path.Base(kubepodsCgroupName) {
+			names = append(names, path.Join(parent, entry.Name()))
+		}
+	}
+	return names, nil
+}
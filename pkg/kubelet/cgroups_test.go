@@ -0,0 +1,138 @@
+package kubelet_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KubepodsCgroupName", func() {
+	expectKubepodsCgroupName := func(driver, root, expected string) {
+		name, err := kubelet.KubepodsCgroupName(driver, root)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal(expected))
+	}
+
+	It("should return the kubepods cgroup for the cgroupfs driver", func() {
+		expectKubepodsCgroupName("cgroupfs", "", "kubepods")
+		expectKubepodsCgroupName("cgroupfs", "/", "kubepods")
+		expectKubepodsCgroupName("cgroupfs", "/custom", "custom/kubepods")
+	})
+
+	It("should return the kubepods cgroup for the systemd driver", func() {
+		expectKubepodsCgroupName("systemd", "", "kubepods.slice")
+		expectKubepodsCgroupName("systemd", "/", "kubepods.slice")
+		expectKubepodsCgroupName("systemd", "/custom.slice", "custom.slice/custom-kubepods.slice")
+		expectKubepodsCgroupName("systemd", "/a.slice/a-b.slice", "a.slice/a-b.slice/a-b-kubepods.slice")
+	})
+
+	It("should return an error for an unknown driver", func() {
+		_, err := kubelet.KubepodsCgroupName("unknown", "/")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("DiscoverKubepodsCgroupName", func() {
+	var hierarchy string
+
+	BeforeEach(func() {
+		var err error
+		hierarchy, err = ioutil.TempDir("", "cgroups")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(hierarchy)).To(Succeed())
+	})
+
+	It("should use the kubelet configuration", func() {
+		Expect(os.MkdirAll(filepath.Join(hierarchy, "custom", "kubepods"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(hierarchy, "kubepods.slice"), 0755)).To(Succeed())
+
+		name, err := kubelet.DiscoverKubepodsCgroupName(hierarchy, &kubelet.Configuration{CgroupDriver: "cgroupfs", CgroupRoot: "/custom"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal("custom/kubepods"))
+	})
+
+	It("should probe for the kubepods cgroup without kubelet configuration", func() {
+		Expect(os.MkdirAll(filepath.Join(hierarchy, "kubepods.slice"), 0755)).To(Succeed())
+
+		name, err := kubelet.DiscoverKubepodsCgroupName(hierarchy, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal("kubepods.slice"))
+	})
+
+	It("should return an error if there is no kubepods cgroup", func() {
+		_, err := kubelet.DiscoverKubepodsCgroupName(hierarchy, nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("QoS cgroups", func() {
+	It("should return the QoS cgroups", func() {
+		Expect(kubelet.QoSCgroupName("kubepods", kubelet.QoSBurstable)).To(Equal("kubepods/burstable"))
+		Expect(kubelet.QoSCgroupName("custom/kubepods", kubelet.QoSBestEffort)).To(Equal("custom/kubepods/besteffort"))
+		Expect(kubelet.QoSCgroupName("kubepods.slice", kubelet.QoSBurstable)).To(Equal("kubepods.slice/kubepods-burstable.slice"))
+		Expect(kubelet.QoSCgroupName("custom.slice/custom-kubepods.slice", kubelet.QoSBestEffort)).To(Equal("custom.slice/custom-kubepods.slice/custom-kubepods-besteffort.slice"))
+	})
+
+	It("should list the guaranteed pod cgroups", func() {
+		hierarchy, err := ioutil.TempDir("", "hierarchy")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(hierarchy)
+
+		for _, dir := range []string{"kubepods/burstable/pod1", "kubepods/besteffort", "kubepods/pod2", "kubepods/pod3",
+			"kubepods.slice/kubepods-burstable.slice", "kubepods.slice/kubepods-pod4.slice"} {
+			Expect(os.MkdirAll(filepath.Join(hierarchy, dir), 0755)).To(Succeed())
+		}
+		Expect(ioutil.WriteFile(filepath.Join(hierarchy, "kubepods", "cpu.shares"), []byte("1024"), 0644)).To(Succeed())
+
+		names, err := kubelet.GuaranteedPodCgroupNames(hierarchy, "kubepods")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(ConsistOf("kubepods/pod2", "kubepods/pod3"))
+
+		names, err = kubelet.GuaranteedPodCgroupNames(hierarchy, "kubepods.slice")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(ConsistOf("kubepods.slice/kubepods-pod4.slice"))
+	})
+})
+
+var _ = Describe("Kubepods siblings", func() {
+	var hierarchy string
+
+	BeforeEach(func() {
+		var err error
+		hierarchy, err = ioutil.TempDir("", "hierarchy")
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, dir := range []string{"kubepods", "custom.slice/custom-kubepods.slice", "custom.slice/custom-other.slice", "system.slice", "user.slice", "init.scope"} {
+			Expect(os.MkdirAll(filepath.Join(hierarchy, dir), 0755)).To(Succeed())
+		}
+		Expect(ioutil.WriteFile(filepath.Join(hierarchy, "cgroup.procs"), []byte("1"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(hierarchy, "custom.slice", "cgroup.procs"), []byte(""), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(hierarchy)).To(Succeed())
+	})
+
+	It("should list the top-level cgroups except for a top-level kubepods cgroup", func() {
+		names, err := kubelet.KubepodsSiblingCgroupNames(hierarchy, "kubepods")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(Equal([]string{"custom.slice", "init.scope", "system.slice", "user.slice"}))
+	})
+
+	It("should list the children of the parent of a nested kubepods cgroup", func() {
+		names, err := kubelet.KubepodsSiblingCgroupNames(hierarchy, "custom.slice/custom-kubepods.slice")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(Equal([]string{"custom.slice/custom-other.slice"}))
+
+		names, err = kubelet.KubepodsSiblingCgroupNames(hierarchy, "/custom.slice/custom-kubepods.slice/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(Equal([]string{"custom.slice/custom-other.slice"}))
+	})
+})
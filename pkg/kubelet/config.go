@@ -0,0 +1,119 @@
+package kubelet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// configurationKind is the kind of the kubelet configuration file
+	configurationKind = "KubeletConfiguration"
+	// configurationGroup is the API group of the kubelet configuration file
+	configurationGroup = "kubelet.config.k8s.io"
+)
+
+// Configuration contains the subset of the kubelet configuration file (KubeletConfiguration, kubelet.config.k8s.io/v1beta1)
+// that is relevant for the recommender.
+// The field names and JSON tags are the ones of the KubeletConfiguration type. The type itself is not used as
+// k8s.io/kubelet is not vendored.
+type Configuration struct {
+	metav1.TypeMeta `json:",inline"`
+	// CgroupDriver is the driver the kubelet uses to manipulate cgroups on the host (cgroupfs or systemd)
+	CgroupDriver string `json:"cgroupDriver,omitempty"`
+	// CgroupRoot is the root cgroup to use for pods
+	CgroupRoot string `json:"cgroupRoot,omitempty"`
+	// KubeReserved is a set of ResourceName=ResourceQuantity pairs that describe resources reserved for
+	// kubernetes system components (kubelet, container runtime)
+	KubeReserved map[string]string `json:"kubeReserved,omitempty"`
+	// SystemReserved is a set of ResourceName=ResourceQuantity pairs that describe resources reserved for
+	// non-kubernetes components
+	SystemReserved map[string]string `json:"systemReserved,omitempty"`
+	// EvictionHard is a map of signal names to quantities (absolute or percentage) that defines hard eviction thresholds
+	EvictionHard map[string]string `json:"evictionHard,omitempty"`
+}
+
+// LoadConfiguration reads and parses the kubelet configuration file at the given path.
+// Fails if the file declares a kind or API group other than KubeletConfiguration (kubelet.config.k8s.io).
+func LoadConfiguration(path string) (*Configuration, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubelet configuration file %q: %w", path, err)
+	}
+
+	config := &Configuration{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("failed to parse kubelet configuration file %q: %w", path, err)
+	}
+
+	if len(config.Kind) > 0 && config.Kind != configurationKind {
+		return nil, fmt.Errorf("kubelet configuration file %q is of kind %q instead of %q", path, config.Kind, configurationKind)
+	}
+
+	if len(config.APIVersion) > 0 && config.GroupVersionKind().Group != configurationGroup {
+		return nil, fmt.Errorf("kubelet configuration file %q has the API version %q instead of %s/<version>", path, config.APIVersion, configurationGroup)
+	}
+	return config, nil
+}
+
+// ConfigurationCache caches the kubelet configuration file.
+// The file is only read again if its modification time or size changed.
+// Safe for concurrent use.
+type ConfigurationCache struct {
+	mu   sync.Mutex
+	path string
+
+	modTime time.Time
+	size    int64
+	config  *Configuration
+	// failed is true if the last load failed. The failure has already been logged.
+	failed bool
+}
+
+// NewConfigurationCache creates a new ConfigurationCache for the kubelet configuration file at the given path
+func NewConfigurationCache(path string) *ConfigurationCache {
+	return &ConfigurationCache{path: path}
+}
+
+// Load returns the kubelet configuration or nil if it cannot be loaded (e.g the file does not exist).
+// A failure is only logged as a warning once until the configuration can be loaded again.
+func (c *ConfigurationCache) Load(log *logrus.Logger) *Configuration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.path)
+	if err == nil && c.config != nil && info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return c.config
+	}
+
+	var config *Configuration
+	if err == nil {
+		config, err = LoadConfiguration(c.path)
+	}
+
+	if err != nil {
+		if !c.failed {
+			log.Warnf("Failed to load the kubelet configuration, assuming kubelet defaults: %v", err)
+		} else {
+			log.Debugf("Failed to load the kubelet configuration, assuming kubelet defaults: %v", err)
+		}
+		c.failed = true
+		c.config = nil
+		return nil
+	}
+
+	if c.failed {
+		log.Infof("Loaded the kubelet configuration %s", c.path)
+	}
+	c.failed = false
+	c.config = config
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+	return config
+}
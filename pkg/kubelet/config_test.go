@@ -0,0 +1,81 @@
+package kubelet_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("LoadConfiguration", func() {
+	var (
+		dir        string
+		configPath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "kubelet")
+		Expect(err).ToNot(HaveOccurred())
+		configPath = filepath.Join(dir, "kubelet")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should reject a file of another kind", func() {
+		Expect(ioutil.WriteFile(configPath, []byte("apiVersion: v1\nkind: ConfigMap\n"), 0644)).To(Succeed())
+		_, err := kubelet.LoadConfiguration(configPath)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("ConfigurationCache", func() {
+		var (
+			output *bytes.Buffer
+			log    *logrus.Logger
+			cache  *kubelet.ConfigurationCache
+		)
+
+		BeforeEach(func() {
+			output = &bytes.Buffer{}
+			log = logrus.New()
+			log.SetOutput(output)
+			cache = kubelet.NewConfigurationCache(configPath)
+		})
+
+		It("should warn only once while the configuration file does not exist", func() {
+			Expect(cache.Load(log)).To(BeNil())
+			Expect(cache.Load(log)).To(BeNil())
+			Expect(strings.Count(output.String(), "level=warning")).To(Equal(1))
+
+			Expect(ioutil.WriteFile(configPath, []byte(kubeletConfiguration), 0644)).To(Succeed())
+			Expect(cache.Load(log)).ToNot(BeNil())
+
+			Expect(os.Remove(configPath)).To(Succeed())
+			Expect(cache.Load(log)).To(BeNil())
+			Expect(strings.Count(output.String(), "level=warning")).To(Equal(2))
+		})
+
+		It("should only read the configuration file again if it changed", func() {
+			Expect(ioutil.WriteFile(configPath, []byte(kubeletConfiguration), 0644)).To(Succeed())
+			modTime := time.Now().Add(-time.Minute)
+			Expect(os.Chtimes(configPath, modTime, modTime)).To(Succeed())
+
+			config := cache.Load(log)
+			Expect(config).ToNot(BeNil())
+			Expect(config.KubeReserved["memory"]).To(Equal("1Gi"))
+			Expect(cache.Load(log)).To(BeIdenticalTo(config))
+
+			Expect(ioutil.WriteFile(configPath, []byte(strings.Replace(kubeletConfiguration, "memory: 1Gi", "memory: 2Gi", 1)), 0644)).To(Succeed())
+			Expect(cache.Load(log).KubeReserved["memory"]).To(Equal("2Gi"))
+		})
+	})
+})
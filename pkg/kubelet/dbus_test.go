@@ -0,0 +1,224 @@
+package kubelet_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+
+	godbus "github.com/godbus/dbus/v5"
+)
+
+const (
+	systemdPath      = godbus.ObjectPath("/org/freedesktop/systemd1")
+	systemdInterface = "org.freedesktop.systemd1.Manager"
+)
+
+// fakeSystemd is a minimal D-Bus bus serving the systemd manager API on a unix socket.
+// It implements the authentication handshake, Hello, AddMatch and RestartUnit.
+// Every RestartUnit job finishes immediately with the configured result, announced via the JobRemoved signal.
+type fakeSystemd struct {
+	listener net.Listener
+	// result is the result of the restart jobs
+	result string
+
+	mu        sync.Mutex
+	conns     []net.Conn
+	restarted []string
+	jobs      uint32
+}
+
+// newFakeSystemd starts a fake systemd D-Bus service listening on a unix socket in the given directory
+func newFakeSystemd(dir, result string) (*fakeSystemd, error) {
+	listener, err := net.Listen("unix", filepath.Join(dir, "system_bus_socket"))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fakeSystemd{listener: listener, result: result}
+	go f.serve()
+	return f, nil
+}
+
+// address is the D-Bus address of the fake service
+func (f *fakeSystemd) address() string {
+	return "unix:path=" + f.listener.Addr().String()
+}
+
+// restarts returns the restarted units with the job mode (<unit>:<mode>)
+func (f *fakeSystemd) restarts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.restarted...)
+}
+
+// openConnections returns the number of connections that have not been closed by the client
+func (f *fakeSystemd) openConnections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns)
+}
+
+func (f *fakeSystemd) close() {
+	f.listener.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeSystemd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSystemd) handle(conn net.Conn) {
+	defer f.remove(conn)
+	defer conn.Close()
+
+	in := bufio.NewReader(conn)
+	if err := authenticate(conn, in); err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	name := fmt.Sprintf(":1.%d", len(f.conns))
+	f.mu.Unlock()
+
+	for {
+		msg, err := godbus.DecodeMessage(in)
+		if err != nil {
+			return
+		}
+		if msg.Type != godbus.TypeMethodCall {
+			continue
+		}
+
+		member, _ := msg.Headers[godbus.FieldMember].Value().(string)
+		switch member {
+		case "Hello":
+			f.send(conn, reply(msg, name))
+		case "AddMatch":
+			f.send(conn, reply(msg))
+		case "RestartUnit":
+			f.restartUnit(conn, msg)
+		default:
+			f.send(conn, &godbus.Message{
+				Type: godbus.TypeError,
+				Headers: map[godbus.HeaderField]godbus.Variant{
+					godbus.FieldReplySerial: godbus.MakeVariant(msg.Serial()),
+					godbus.FieldErrorName:   godbus.MakeVariant("org.freedesktop.DBus.Error.UnknownMethod"),
+				},
+			})
+		}
+	}
+}
+
+// restartUnit replies with the job and broadcasts its removal to all connections (go-systemd listens on a separate connection)
+func (f *fakeSystemd) restartUnit(conn net.Conn, msg *godbus.Message) {
+	var unit, mode string
+	if err := godbus.Store(msg.Body, &unit, &mode); err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	f.restarted = append(f.restarted, unit+":"+mode)
+	f.jobs++
+	id := f.jobs
+	conns := append([]net.Conn{}, f.conns...)
+	f.mu.Unlock()
+
+	job := godbus.ObjectPath(fmt.Sprintf("%s/job/%d", systemdPath, id))
+	f.send(conn, reply(msg, job))
+
+	body := []interface{}{id, job, unit, f.result}
+	jobRemoved := &godbus.Message{
+		Type: godbus.TypeSignal,
+		Headers: map[godbus.HeaderField]godbus.Variant{
+			godbus.FieldPath:      godbus.MakeVariant(systemdPath),
+			godbus.FieldInterface: godbus.MakeVariant(systemdInterface),
+			godbus.FieldMember:    godbus.MakeVariant("JobRemoved"),
+			godbus.FieldSignature: godbus.MakeVariant(godbus.SignatureOf(body...)),
+		},
+		Body: body,
+	}
+	for _, c := range conns {
+		f.send(c, jobRemoved)
+	}
+}
+
+func (f *fakeSystemd) send(conn net.Conn, msg *godbus.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msg.EncodeTo(conn, binary.LittleEndian)
+}
+
+func (f *fakeSystemd) remove(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, c := range f.conns {
+		if c == conn {
+			f.conns = append(f.conns[:i], f.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// reply creates the method reply with the given body
+func reply(call *godbus.Message, body ...interface{}) *godbus.Message {
+	msg := &godbus.Message{
+		Type: godbus.TypeMethodReply,
+		Headers: map[godbus.HeaderField]godbus.Variant{
+			godbus.FieldReplySerial: godbus.MakeVariant(call.Serial()),
+		},
+		Body: body,
+	}
+	if len(body) > 0 {
+		msg.Headers[godbus.FieldSignature] = godbus.MakeVariant(godbus.SignatureOf(body...))
+	}
+	return msg
+}
+
+// authenticate performs the server side of the D-Bus authentication handshake accepting the EXTERNAL mechanism
+func authenticate(conn net.Conn, in *bufio.Reader) error {
+	// the client starts with a null byte
+	if _, err := in.ReadByte(); err != nil {
+		return err
+	}
+
+	for {
+		line, err := in.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		var response string
+		switch fields := bytes.Fields(line); {
+		case len(fields) == 0:
+			response = "ERROR"
+		case string(fields[0]) == "BEGIN":
+			return nil
+		case string(fields[0]) == "AUTH" && len(fields) > 1 && string(fields[1]) == "EXTERNAL":
+			response = "OK 0123456789abcdef0123456789abcdef"
+		case string(fields[0]) == "AUTH":
+			response = "REJECTED EXTERNAL"
+		default:
+			// e.g NEGOTIATE_UNIX_FD
+			response = "ERROR"
+		}
+
+		if _, err := conn.Write([]byte(response + "\r\n")); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package kubelet
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+)
+
+// SetNow sets the clock of the ConfigUpdater
+func SetNow(u *ConfigUpdater, now func() time.Time) {
+	u.now = now
+}
+
+// NewSystemdRestarterForAddress creates a SystemdRestarter connecting to the systemd D-Bus API on the bus with the
+// given address (e.g unix:path=/run/dbus/system_bus_socket)
+func NewSystemdRestarterForAddress(address string) *SystemdRestarter {
+	return NewSystemdRestarterWithConnection(func(ctx context.Context) (SystemdConnection, error) {
+		return dbus.NewConnection(func() (*godbus.Conn, error) {
+			return dialBus(ctx, address)
+		})
+	})
+}
+
+// dialBus connects and authenticates to the bus with the given address.
+// Like the go-systemd connections, only the EXTERNAL authentication with the uid is used.
+func dialBus(ctx context.Context, address string) (*godbus.Conn, error) {
+	conn, err := godbus.Dial(address, godbus.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Auth([]godbus.Auth{godbus.AuthExternal(strconv.Itoa(os.Getuid()))}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
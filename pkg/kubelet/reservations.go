@@ -0,0 +1,204 @@
+package kubelet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// ResourceMemory is the name of the memory resource in the kubelet reservations
+	ResourceMemory = "memory"
+	// ResourceCPU is the name of the CPU resource in the kubelet reservations
+	ResourceCPU = "cpu"
+	// ResourceEphemeralStorage is the name of the ephemeral storage resource in the kubelet reservations
+	ResourceEphemeralStorage = "ephemeral-storage"
+	// ResourcePID is the name of the process ID resource in the kubelet reservations
+	ResourcePID = "pid"
+
+	// procPIDMax is the file containing the maximum number of process IDs
+	procPIDMax = "/proc/sys/kernel/pid_max"
+
+	reservationKubeReserved   = "kube-reserved"
+	reservationSystemReserved = "system-reserved"
+	reservationEvictionHard   = "eviction-hard"
+)
+
+var (
+	// evictionSignals maps a resource to the eviction signal of the kubelet's hard eviction thresholds
+	// there is no eviction signal for CPU
+	evictionSignals = map[string]string{
+		ResourceMemory:           "memory.available",
+		ResourceEphemeralStorage: "nodefs.available",
+		ResourcePID:              "pid.available",
+	}
+
+	// defaultEvictionHard are the hard eviction thresholds the kubelet uses if evictionHard is not configured
+	defaultEvictionHard = map[string]string{
+		"memory.available":  "100Mi",
+		"nodefs.available":  "10%",
+		"nodefs.inodesFree": "5%",
+		"imagefs.available": "15%",
+	}
+
+	metricConfiguredReservation = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubelet_configured_reservation",
+		Help: "The kube-reserved, system-reserved and hard eviction threshold as configured in the kubelet configuration file (CPU in millicores, memory and ephemeral-storage in bytes)",
+	}, []string{"reservation", "resource"})
+
+	metricTargetReservation = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubelet_target_reservation",
+		Help: "The recommended kube-reserved, system-reserved and hard eviction threshold (CPU in millicores, memory and ephemeral-storage in bytes)",
+	}, []string{"reservation", "resource"})
+)
+
+// Reservations are the kubelet reservations for a single resource
+type Reservations struct {
+	// KubeReserved is the amount reserved for kubernetes system components (kubelet, container runtime)
+	KubeReserved resource.Quantity
+	// SystemReserved is the amount reserved for non-kubernetes components
+	SystemReserved resource.Quantity
+	// EvictionHard is the absolute hard eviction threshold
+	EvictionHard resource.Quantity
+}
+
+// Total returns the sum of kube-reserved and system-reserved (without the hard eviction threshold)
+func (r Reservations) Total() resource.Quantity {
+	total := r.KubeReserved.DeepCopy()
+	total.Add(r.SystemReserved)
+	return total
+}
+
+// String returns a human-readable representation of the reservations
+func (r Reservations) String() string {
+	return fmt.Sprintf("kube-reserved: %s | system-reserved: %s | eviction-hard: %s", r.KubeReserved.String(), r.SystemReserved.String(), r.EvictionHard.String())
+}
+
+// Reservations returns the configured reservations for the given resource.
+// The capacity of the resource is required to resolve hard eviction thresholds given in percent.
+// A nil configuration is treated like an empty configuration (kubelet defaults).
+func (c *Configuration) Reservations(resourceName string, capacity resource.Quantity) (Reservations, error) {
+	if c == nil {
+		c = &Configuration{}
+	}
+
+	var (
+		reservations Reservations
+		err          error
+	)
+
+	if reservations.KubeReserved, err = parseReservation(c.KubeReserved, resourceName); err != nil {
+		return Reservations{}, fmt.Errorf("invalid kubeReserved: %w", err)
+	}
+
+	if reservations.SystemReserved, err = parseReservation(c.SystemReserved, resourceName); err != nil {
+		return Reservations{}, fmt.Errorf("invalid systemReserved: %w", err)
+	}
+
+	signal, ok := evictionSignals[resourceName]
+	if !ok {
+		return reservations, nil
+	}
+
+	evictionHard := c.EvictionHard
+	if evictionHard == nil {
+		evictionHard = defaultEvictionHard
+	}
+
+	if threshold, ok := evictionHard[signal]; ok {
+		if reservations.EvictionHard, err = ParseThreshold(threshold, capacity); err != nil {
+			return Reservations{}, fmt.Errorf("invalid evictionHard %q: %w", signal, err)
+		}
+	}
+
+	return reservations, nil
+}
+
+// ParseThreshold parses an eviction threshold given either as an absolute quantity (e.g. 100Mi) or as a percentage
+// of the capacity (e.g. 10%)
+func ParseThreshold(threshold string, capacity resource.Quantity) (resource.Quantity, error) {
+	if strings.HasSuffix(threshold, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(threshold, "%"), 64)
+		if err != nil {
+			return resource.Quantity{}, err
+		}
+		if percentage < 0 || percentage > 100 {
+			return resource.Quantity{}, fmt.Errorf("percentage must be between 0 and 100, got %q", threshold)
+		}
+		return *resource.NewQuantity(int64(float64(capacity.Value())*percentage/100), capacity.Format), nil
+	}
+
+	return resource.ParseQuantity(threshold)
+}
+
+// SplitKeepingSystemReserved splits the recommended total reservation (kube-reserved + system-reserved)
+// into kube-reserved and system-reserved by keeping the currently configured system-reserved
+// and assigning the rest to kube-reserved.
+// If the total is lower than the current system-reserved, the total is assigned to system-reserved.
+// The hard eviction threshold is not changed.
+func SplitKeepingSystemReserved(total resource.Quantity, current Reservations) Reservations {
+	recommendation := Reservations{
+		SystemReserved: current.SystemReserved.DeepCopy(),
+		EvictionHard:   current.EvictionHard.DeepCopy(),
+	}
+
+	if total.Cmp(current.SystemReserved) <= 0 {
+		recommendation.SystemReserved = total.DeepCopy()
+		recommendation.KubeReserved = *resource.NewQuantity(0, total.Format)
+		return recommendation
+	}
+
+	recommendation.KubeReserved = total.DeepCopy()
+	recommendation.KubeReserved.Sub(current.SystemReserved)
+	return recommendation
+}
+
+// RecordReservations records the configured and recommended reservations of the given resource as prometheus metrics
+func RecordReservations(resourceName string, current, target Reservations) {
+	for _, r := range []struct {
+		reservation     string
+		current, target resource.Quantity
+	}{
+		{reservationKubeReserved, current.KubeReserved, target.KubeReserved},
+		{reservationSystemReserved, current.SystemReserved, target.SystemReserved},
+		{reservationEvictionHard, current.EvictionHard, target.EvictionHard},
+	} {
+		metricConfiguredReservation.WithLabelValues(r.reservation, resourceName).Set(metricValue(resourceName, r.current))
+		metricTargetReservation.WithLabelValues(r.reservation, resourceName).Set(metricValue(resourceName, r.target))
+	}
+}
+
+func metricValue(resourceName string, quantity resource.Quantity) float64 {
+	if resourceName == ResourceCPU {
+		return float64(quantity.MilliValue())
+	}
+	return float64(quantity.Value())
+}
+
+func parseReservation(reserved map[string]string, resourceName string) (resource.Quantity, error) {
+	value, ok := reserved[resourceName]
+	if !ok {
+		return resource.Quantity{}, nil
+	}
+	return resource.ParseQuantity(value)
+}
+
+// PIDCapacity returns the maximum number of process IDs on the node (/proc/sys/kernel/pid_max)
+// The kubelet uses the same value as the capacity for the pid resource.
+func PIDCapacity() (resource.Quantity, error) {
+	content, err := ioutil.ReadFile(procPIDMax)
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("failed to read %s: %w", procPIDMax, err)
+	}
+
+	pidMax, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("failed to parse %s: %w", procPIDMax, err)
+	}
+	return *resource.NewQuantity(pidMax, resource.DecimalSI), nil
+}
@@ -0,0 +1,89 @@
+package kubelet_test
+
+import (
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = Describe("Reservations", func() {
+	capacity := resource.MustParse("10Gi")
+
+	It("should return the configured reservations", func() {
+		config := &kubelet.Configuration{
+			KubeReserved:   map[string]string{"memory": "1Gi", "cpu": "80m"},
+			SystemReserved: map[string]string{"memory": "512Mi"},
+			EvictionHard:   map[string]string{"memory.available": "10%"},
+		}
+
+		reservations, err := config.Reservations(kubelet.ResourceMemory, capacity)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations.KubeReserved.Value()).To(Equal(int64(1024 * 1024 * 1024)))
+		Expect(reservations.SystemReserved.Value()).To(Equal(int64(512 * 1024 * 1024)))
+		Expect(reservations.EvictionHard.Value()).To(Equal(int64(1073741824)))
+
+		total := reservations.Total()
+		Expect(total.Value()).To(Equal(int64(1536 * 1024 * 1024)))
+
+		reservations, err = config.Reservations(kubelet.ResourceCPU, resource.MustParse("2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations.KubeReserved.MilliValue()).To(Equal(int64(80)))
+		Expect(reservations.SystemReserved.IsZero()).To(BeTrue())
+		Expect(reservations.EvictionHard.IsZero()).To(BeTrue())
+	})
+
+	It("should use the kubelet default eviction thresholds without configuration", func() {
+		var config *kubelet.Configuration
+
+		reservations, err := config.Reservations(kubelet.ResourceMemory, capacity)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations.KubeReserved.IsZero()).To(BeTrue())
+		Expect(reservations.EvictionHard.Value()).To(Equal(int64(100 * 1024 * 1024)))
+	})
+
+	It("should return an error for invalid quantities", func() {
+		config := &kubelet.Configuration{KubeReserved: map[string]string{"memory": "abc"}}
+
+		_, err := config.Reservations(kubelet.ResourceMemory, capacity)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("ParseThreshold", func() {
+	It("should parse absolute thresholds", func() {
+		threshold, err := kubelet.ParseThreshold("100Mi", resource.MustParse("10Gi"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(threshold.Value()).To(Equal(int64(100 * 1024 * 1024)))
+	})
+
+	It("should parse percentage thresholds", func() {
+		threshold, err := kubelet.ParseThreshold("5%", resource.MustParse("10Gi"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(threshold.Value()).To(Equal(int64(536870912)))
+	})
+
+	It("should reject invalid percentages", func() {
+		_, err := kubelet.ParseThreshold("150%", resource.MustParse("10Gi"))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("SplitKeepingSystemReserved", func() {
+	current := kubelet.Reservations{
+		KubeReserved:   resource.MustParse("100m"),
+		SystemReserved: resource.MustParse("50m"),
+	}
+
+	It("should keep system-reserved and assign the rest to kube-reserved", func() {
+		recommendation := kubelet.SplitKeepingSystemReserved(resource.MustParse("200m"), current)
+		Expect(recommendation.KubeReserved.MilliValue()).To(Equal(int64(150)))
+		Expect(recommendation.SystemReserved.MilliValue()).To(Equal(int64(50)))
+	})
+
+	It("should lower system-reserved if the total is lower", func() {
+		recommendation := kubelet.SplitKeepingSystemReserved(resource.MustParse("30m"), current)
+		Expect(recommendation.KubeReserved.MilliValue()).To(Equal(int64(0)))
+		Expect(recommendation.SystemReserved.MilliValue()).To(Equal(int64(30)))
+	})
+})
@@ -0,0 +1,65 @@
+package kubelet
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+const (
+	// DefaultKubeletUnit is the default name of the kubelet's systemd unit
+	DefaultKubeletUnit = "kubelet.service"
+	// restartModeReplace is the systemd job mode that replaces already queued jobs for the unit
+	restartModeReplace = "replace"
+	// jobResultDone is the systemd job result of a successfully executed job
+	jobResultDone = "done"
+)
+
+// SystemdConnection is the subset of the systemd D-Bus API used to restart units
+type SystemdConnection interface {
+	RestartUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+	Close()
+}
+
+// SystemdRestarter restarts systemd units via the systemd D-Bus API.
+// Requires access to the system bus socket (/run/dbus/system_bus_socket).
+type SystemdRestarter struct {
+	newConnection func(ctx context.Context) (SystemdConnection, error)
+}
+
+// NewSystemdRestarter creates a SystemdRestarter connecting to the systemd D-Bus API on the system bus
+func NewSystemdRestarter() *SystemdRestarter {
+	return NewSystemdRestarterWithConnection(func(ctx context.Context) (SystemdConnection, error) {
+		return dbus.NewSystemConnectionContext(ctx)
+	})
+}
+
+// NewSystemdRestarterWithConnection creates a SystemdRestarter using the given function to connect to the systemd D-Bus API
+func NewSystemdRestarterWithConnection(newConnection func(ctx context.Context) (SystemdConnection, error)) *SystemdRestarter {
+	return &SystemdRestarter{newConnection: newConnection}
+}
+
+// RestartUnit restarts the given systemd unit and waits until the restart job completed
+func (r *SystemdRestarter) RestartUnit(ctx context.Context, unit string) error {
+	conn, err := r.newConnection(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the systemd D-Bus API: %w", err)
+	}
+	defer conn.Close()
+
+	result := make(chan string, 1)
+	if _, err := conn.RestartUnitContext(ctx, unit, restartModeReplace, result); err != nil {
+		return fmt.Errorf("failed to restart unit %q: %w", unit, err)
+	}
+
+	select {
+	case r := <-result:
+		if r != jobResultDone {
+			return fmt.Errorf("failed to restart unit %q: job finished with result %q", unit, r)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to restart unit %q: %w", unit, ctx.Err())
+	}
+}
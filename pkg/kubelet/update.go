@@ -0,0 +1,313 @@
+package kubelet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// backupSuffix is the suffix of the backup of the original kubelet configuration file written before the first update
+	backupSuffix = ".bak"
+	// keyKubeReserved is the key of kube-reserved in the kubelet configuration file
+	keyKubeReserved = "kubeReserved"
+	// keySystemReserved is the key of system-reserved in the kubelet configuration file
+	keySystemReserved = "systemReserved"
+)
+
+var (
+	metricKubeletRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kubelet_config_update_restarts_total",
+		Help: "The number of kubelet restarts after updating the reservations in the kubelet configuration file",
+	})
+
+	metricKubeletConfigUpdatesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubelet_config_update_skipped_total",
+		Help: "The number of skipped kubelet configuration updates by reason",
+	}, []string{"reason"})
+)
+
+// UnitRestarter restarts a systemd unit
+type UnitRestarter interface {
+	RestartUnit(ctx context.Context, unit string) error
+}
+
+// ConfigUpdater rewrites kube-reserved and system-reserved in the kubelet configuration file
+// with the recommended reservations and restarts the kubelet to apply them.
+// To not restart the kubelet on every spike, the kubelet is restarted at most once per minimum restart interval
+// and only if the recommendation differs sufficiently from the configured reservations.
+type ConfigUpdater struct {
+	mu sync.Mutex
+
+	configPath         string
+	unit               string
+	restarter          UnitRestarter
+	minRestartInterval time.Duration
+	// minChange is the minimum change per resource for the reservations to be updated
+	minChange map[string]resource.Quantity
+	// targets are the latest recommended reservations per resource
+	targets map[string]Reservations
+	// lastRestart is the time of the last (successful or failed) restart attempt
+	lastRestart time.Time
+	// restartPending is true if the kubelet configuration has been updated, but the kubelet could not be restarted
+	restartPending bool
+	now            func() time.Time
+}
+
+// NewConfigUpdater creates a new ConfigUpdater.
+// minChange is the minimum change per resource (e.g memory: 100Mi) of kube-reserved or system-reserved that
+// leads to an update of the kubelet configuration. Only resources contained in minChange are updated.
+func NewConfigUpdater(configPath, unit string, restarter UnitRestarter, minRestartInterval time.Duration, minChange map[string]resource.Quantity) *ConfigUpdater {
+	return &ConfigUpdater{
+		configPath:         configPath,
+		unit:               unit,
+		restarter:          restarter,
+		minRestartInterval: minRestartInterval,
+		minChange:          minChange,
+		targets:            map[string]Reservations{},
+		now:                time.Now,
+	}
+}
+
+// SetTarget sets the recommended reservations for the given resource
+func (u *ConfigUpdater) SetTarget(resourceName string, target Reservations) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.targets[resourceName] = target
+}
+
+// Reconcile updates the kubelet configuration file with the recommended reservations and restarts the kubelet
+// if the recommendation differs sufficiently from the configured reservations and the kubelet has not been restarted
+// within the minimum restart interval. A failed restart is retried once the minimum restart interval has passed.
+// Returns true if the kubelet configuration has been updated and the kubelet restarted.
+func (u *ConfigUpdater) Reconcile(ctx context.Context, log *logrus.Logger) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.lastRestart.IsZero() && u.now().Sub(u.lastRestart) < u.minRestartInterval {
+		metricKubeletConfigUpdatesSkipped.WithLabelValues("restart-interval").Inc()
+		log.Debugf("Not updating the kubelet configuration: last kubelet restart attempt at %s is less than %s ago", u.lastRestart.Format(time.RFC3339), u.minRestartInterval.String())
+		return false, nil
+	}
+
+	config, err := LoadConfiguration(u.configPath)
+	if err != nil {
+		return false, err
+	}
+
+	kubeReserved := map[string]string{}
+	systemReserved := map[string]string{}
+	for _, resourceName := range sortedKeys(u.targets) {
+		minChange, ok := u.minChange[resourceName]
+		if !ok {
+			continue
+		}
+
+		// the capacity is only required to resolve percentages of hard eviction thresholds which are not updated
+		current, err := config.Reservations(resourceName, resource.Quantity{})
+		if err != nil {
+			return false, err
+		}
+
+		target := u.targets[resourceName]
+		if !exceedsChange(current.KubeReserved, target.KubeReserved, minChange) && !exceedsChange(current.SystemReserved, target.SystemReserved, minChange) {
+			continue
+		}
+
+		kubeReserved[resourceName] = formatReservation(resourceName, target.KubeReserved)
+		systemReserved[resourceName] = formatReservation(resourceName, target.SystemReserved)
+		log.Infof("Updating %s reservations in the kubelet configuration. Current: %s. Target: %s", resourceName, current.String(), target.String())
+	}
+
+	if len(kubeReserved) == 0 && !u.restartPending {
+		metricKubeletConfigUpdatesSkipped.WithLabelValues("below-threshold").Inc()
+		return false, nil
+	}
+
+	if len(kubeReserved) > 0 {
+		if err := UpdateReservations(u.configPath, kubeReserved, systemReserved); err != nil {
+			return false, err
+		}
+	}
+
+	// the kubelet only reads the configuration file on startup.
+	// A failed attempt counts towards the minimum restart interval as well to not retry a failing restart in every loop.
+	u.restartPending = true
+	u.lastRestart = u.now()
+	if err := u.restarter.RestartUnit(ctx, u.unit); err != nil {
+		return false, err
+	}
+
+	u.restartPending = false
+	metricKubeletRestarts.Inc()
+	log.Infof("Restarted %s to apply the updated reservations", u.unit)
+	return true, nil
+}
+
+// UpdateReservations sets the given resources in kube-reserved and system-reserved of the kubelet configuration file.
+// Only the given resources are patched in place: all other fields, comments and the order of the keys are preserved.
+// Before the first update, the original file is backed up to <path>.bak. An existing backup is never overwritten
+// to always allow restoring the configuration from before the first update.
+// The configuration file is replaced atomically.
+func UpdateReservations(path string, kubeReserved, systemReserved map[string]string) error {
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read kubelet configuration file %q: %w", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(original, &document); err != nil {
+		return fmt.Errorf("failed to parse kubelet configuration file %q: %w", path, err)
+	}
+
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("failed to parse kubelet configuration file %q: not a YAML mapping", path)
+	}
+
+	config := document.Content[0]
+	setReservations(config, keyKubeReserved, kubeReserved)
+	setReservations(config, keySystemReserved, systemReserved)
+
+	var updated bytes.Buffer
+	encoder := yaml.NewEncoder(&updated)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path + backupSuffix); os.IsNotExist(err) {
+		if err := writeFileAtomically(path+backupSuffix, original, info.Mode()); err != nil {
+			return fmt.Errorf("failed to back up kubelet configuration file: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to check the backup of the kubelet configuration file: %w", err)
+	}
+
+	if err := writeFileAtomically(path, updated.Bytes(), info.Mode()); err != nil {
+		return fmt.Errorf("failed to write kubelet configuration file: %w", err)
+	}
+	return nil
+}
+
+// setReservations sets the given resources in the mapping of the given key of the configuration.
+// Existing resources are updated in place, missing resources (and a missing mapping) are appended.
+func setReservations(config *yaml.Node, key string, reservations map[string]string) {
+	existing := mappingValue(config, key)
+	if existing == nil {
+		existing = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		config.Content = append(config.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, existing)
+	} else if existing.Kind != yaml.MappingNode {
+		// e.g an empty "kubeReserved:" is a null scalar
+		*existing = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: existing.HeadComment, LineComment: existing.LineComment}
+	}
+
+	resourceNames := make([]string, 0, len(reservations))
+	for resourceName := range reservations {
+		resourceNames = append(resourceNames, resourceName)
+	}
+	sort.Strings(resourceNames)
+
+	for _, resourceName := range resourceNames {
+		value := mappingValue(existing, resourceName)
+		if value == nil {
+			value = &yaml.Node{}
+			existing.Content = append(existing.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: resourceName}, value)
+		}
+		value.Kind = yaml.ScalarNode
+		value.Tag = "!!str"
+		value.Style = 0
+		value.Value = reservations[resourceName]
+	}
+}
+
+// mappingValue returns the value of the given key of the mapping node or nil if the key does not exist
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// writeFileAtomically writes the content to a temporary file in the same directory and renames it to the given path
+func writeFileAtomically(path string, content []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// exceedsChange returns true if the difference between current and target is at least minChange
+func exceedsChange(current, target, minChange resource.Quantity) bool {
+	diff := target.DeepCopy()
+	diff.Sub(current)
+	if diff.Sign() < 0 {
+		diff.Neg()
+	}
+	return diff.Cmp(minChange) >= 0
+}
+
+// formatReservation formats the reservation for the kubelet configuration file
+// memory and ephemeral-storage are rounded up to full MiB, CPU is given in millicores
+func formatReservation(resourceName string, quantity resource.Quantity) string {
+	switch resourceName {
+	case ResourceCPU:
+		return fmt.Sprintf("%dm", quantity.MilliValue())
+	case ResourceMemory, ResourceEphemeralStorage:
+		const mebibyte = 1024 * 1024
+		return fmt.Sprintf("%dMi", (quantity.Value()+mebibyte-1)/mebibyte)
+	default:
+		return quantity.String()
+	}
+}
+
+func sortedKeys(m map[string]Reservations) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,243 @@
+package kubelet_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const kubeletConfiguration = `apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+cgroupDriver: systemd
+kubeReserved:
+  cpu: 80m
+  memory: 1Gi
+  pid: "20k"
+systemReserved:
+  memory: 100Mi
+`
+
+type fakeRestarter struct {
+	restarts []string
+	err      error
+}
+
+func (f *fakeRestarter) RestartUnit(_ context.Context, unit string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.restarts = append(f.restarts, unit)
+	return nil
+}
+
+var _ = Describe("UpdateReservations", func() {
+	var (
+		dir        string
+		configPath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "kubelet")
+		Expect(err).ToNot(HaveOccurred())
+
+		configPath = filepath.Join(dir, "kubelet")
+		Expect(ioutil.WriteFile(configPath, []byte(kubeletConfiguration), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should update the reservations and keep all other fields", func() {
+		Expect(kubelet.UpdateReservations(configPath, map[string]string{"memory": "2Gi"}, map[string]string{"memory": "200Mi"})).To(Succeed())
+
+		config, err := kubelet.LoadConfiguration(configPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.CgroupDriver).To(Equal("systemd"))
+		Expect(config.KubeReserved).To(Equal(map[string]string{"cpu": "80m", "memory": "2Gi", "pid": "20k"}))
+		Expect(config.SystemReserved).To(Equal(map[string]string{"memory": "200Mi"}))
+
+		backup, err := ioutil.ReadFile(configPath + ".bak")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(backup)).To(Equal(kubeletConfiguration))
+
+		entries, err := ioutil.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+	})
+
+	It("should only patch the reservations and preserve comments and the order of the keys", func() {
+		const commented = `# managed by the node bootstrap
+apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+# reserved for the kubelet and the container runtime
+kubeReserved:
+  pid: "20k" # pids
+  memory: 1Gi
+cgroupDriver: systemd
+`
+		Expect(ioutil.WriteFile(configPath, []byte(commented), 0644)).To(Succeed())
+		Expect(kubelet.UpdateReservations(configPath, map[string]string{"memory": "2Gi", "cpu": "100m"}, map[string]string{"memory": "200Mi"})).To(Succeed())
+
+		updated, err := ioutil.ReadFile(configPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(updated)).To(Equal(`# managed by the node bootstrap
+apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+# reserved for the kubelet and the container runtime
+kubeReserved:
+  pid: "20k" # pids
+  memory: 2Gi
+  cpu: 100m
+cgroupDriver: systemd
+systemReserved:
+  memory: 200Mi
+`))
+	})
+
+	It("should keep the backup of the original configuration", func() {
+		Expect(kubelet.UpdateReservations(configPath, map[string]string{"memory": "2Gi"}, map[string]string{"memory": "200Mi"})).To(Succeed())
+		Expect(kubelet.UpdateReservations(configPath, map[string]string{"memory": "3Gi"}, map[string]string{"memory": "300Mi"})).To(Succeed())
+
+		config, err := kubelet.LoadConfiguration(configPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.KubeReserved["memory"]).To(Equal("3Gi"))
+
+		backup, err := ioutil.ReadFile(configPath + ".bak")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(backup)).To(Equal(kubeletConfiguration))
+	})
+
+	Describe("ConfigUpdater", func() {
+		var (
+			restarter *fakeRestarter
+			updater   *kubelet.ConfigUpdater
+			log       = logrus.New()
+		)
+
+		BeforeEach(func() {
+			restarter = &fakeRestarter{}
+			updater = kubelet.NewConfigUpdater(configPath, "kubelet.service", restarter, time.Hour, map[string]resource.Quantity{
+				kubelet.ResourceMemory: resource.MustParse("100Mi"),
+			})
+		})
+
+		It("should not update the configuration if the change is below the threshold", func() {
+			updater.SetTarget(kubelet.ResourceMemory, kubelet.Reservations{
+				KubeReserved:   resource.MustParse("1050Mi"),
+				SystemReserved: resource.MustParse("100Mi"),
+			})
+
+			restarted, err := updater.Reconcile(context.Background(), log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restarted).To(BeFalse())
+			Expect(restarter.restarts).To(BeEmpty())
+		})
+
+		It("should update the configuration, restart the kubelet and respect the minimum restart interval", func() {
+			updater.SetTarget(kubelet.ResourceMemory, kubelet.Reservations{
+				KubeReserved:   resource.MustParse("1500000000"),
+				SystemReserved: resource.MustParse("100Mi"),
+			})
+
+			restarted, err := updater.Reconcile(context.Background(), log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restarted).To(BeTrue())
+			Expect(restarter.restarts).To(Equal([]string{"kubelet.service"}))
+
+			config, err := kubelet.LoadConfiguration(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			// rounded up to full MiB
+			Expect(config.KubeReserved["memory"]).To(Equal("1431Mi"))
+			Expect(config.SystemReserved["memory"]).To(Equal("100Mi"))
+
+			updater.SetTarget(kubelet.ResourceMemory, kubelet.Reservations{
+				KubeReserved:   resource.MustParse("3Gi"),
+				SystemReserved: resource.MustParse("100Mi"),
+			})
+
+			restarted, err = updater.Reconcile(context.Background(), log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restarted).To(BeFalse())
+			Expect(restarter.restarts).To(HaveLen(1))
+		})
+
+		It("should retry the kubelet restart after a failed restart once the minimum restart interval passed", func() {
+			now := time.Now()
+			kubelet.SetNow(updater, func() time.Time { return now })
+
+			restarter.err = errors.New("fake")
+			updater.SetTarget(kubelet.ResourceMemory, kubelet.Reservations{
+				KubeReserved:   resource.MustParse("2Gi"),
+				SystemReserved: resource.MustParse("100Mi"),
+			})
+
+			_, err := updater.Reconcile(context.Background(), log)
+			Expect(err).To(HaveOccurred())
+
+			// the failed attempt counts towards the minimum restart interval
+			restarter.err = nil
+			restarted, err := updater.Reconcile(context.Background(), log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restarted).To(BeFalse())
+			Expect(restarter.restarts).To(BeEmpty())
+
+			now = now.Add(time.Hour)
+			restarted, err = updater.Reconcile(context.Background(), log)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restarted).To(BeTrue())
+			Expect(restarter.restarts).To(HaveLen(1))
+		})
+	})
+})
+
+var _ = Describe("SystemdRestarter", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dbus")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should restart the unit via the systemd D-Bus API", func() {
+		systemd, err := newFakeSystemd(dir, "done")
+		Expect(err).ToNot(HaveOccurred())
+		defer systemd.close()
+
+		restarter := kubelet.NewSystemdRestarterForAddress(systemd.address())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		Expect(restarter.RestartUnit(ctx, "kubelet.service")).To(Succeed())
+		Expect(systemd.restarts()).To(Equal([]string{"kubelet.service:replace"}))
+		Eventually(systemd.openConnections).Should(BeZero())
+	})
+
+	It("should return an error if the restart job failed", func() {
+		systemd, err := newFakeSystemd(dir, "failed")
+		Expect(err).ToNot(HaveOccurred())
+		defer systemd.close()
+
+		restarter := kubelet.NewSystemdRestarterForAddress(systemd.address())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err = restarter.RestartUnit(ctx, "kubelet.service")
+		Expect(err).To(MatchError(ContainSubstring(`job finished with result "failed"`)))
+	})
+})
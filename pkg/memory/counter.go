@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// kernelCounterVec exports cumulative counters maintained by the kernel (e.g memory.events) as prometheus counters.
+// The last read value per label values is exported as is. A decreasing value (e.g a recreated cgroup) is a counter reset.
+type kernelCounterVec struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	values map[string]kernelCounter
+}
+
+type kernelCounter struct {
+	labelValues []string
+	value       float64
+}
+
+// newKernelCounterVec creates a kernelCounterVec with the given labels and registers it with the default registry
+func newKernelCounterVec(name, help string, labels ...string) *kernelCounterVec {
+	c := &kernelCounterVec{
+		desc:   prometheus.NewDesc(name, help, labels, nil),
+		values: map[string]kernelCounter{},
+	}
+	prometheus.MustRegister(c)
+	return c
+}
+
+// Set sets the counter of the given label values to the value read from the kernel
+func (c *kernelCounterVec) Set(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")] = kernelCounter{labelValues: labelValues, value: value}
+}
+
+// Describe implements prometheus.Collector
+func (c *kernelCounterVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *kernelCounterVec) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, counter := range c.values {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, counter.value, counter.labelValues...)
+	}
+}
@@ -0,0 +1,7 @@
+package memory
+
+// PollOOMCounters reads the OOM counters once, reading /proc/vmstat from the given path
+func PollOOMCounters(w *OOMWatcher, vmStatPath string) error {
+	w.vmStatPath = vmStatPath
+	return w.poll()
+}
@@ -0,0 +1,187 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// sysKernelHugePages is the directory containing a directory per hugepage size (e.g. hugepages-2048kB)
+	sysKernelHugePages = "/sys/kernel/mm/hugepages"
+	// hugePagesDirPrefix is the prefix of the directories per hugepage size in /sys/kernel/mm/hugepages
+	hugePagesDirPrefix = "hugepages-"
+	// cgroupV1HugetlbUsageFormat is the format of the name of the cgroupsv1 file containing the hugetlb usage of a cgroup per hugepage size
+	cgroupV1HugetlbUsageFormat = "hugetlb.%s.usage_in_bytes"
+	// cgroupV2HugetlbCurrentFormat is the format of the name of the cgroupsv2 file containing the hugetlb usage of a cgroup per hugepage size
+	cgroupV2HugetlbCurrentFormat = "hugetlb.%s.current"
+)
+
+var (
+	metricHugetlb = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_Hugetlb",
+		Help: "The memory pre-allocated as hugepages of all sizes (Hugetlb from /proc/meminfo). Not usable as regular memory.",
+	})
+
+	metricHugePages = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_memory_hugepages",
+		Help: "The number of pre-allocated hugepages by page size from /sys/kernel/mm/hugepages",
+	}, []string{"size"})
+
+	metricHugePagesFree = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_memory_hugepages_free",
+		Help: "The number of free hugepages by page size from /sys/kernel/mm/hugepages",
+	}, []string{"size"})
+
+	metricKubepodsHugetlbUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_kubepods_hugetlb_usage_bytes",
+		Help: "The hugetlb usage of the kubepods cgroup in bytes by page size",
+	}, []string{"size"})
+)
+
+// HugePageSize are the hugepages of a single page size
+type HugePageSize struct {
+	// Name is the name of the page size as used by the hugetlb cgroup controller (e.g. 2MB)
+	Name string
+	// SizeBytes is the page size in bytes
+	SizeBytes int64
+	// Count is the number of pre-allocated hugepages
+	Count int64
+	// Free is the number of free hugepages
+	Free int64
+}
+
+// HugePages are the pre-allocated hugepages of the node
+type HugePages struct {
+	// Total is the memory pre-allocated as hugepages of all sizes
+	Total resource.Quantity
+	// Sizes are the hugepages per page size
+	Sizes []HugePageSize
+}
+
+// MemInfoHugePages are the hugepage fields of /proc/meminfo
+type MemInfoHugePages struct {
+	// Total is the number of pre-allocated hugepages of the default page size (HugePages_Total)
+	Total int64
+	// PageSize is the default page size (Hugepagesize)
+	PageSize resource.Quantity
+	// Hugetlb is the memory pre-allocated as hugepages of all sizes. Nil before Linux 4.16.
+	Hugetlb *resource.Quantity
+}
+
+// ReadHugePages returns the pre-allocated hugepages given the hugepage fields of /proc/meminfo and reads the hugepages
+// per page size from the given directory (/sys/kernel/mm/hugepages).
+// The hugepages are counted in MemTotal, but are neither part of MemAvailable nor usable as regular memory.
+func ReadHugePages(meminfo MemInfoHugePages, hugePagesDir string) (HugePages, error) {
+	sizes, err := readHugePageSizes(hugePagesDir)
+	if err != nil {
+		return HugePages{}, err
+	}
+
+	// Hugetlb (Linux >= 4.16) includes all page sizes, HugePages_Total only the default page size
+	var total int64
+	switch {
+	case meminfo.Hugetlb != nil:
+		total = meminfo.Hugetlb.Value()
+	case len(sizes) > 0:
+		for _, size := range sizes {
+			total += size.Count * size.SizeBytes
+		}
+	default:
+		total = meminfo.Total * meminfo.PageSize.Value()
+	}
+
+	return HugePages{
+		Total: *resource.NewQuantity(total, resource.BinarySI),
+		Sizes: sizes,
+	}, nil
+}
+
+// readHugePageSizes reads the hugepages per page size from the given directory (/sys/kernel/mm/hugepages).
+// Returns no sizes if the kernel does not support hugepages.
+func readHugePageSizes(dir string) ([]HugePageSize, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+
+	var sizes []HugePageSize
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), hugePagesDirPrefix) {
+			continue
+		}
+
+		sizeKB, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(entry.Name(), hugePagesDirPrefix), "kB"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hugepage size %q: %v", entry.Name(), err)
+		}
+
+		count, err := cgroupfs.ReadUint(filepath.Join(dir, entry.Name(), "nr_hugepages"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the number of hugepages of size %s: %v", entry.Name(), err)
+		}
+
+		free, err := cgroupfs.ReadUint(filepath.Join(dir, entry.Name(), "free_hugepages"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the number of free hugepages of size %s: %v", entry.Name(), err)
+		}
+
+		sizes = append(sizes, HugePageSize{
+			Name:      HugePageSizeName(sizeKB),
+			SizeBytes: sizeKB * 1024,
+			Count:     int64(count),
+			Free:      int64(free),
+		})
+	}
+	return sizes, nil
+}
+
+// HugePageSizeName returns the name of the page size (given in kiB) as used in the file names of the hugetlb cgroup controller (e.g. 2MB, 1GB)
+func HugePageSizeName(sizeKB int64) string {
+	switch {
+	case sizeKB >= 1024*1024 && sizeKB%(1024*1024) == 0:
+		return fmt.Sprintf("%dGB", sizeKB/(1024*1024))
+	case sizeKB >= 1024 && sizeKB%1024 == 0:
+		return fmt.Sprintf("%dMB", sizeKB/1024)
+	}
+	return fmt.Sprintf("%dKB", sizeKB)
+}
+
+// recordHugePages records the pre-allocated hugepages and the hugetlb usage of the kubepods cgroup as metrics
+func recordHugePages(hugePages HugePages, cgroupRoot string, cgroupsV2 bool, kubepodsCgroupName string) error {
+	metricHugetlb.Set(float64(hugePages.Total.Value()))
+
+	for _, size := range hugePages.Sizes {
+		metricHugePages.WithLabelValues(size.Name).Set(float64(size.Count))
+		metricHugePagesFree.WithLabelValues(size.Name).Set(float64(size.Free))
+
+		path := filepath.Join(cgroupRoot, string(cgroups.Hugetlb), kubepodsCgroupName, fmt.Sprintf(cgroupV1HugetlbUsageFormat, size.Name))
+		if cgroupsV2 {
+			path = filepath.Join(cgroupRoot, kubepodsCgroupName, fmt.Sprintf(cgroupV2HugetlbCurrentFormat, size.Name))
+		}
+
+		usage, err := cgroupfs.ReadUint(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// the hugetlb controller is not enabled
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the hugetlb usage of the %s cgroup: %v", kubepodsCgroupName, err)
+		}
+		metricKubepodsHugetlbUsage.WithLabelValues(size.Name).Set(float64(usage))
+	}
+	return nil
+}
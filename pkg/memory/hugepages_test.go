@@ -0,0 +1,96 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = Describe("HugePages", func() {
+	It("should name the page sizes like the hugetlb cgroup controller", func() {
+		Expect(memory.HugePageSizeName(2048)).To(Equal("2MB"))
+		Expect(memory.HugePageSizeName(1048576)).To(Equal("1GB"))
+		Expect(memory.HugePageSizeName(32768)).To(Equal("32MB"))
+		Expect(memory.HugePageSizeName(64)).To(Equal("64KB"))
+	})
+
+	Context("reading the pre-allocated hugepages", func() {
+		var (
+			dir          string
+			hugePagesDir string
+		)
+
+		writeFile := func(path, value string) {
+			Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path, []byte(value), 0644)).To(Succeed())
+		}
+
+		writeHugePageSize := func(name, count, free string) {
+			writeFile(filepath.Join(hugePagesDir, name, "nr_hugepages"), count+"\n")
+			writeFile(filepath.Join(hugePagesDir, name, "free_hugepages"), free+"\n")
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "sys")
+			Expect(err).ToNot(HaveOccurred())
+			hugePagesDir = filepath.Join(dir, "hugepages")
+
+			writeHugePageSize("hugepages-2048kB", "512", "100")
+			writeHugePageSize("hugepages-1048576kB", "2", "2")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("should read the hugepages per page size", func() {
+			hugePages, err := memory.ReadHugePages(memory.MemInfoHugePages{}, hugePagesDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hugePages.Sizes).To(ConsistOf(
+				memory.HugePageSize{Name: "2MB", SizeBytes: 2 << 20, Count: 512, Free: 100},
+				memory.HugePageSize{Name: "1GB", SizeBytes: 1 << 30, Count: 2, Free: 2},
+			))
+		})
+
+		It("should prefer Hugetlb from the meminfo", func() {
+			hugetlb := resource.MustParse("3Gi")
+			hugePages, err := memory.ReadHugePages(memory.MemInfoHugePages{Total: 512, PageSize: resource.MustParse("2Mi"), Hugetlb: &hugetlb}, hugePagesDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hugePages.Total.Value()).To(Equal(int64(3 << 30)))
+		})
+
+		It("should sum up the page sizes without Hugetlb", func() {
+			hugePages, err := memory.ReadHugePages(memory.MemInfoHugePages{Total: 512, PageSize: resource.MustParse("2Mi")}, hugePagesDir)
+			Expect(err).ToNot(HaveOccurred())
+			// 512 * 2Mi + 2 * 1Gi
+			Expect(hugePages.Total.Value()).To(Equal(int64(3 << 30)))
+		})
+
+		It("should fall back to the default page size without the per-size directories", func() {
+			Expect(os.RemoveAll(hugePagesDir)).To(Succeed())
+			hugePages, err := memory.ReadHugePages(memory.MemInfoHugePages{Total: 512, PageSize: resource.MustParse("2Mi")}, hugePagesDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hugePages.Sizes).To(BeEmpty())
+			Expect(hugePages.Total.Value()).To(Equal(int64(1 << 30)))
+		})
+
+		It("should skip entries that are no hugepage size", func() {
+			writeFile(filepath.Join(hugePagesDir, "other"), "")
+			hugePages, err := memory.ReadHugePages(memory.MemInfoHugePages{}, hugePagesDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hugePages.Sizes).To(HaveLen(2))
+		})
+
+		It("should fail on an invalid hugepage size", func() {
+			writeHugePageSize("hugepages-invalid", "1", "1")
+			_, err := memory.ReadHugePages(memory.MemInfoHugePages{}, hugePagesDir)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,153 @@
+package memory
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// AttributionSystemSlice is the part of the reservation attributed to the working set of system.slice
+	AttributionSystemSlice = "system.slice"
+	// AttributionSwap is the part of the reservation attributed to the swap used by non-pod processes
+	AttributionSwap = "swap"
+	// AttributionKernel is the part of the reservation attributed to unreclaimable kernel memory
+	AttributionKernel = "kernel"
+	// AttributionUnaccounted is the part of the reservation that is neither attributed to system.slice, swap nor the kernel
+	// (e.g. processes in other cgroups, kernel memory not reported in /proc/meminfo)
+	AttributionUnaccounted = "unaccounted"
+	// AttributionSafetyMargin is the part of the reservation added as safety margin
+	AttributionSafetyMargin = "safety-margin"
+)
+
+var (
+	metricSlabReclaimable = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_SReclaimable",
+		Help: "The SReclaimable (reclaimable slab) from /proc/meminfo",
+	})
+
+	metricSlabUnreclaimable = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_SUnreclaim",
+		Help: "The SUnreclaim (unreclaimable slab) from /proc/meminfo",
+	})
+
+	metricPageTables = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_PageTables",
+		Help: "The PageTables from /proc/meminfo",
+	})
+
+	metricKernelStack = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_KernelStack",
+		Help: "The KernelStack from /proc/meminfo",
+	})
+
+	metricVmallocUsed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_VmallocUsed",
+		Help: "The VmallocUsed from /proc/meminfo",
+	})
+
+	metricPercpu = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_Percpu",
+		Help: "The Percpu from /proc/meminfo",
+	})
+
+	metricShmem = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_Shmem",
+		Help: "The Shmem (shared memory and tmpfs) from /proc/meminfo",
+	})
+
+	metricKernelUnreclaimable = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_kernel_unreclaimable",
+		Help: "The unreclaimable kernel memory calculated from /proc/meminfo SUnreclaim + PageTables + KernelStack + VmallocUsed + Percpu",
+	})
+
+	metricReservationAttribution = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubelet_target_reserved_memory_attribution_bytes",
+		Help: "The recommended reserved memory in bytes attributed to system.slice, swap, the kernel, unaccounted memory and the safety margin",
+	}, []string{"component"})
+)
+
+// KernelMemory is the memory used by the kernel as reported in /proc/meminfo
+type KernelMemory struct {
+	// SlabReclaimable is the slab memory that can be reclaimed (e.g. dentry and inode caches)
+	SlabReclaimable resource.Quantity
+	// SlabUnreclaimable is the slab memory that cannot be reclaimed
+	SlabUnreclaimable resource.Quantity
+	// PageTables is the memory used for page tables
+	PageTables resource.Quantity
+	// KernelStack is the memory used for kernel stacks of all tasks
+	KernelStack resource.Quantity
+	// VmallocUsed is the memory used by vmalloc allocations
+	VmallocUsed resource.Quantity
+	// Percpu is the memory used by per-CPU allocations
+	Percpu resource.Quantity
+	// Shmem is the shared memory and tmpfs. Not kernel memory, but not part of any process's working set either.
+	Shmem resource.Quantity
+}
+
+// Unreclaimable returns the kernel memory that cannot be reclaimed
+// (SUnreclaim + PageTables + KernelStack + VmallocUsed + Percpu)
+func (k KernelMemory) Unreclaimable() resource.Quantity {
+	unreclaimable := k.SlabUnreclaimable.DeepCopy()
+	unreclaimable.Add(k.PageTables)
+	unreclaimable.Add(k.KernelStack)
+	unreclaimable.Add(k.VmallocUsed)
+	unreclaimable.Add(k.Percpu)
+	return unreclaimable
+}
+
+// ReservationAttribution attributes the target reserved memory to its consumers
+type ReservationAttribution struct {
+	SystemSlice  resource.Quantity
+	Swap         resource.Quantity
+	Kernel       resource.Quantity
+	Unaccounted  resource.Quantity
+	SafetyMargin resource.Quantity
+}
+
+// AttributeReservation attributes the memory used by non-pod processes (the recommended reserved memory without the safety margin)
+// to the working set of system.slice, the swap used by non-pod processes, the unreclaimable kernel memory and the remaining unaccounted memory.
+// Kernel memory charged to the system.slice cgroup (e.g. kernel stacks and slab of its processes) is contained in both,
+// hence each part is capped at the memory not yet attributed (in the order system.slice, swap, kernel, unaccounted).
+func AttributeReservation(nonPodMemory, systemSliceWorkingSet, nonPodSwap resource.Quantity, kernel KernelMemory, safetyMargin resource.Quantity) ReservationAttribution {
+	remaining := nonPodMemory.DeepCopy()
+	attribute := func(value resource.Quantity) resource.Quantity {
+		if value.Cmp(remaining) > 0 {
+			value = remaining.DeepCopy()
+		}
+		if value.Sign() < 0 {
+			value = resource.Quantity{}
+		}
+		remaining.Sub(value)
+		return value
+	}
+
+	attribution := ReservationAttribution{
+		SystemSlice:  attribute(systemSliceWorkingSet.DeepCopy()),
+		Swap:         attribute(nonPodSwap.DeepCopy()),
+		Kernel:       attribute(kernel.Unreclaimable()),
+		SafetyMargin: safetyMargin.DeepCopy(),
+	}
+	attribution.Unaccounted = attribute(remaining.DeepCopy())
+	return attribution
+}
+
+// recordKernelMemory records the kernel memory and the attribution of the recommended reserved memory as metrics
+func recordKernelMemory(kernel KernelMemory, attribution ReservationAttribution) {
+	metricSlabReclaimable.Set(float64(kernel.SlabReclaimable.Value()))
+	metricSlabUnreclaimable.Set(float64(kernel.SlabUnreclaimable.Value()))
+	metricPageTables.Set(float64(kernel.PageTables.Value()))
+	metricKernelStack.Set(float64(kernel.KernelStack.Value()))
+	metricVmallocUsed.Set(float64(kernel.VmallocUsed.Value()))
+	metricPercpu.Set(float64(kernel.Percpu.Value()))
+	metricShmem.Set(float64(kernel.Shmem.Value()))
+
+	unreclaimable := kernel.Unreclaimable()
+	metricKernelUnreclaimable.Set(float64(unreclaimable.Value()))
+
+	metricReservationAttribution.WithLabelValues(AttributionSystemSlice).Set(float64(attribution.SystemSlice.Value()))
+	metricReservationAttribution.WithLabelValues(AttributionSwap).Set(float64(attribution.Swap.Value()))
+	metricReservationAttribution.WithLabelValues(AttributionKernel).Set(float64(attribution.Kernel.Value()))
+	metricReservationAttribution.WithLabelValues(AttributionUnaccounted).Set(float64(attribution.Unaccounted.Value()))
+	metricReservationAttribution.WithLabelValues(AttributionSafetyMargin).Set(float64(attribution.SafetyMargin.Value()))
+}
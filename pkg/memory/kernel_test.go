@@ -0,0 +1,51 @@
+package memory_test
+
+import (
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = Describe("Kernel memory", func() {
+	kernel := memory.KernelMemory{
+		SlabReclaimable:   resource.MustParse("500Mi"),
+		SlabUnreclaimable: resource.MustParse("200Mi"),
+		PageTables:        resource.MustParse("50Mi"),
+		KernelStack:       resource.MustParse("20Mi"),
+		VmallocUsed:       resource.MustParse("20Mi"),
+		Percpu:            resource.MustParse("10Mi"),
+		Shmem:             resource.MustParse("100Mi"),
+	}
+
+	expectQuantity := func(actual resource.Quantity, expected string) {
+		ExpectWithOffset(1, actual.Cmp(resource.MustParse(expected))).To(Equal(0), "quantity is %s", actual.String())
+	}
+
+	It("should sum up the unreclaimable kernel memory", func() {
+		expectQuantity(kernel.Unreclaimable(), "300Mi")
+	})
+
+	It("should attribute the reservation", func() {
+		attribution := memory.AttributeReservation(resource.MustParse("2Gi"), resource.MustParse("1Gi"), resource.Quantity{}, kernel, resource.MustParse("100Mi"))
+		expectQuantity(attribution.SystemSlice, "1Gi")
+		expectQuantity(attribution.Kernel, "300Mi")
+		expectQuantity(attribution.Unaccounted, "724Mi")
+		expectQuantity(attribution.SafetyMargin, "100Mi")
+	})
+
+	It("should attribute the swap used by non-pod processes", func() {
+		attribution := memory.AttributeReservation(resource.MustParse("2Gi"), resource.MustParse("1Gi"), resource.MustParse("200Mi"), kernel, resource.MustParse("100Mi"))
+		expectQuantity(attribution.SystemSlice, "1Gi")
+		expectQuantity(attribution.Swap, "200Mi")
+		expectQuantity(attribution.Kernel, "300Mi")
+		expectQuantity(attribution.Unaccounted, "524Mi")
+	})
+
+	It("should not attribute more than the non-pod memory", func() {
+		attribution := memory.AttributeReservation(resource.MustParse("1100Mi"), resource.MustParse("1Gi"), resource.Quantity{}, kernel, resource.MustParse("100Mi"))
+		expectQuantity(attribution.SystemSlice, "1Gi")
+		expectQuantity(attribution.Kernel, "76Mi")
+		expectQuantity(attribution.Unaccounted, "0")
+	})
+})
@@ -0,0 +1,291 @@
+package memory
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// pressureGrowInterval is the minimum time between two increases of the safety margin under sustained memory pressure
+	pressureGrowInterval = time.Minute
+	// pressureShrinkInterval is the minimum time the memory pressure has to be low (and since the last adjustment) before the safety margin is decreased again
+	pressureShrinkInterval = 10 * time.Minute
+	// minStdDevSamples is the minimum number of non-pod memory samples within the window to calculate the standard deviation
+	minStdDevSamples = 2
+
+	// MarginStrategyAbsolute is a fixed safety margin
+	MarginStrategyAbsolute = "absolute"
+	// MarginStrategyPercent is a safety margin in percent of the memory capacity
+	MarginStrategyPercent = "percent"
+	// MarginStrategyStdDev is a multiple of the standard deviation of the non-pod memory within a window
+	MarginStrategyStdDev = "stddev"
+)
+
+// MarginStrategies are the supported strategies to calculate the base safety margin
+var MarginStrategies = []string{MarginStrategyAbsolute, MarginStrategyPercent, MarginStrategyStdDev}
+
+var (
+	metricSafetyMarginBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kubelet_memory_safety_margin_bytes",
+		Help: "The safety margin in bytes added to the target reserved memory (including increases due to memory pressure and global OOM kills)",
+	})
+
+	metricSafetyMarginStrategyBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubelet_memory_safety_margin_strategy_bytes",
+		Help: "The base safety margin in bytes calculated by each enabled strategy (absolute, percent, stddev). The base safety margin is the maximum.",
+	}, []string{"strategy"})
+
+	metricSafetyMarginStrategyClamped = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kubelet_memory_safety_margin_strategy_clamped",
+		Help: "1 if the base safety margin calculated by the strategy (absolute, percent, stddev) exceeds the maximum safety margin and is clamped, 0 otherwise",
+	}, []string{"strategy"})
+
+	metricNonPodMemoryStdDevBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_non_pod_stddev_bytes",
+		Help: "The standard deviation of the memory used by non-pod processes (target reserved memory without the safety margin) within the window of the stddev safety margin strategy in bytes",
+	})
+)
+
+// MarginStrategy configures how the base safety margin is calculated.
+// With several strategies, the base safety margin is the maximum of the margins of all strategies.
+type MarginStrategy struct {
+	// Strategies are the enabled strategies (see MarginStrategies)
+	Strategies []string
+	// Absolute is the margin of the absolute strategy
+	Absolute resource.Quantity
+	// Percent is the margin of the percent strategy in percent of the memory capacity
+	Percent float64
+	// StdDevMultiplier is the multiple of the standard deviation of the non-pod memory used by the stddev strategy
+	StdDevMultiplier float64
+	// StdDevWindow is the window of non-pod memory samples the standard deviation is calculated of
+	StdDevWindow time.Duration
+}
+
+// Enabled returns true if the given strategy is enabled
+func (s MarginStrategy) Enabled(strategy string) bool {
+	for _, enabled := range s.Strategies {
+		if enabled == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// memorySample is the non-pod memory in bytes at a point in time
+type memorySample struct {
+	value int64
+	time  time.Time
+}
+
+// SafetyMargin is the safety margin added to the target reserved memory.
+// The base safety margin is calculated by the configured strategies (fixed, relative to the memory capacity or to the volatility of the non-pod memory).
+// On top of the base, it grows step-wise while the non-pod processes are under sustained memory pressure
+// and shrinks back step-wise once the pressure is gone.
+// In addition, it grows permanently by one step on every global OOM kill. The margin never exceeds the maximum (if any).
+// Safe for concurrent use.
+type SafetyMargin struct {
+	mu       sync.Mutex
+	strategy MarginStrategy
+	// base is the base safety margin of the latest observation
+	base              int64
+	step              int64
+	max               int64
+	pressureThreshold float64
+	// pressureIncrease is the amount the margin is currently increased by due to memory pressure
+	pressureIncrease int64
+	// oomIncrease is the amount the margin is permanently increased by due to global OOM kills
+	oomIncrease    int64
+	lastAdjustment time.Time
+	// lowPressureSince is the time the memory pressure dropped below half the threshold (zero while it is not)
+	lowPressureSince time.Time
+	// samples are the non-pod memory samples within the window of the stddev strategy
+	samples []memorySample
+}
+
+// NewSafetyMargin returns a new safety margin starting at base (must not be larger than max).
+// A max of 0 does not limit the margin.
+// The margin grows by step (up to max) while the observed memory pressure is at or above the pressureThreshold (in percent).
+// A pressureThreshold of 0 disables the adjustment.
+func NewSafetyMargin(base, step, max resource.Quantity, pressureThreshold float64) *SafetyMargin {
+	return NewAdaptiveSafetyMargin(MarginStrategy{Strategies: []string{MarginStrategyAbsolute}, Absolute: base}, step, max, pressureThreshold)
+}
+
+// NewAdaptiveSafetyMargin returns a new safety margin with the base calculated by the given strategy.
+// Until the first observation of the non-pod memory, the base is the absolute margin (if enabled).
+// A max of 0 does not limit the margin.
+// The margin grows by step (up to max) while the observed memory pressure is at or above the pressureThreshold (in percent).
+// A pressureThreshold of 0 disables the adjustment.
+func NewAdaptiveSafetyMargin(strategy MarginStrategy, step, max resource.Quantity, pressureThreshold float64) *SafetyMargin {
+	m := &SafetyMargin{
+		strategy:          strategy,
+		step:              step.Value(),
+		max:               max.Value(),
+		pressureThreshold: pressureThreshold,
+	}
+	if strategy.Enabled(MarginStrategyAbsolute) {
+		m.base = strategy.Absolute.Value()
+	}
+	metricSafetyMarginBytes.Set(float64(m.value()))
+	return m
+}
+
+// Get returns the current safety margin
+func (m *SafetyMargin) Get() resource.Quantity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return *resource.NewQuantity(m.value(), resource.BinarySI)
+}
+
+// ObservePressure adjusts the safety margin to the memory pressure (share of stalled time in percent) observed at time now.
+// While the pressure is at or above the threshold, the margin grows by one step per pressureGrowInterval.
+// Once the pressure has been below half the threshold for pressureShrinkInterval, the margin shrinks by one step
+// per pressureShrinkInterval.
+// Returns the safety margin and true if it changed.
+func (m *SafetyMargin) ObservePressure(pressure float64, now time.Time) (resource.Quantity, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.value()
+	switch {
+	case m.pressureThreshold <= 0:
+	case pressure >= m.pressureThreshold:
+		m.lowPressureSince = time.Time{}
+		if m.lastAdjustment.IsZero() || now.Sub(m.lastAdjustment) >= pressureGrowInterval {
+			m.pressureIncrease += m.step
+			m.lastAdjustment = now
+		}
+	case pressure < m.pressureThreshold/2:
+		if m.lowPressureSince.IsZero() {
+			m.lowPressureSince = now
+		}
+		if m.pressureIncrease > 0 && now.Sub(m.lowPressureSince) >= pressureShrinkInterval && now.Sub(m.lastAdjustment) >= pressureShrinkInterval {
+			m.pressureIncrease -= m.step
+			if m.pressureIncrease < 0 {
+				m.pressureIncrease = 0
+			}
+			m.lastAdjustment = now
+		}
+	default:
+		// between half the threshold and the threshold, the margin is kept
+		m.lowPressureSince = time.Time{}
+	}
+
+	return m.update(previous)
+}
+
+// ObserveNonPodMemory recalculates the base safety margin given the memory used by non-pod processes and the memory capacity
+// observed at time now. The margins of all enabled strategies are recorded as metrics, the base is the maximum.
+// Strategies whose margin exceeds the maximum safety margin are recorded as clamped.
+// Returns the safety margin and true if it changed.
+func (m *SafetyMargin) ObserveNonPodMemory(nonPodMemory, capacity resource.Quantity, now time.Time) (resource.Quantity, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.value()
+	margins := map[string]int64{}
+	if m.strategy.Enabled(MarginStrategyAbsolute) {
+		margins[MarginStrategyAbsolute] = m.strategy.Absolute.Value()
+	}
+
+	if m.strategy.Enabled(MarginStrategyPercent) {
+		margins[MarginStrategyPercent] = int64(math.Round(float64(capacity.Value()) * m.strategy.Percent / 100))
+	}
+
+	if m.strategy.Enabled(MarginStrategyStdDev) {
+		m.samples = append(m.samples, memorySample{value: nonPodMemory.Value(), time: now})
+		for len(m.samples) > 0 && now.Sub(m.samples[0].time) > m.strategy.StdDevWindow {
+			m.samples = m.samples[1:]
+		}
+
+		stdDev := standardDeviation(m.samples)
+		metricNonPodMemoryStdDevBytes.Set(math.Round(stdDev))
+		margins[MarginStrategyStdDev] = int64(math.Round(stdDev * m.strategy.StdDevMultiplier))
+	}
+
+	m.base = 0
+	for strategy, margin := range margins {
+		metricSafetyMarginStrategyBytes.WithLabelValues(strategy).Set(float64(margin))
+		clamped := 0.0
+		if m.limited() && margin > m.max {
+			clamped = 1
+		}
+		metricSafetyMarginStrategyClamped.WithLabelValues(strategy).Set(clamped)
+		if margin > m.base {
+			m.base = margin
+		}
+	}
+	return m.update(previous)
+}
+
+// GrowOnOOM permanently grows the safety margin by one step after a global OOM kill.
+// Returns the safety margin and true if it changed.
+func (m *SafetyMargin) GrowOnOOM() (resource.Quantity, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.value()
+	m.oomIncrease += m.step
+	return m.update(previous)
+}
+
+// update limits the safety margin to the maximum and records it as metric.
+// The increase due to memory pressure is limited first, as it is not permanent.
+// Never grows the increases beyond the maximum to shrink immediately once the pressure is gone.
+// The increase due to global OOM kills is kept if the base grows beyond the maximum, as the base can shrink again.
+// Requires the lock to be held.
+func (m *SafetyMargin) update(previous int64) (resource.Quantity, bool) {
+	if m.limited() {
+		if m.oomIncrease > m.max {
+			m.oomIncrease = m.max
+		}
+		if m.base+m.oomIncrease+m.pressureIncrease > m.max {
+			m.pressureIncrease = m.max - m.base - m.oomIncrease
+			if m.pressureIncrease < 0 {
+				m.pressureIncrease = 0
+			}
+		}
+	}
+
+	value := m.value()
+	metricSafetyMarginBytes.Set(float64(value))
+	return *resource.NewQuantity(value, resource.BinarySI), value != previous
+}
+
+// value returns the current safety margin (at most the maximum, if any). Requires the lock to be held.
+func (m *SafetyMargin) value() int64 {
+	value := m.base + m.oomIncrease + m.pressureIncrease
+	if m.limited() && value > m.max {
+		return m.max
+	}
+	return value
+}
+
+// limited returns true if the safety margin has a maximum
+func (m *SafetyMargin) limited() bool {
+	return m.max > 0
+}
+
+// standardDeviation returns the (population) standard deviation of the given samples.
+// Returns 0 if there are not enough samples.
+func standardDeviation(samples []memorySample) float64 {
+	if len(samples) < minStdDevSamples {
+		return 0
+	}
+
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample.value)
+	}
+	mean := sum / float64(len(samples))
+
+	var squares float64
+	for _, sample := range samples {
+		squares += (float64(sample.value) - mean) * (float64(sample.value) - mean)
+	}
+	return math.Sqrt(squares / float64(len(samples)))
+}
@@ -0,0 +1,219 @@
+package memory_test
+
+import (
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = Describe("SafetyMargin", func() {
+	var (
+		margin *memory.SafetyMargin
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		margin = memory.NewSafetyMargin(resource.MustParse("100Mi"), resource.MustParse("100Mi"), resource.MustParse("300Mi"), 10)
+		now = time.Now()
+	})
+
+	expectMargin := func(expected string) {
+		value := margin.Get()
+		Expect(value.Cmp(resource.MustParse(expected))).To(Equal(0), "margin is %s", value.String())
+	}
+
+	It("should not change without memory pressure", func() {
+		_, changed := margin.ObservePressure(2, now)
+		Expect(changed).To(BeFalse())
+		expectMargin("100Mi")
+	})
+
+	It("should grow once per interval under sustained memory pressure up to the maximum", func() {
+		_, changed := margin.ObservePressure(15, now)
+		Expect(changed).To(BeTrue())
+		expectMargin("200Mi")
+
+		_, changed = margin.ObservePressure(15, now.Add(30*time.Second))
+		Expect(changed).To(BeFalse())
+		expectMargin("200Mi")
+
+		_, changed = margin.ObservePressure(15, now.Add(time.Minute))
+		Expect(changed).To(BeTrue())
+		expectMargin("300Mi")
+
+		_, changed = margin.ObservePressure(15, now.Add(2*time.Minute))
+		Expect(changed).To(BeFalse())
+		expectMargin("300Mi")
+	})
+
+	It("should shrink back once the memory pressure is gone", func() {
+		margin.ObservePressure(15, now)
+		expectMargin("200Mi")
+
+		// between half the threshold and the threshold the margin is kept
+		_, changed := margin.ObservePressure(7, now.Add(time.Minute))
+		Expect(changed).To(BeFalse())
+
+		// the pressure just dropped below half the threshold
+		_, changed = margin.ObservePressure(1, now.Add(20*time.Minute))
+		Expect(changed).To(BeFalse())
+		expectMargin("200Mi")
+
+		_, changed = margin.ObservePressure(1, now.Add(25*time.Minute))
+		Expect(changed).To(BeFalse())
+		expectMargin("200Mi")
+
+		_, changed = margin.ObservePressure(1, now.Add(30*time.Minute))
+		Expect(changed).To(BeTrue())
+		expectMargin("100Mi")
+
+		_, changed = margin.ObservePressure(0, now.Add(time.Hour))
+		Expect(changed).To(BeFalse())
+		expectMargin("100Mi")
+	})
+
+	It("should restart waiting for the shrink if the memory pressure rises again", func() {
+		margin.ObservePressure(15, now)
+		margin.ObservePressure(1, now.Add(time.Minute))
+		margin.ObservePressure(7, now.Add(8*time.Minute))
+
+		_, changed := margin.ObservePressure(1, now.Add(12*time.Minute))
+		Expect(changed).To(BeFalse())
+		expectMargin("200Mi")
+
+		_, changed = margin.ObservePressure(1, now.Add(22*time.Minute))
+		Expect(changed).To(BeTrue())
+		expectMargin("100Mi")
+	})
+
+	It("should not adjust if disabled", func() {
+		margin = memory.NewSafetyMargin(resource.MustParse("100Mi"), resource.MustParse("100Mi"), resource.MustParse("300Mi"), 0)
+		_, changed := margin.ObservePressure(100, now)
+		Expect(changed).To(BeFalse())
+		expectMargin("100Mi")
+	})
+
+	It("should grow permanently on global OOM kills up to the maximum", func() {
+		_, changed := margin.GrowOnOOM()
+		Expect(changed).To(BeTrue())
+		expectMargin("200Mi")
+
+		// the increase is kept without memory pressure
+		_, changed = margin.ObservePressure(0, now.Add(time.Hour))
+		Expect(changed).To(BeFalse())
+		expectMargin("200Mi")
+
+		margin.GrowOnOOM()
+		_, changed = margin.GrowOnOOM()
+		Expect(changed).To(BeFalse())
+		expectMargin("300Mi")
+	})
+
+	It("should limit the increase due to memory pressure first", func() {
+		margin.ObservePressure(15, now)
+		expectMargin("200Mi")
+
+		margin.GrowOnOOM()
+		margin.GrowOnOOM()
+		expectMargin("300Mi")
+
+		// the memory pressure increase has been limited, the OOM increase is kept
+		_, changed := margin.ObservePressure(0, now.Add(time.Hour))
+		Expect(changed).To(BeFalse())
+		expectMargin("300Mi")
+	})
+})
+
+var _ = Describe("adaptive SafetyMargin", func() {
+	var (
+		strategy memory.MarginStrategy
+		now      time.Time
+	)
+
+	BeforeEach(func() {
+		strategy = memory.MarginStrategy{
+			Absolute:         resource.MustParse("100Mi"),
+			Percent:          1,
+			StdDevMultiplier: 2,
+			StdDevWindow:     time.Hour,
+		}
+		now = time.Now()
+	})
+
+	expectMargin := func(margin resource.Quantity, expected string) {
+		Expect(margin.Cmp(resource.MustParse(expected))).To(Equal(0), "margin is %s", margin.String())
+	}
+
+	It("should calculate the margin in percent of the capacity", func() {
+		strategy.Strategies = []string{memory.MarginStrategyPercent}
+		margin := memory.NewAdaptiveSafetyMargin(strategy, resource.MustParse("100Mi"), resource.MustParse("10Gi"), 10)
+		expectMargin(margin.Get(), "0")
+
+		value, changed := margin.ObserveNonPodMemory(resource.MustParse("1Gi"), resource.MustParse("100Gi"), now)
+		Expect(changed).To(BeTrue())
+		expectMargin(value, "1Gi")
+	})
+
+	It("should calculate the margin as a multiple of the standard deviation of the non-pod memory within the window", func() {
+		strategy.Strategies = []string{memory.MarginStrategyStdDev}
+		margin := memory.NewAdaptiveSafetyMargin(strategy, resource.MustParse("100Mi"), resource.MustParse("10Gi"), 10)
+
+		// a single sample has no deviation
+		value, _ := margin.ObserveNonPodMemory(resource.MustParse("1Gi"), resource.MustParse("64Gi"), now)
+		expectMargin(value, "0")
+
+		// mean 1.5Gi, standard deviation 512Mi
+		value, _ = margin.ObserveNonPodMemory(resource.MustParse("2Gi"), resource.MustParse("64Gi"), now.Add(time.Minute))
+		expectMargin(value, "1Gi")
+
+		// the first samples are outside of the window
+		margin.ObserveNonPodMemory(resource.MustParse("2Gi"), resource.MustParse("64Gi"), now.Add(90*time.Minute))
+		value, _ = margin.ObserveNonPodMemory(resource.MustParse("2Gi"), resource.MustParse("64Gi"), now.Add(100*time.Minute))
+		expectMargin(value, "0")
+	})
+
+	It("should use the maximum of several strategies", func() {
+		strategy.Strategies = []string{memory.MarginStrategyAbsolute, memory.MarginStrategyPercent, memory.MarginStrategyStdDev}
+		margin := memory.NewAdaptiveSafetyMargin(strategy, resource.MustParse("100Mi"), resource.MustParse("10Gi"), 10)
+		expectMargin(margin.Get(), "100Mi")
+
+		// 1% of 4Gi is lower than the absolute margin
+		value, _ := margin.ObserveNonPodMemory(resource.MustParse("1Gi"), resource.MustParse("4Gi"), now)
+		expectMargin(value, "100Mi")
+
+		// 1% of 100Gi
+		value, _ = margin.ObserveNonPodMemory(resource.MustParse("1Gi"), resource.MustParse("100Gi"), now.Add(time.Minute))
+		expectMargin(value, "1Gi")
+
+		// two standard deviations of 1Gi, 1Gi and 3Gi (~1.89Gi)
+		value, _ = margin.ObserveNonPodMemory(resource.MustParse("3Gi"), resource.MustParse("100Gi"), now.Add(2*time.Minute))
+		Expect(value.Cmp(resource.MustParse("1800Mi"))).To(Equal(1), "margin is %s", value.String())
+		Expect(value.Cmp(resource.MustParse("2Gi"))).To(Equal(-1), "margin is %s", value.String())
+	})
+
+	It("should not exceed the maximum but keep the increase due to global OOM kills", func() {
+		strategy.Strategies = []string{memory.MarginStrategyPercent}
+		margin := memory.NewAdaptiveSafetyMargin(strategy, resource.MustParse("100Mi"), resource.MustParse("1Gi"), 10)
+		margin.GrowOnOOM()
+
+		value, _ := margin.ObserveNonPodMemory(resource.MustParse("1Gi"), resource.MustParse("1000Gi"), now)
+		expectMargin(value, "1Gi")
+
+		// the capacity shrinks (e.g. more pre-allocated hugepages): 1% of 50Gi + one step
+		value, _ = margin.ObserveNonPodMemory(resource.MustParse("1Gi"), resource.MustParse("50Gi"), now.Add(time.Minute))
+		expectMargin(value, "612Mi")
+	})
+
+	It("should not limit the margin without a maximum", func() {
+		strategy.Strategies = []string{memory.MarginStrategyPercent}
+		margin := memory.NewAdaptiveSafetyMargin(strategy, resource.MustParse("100Mi"), resource.Quantity{}, 10)
+		margin.GrowOnOOM()
+
+		// 1% of 512Gi + one step
+		value, _ := margin.ObserveNonPodMemory(resource.MustParse("1Gi"), resource.MustParse("512Gi"), now)
+		Expect(value.Value()).To(Equal(int64(5497558139 + 100*1024*1024)))
+	})
+})
@@ -1,13 +1,20 @@
 package memory
 
 import (
+	"bufio"
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
-	linuxproc "github.com/c9s/goprocinfo/linux"
 	"github.com/containerd/cgroups"
 	cgroupstatsv1 "github.com/containerd/cgroups/stats/v1"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/histogram"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory/util"
 	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
 	"github.com/dustin/go-humanize"
@@ -18,9 +25,39 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+const (
+	// procMemInfo is the file containing the memory statistics of the node
+	procMemInfo = "/proc/meminfo"
+	// cgroupV1MemoryUsage is the name of the cgroupsv1 file containing the current memory usage of a cgroup
+	cgroupV1MemoryUsage = "memory.usage_in_bytes"
+	// CgroupV1MemoryLimit is the name of the cgroupsv1 file containing the (hard) memory limit of a cgroup
+	CgroupV1MemoryLimit = "memory.limit_in_bytes"
+	// cgroupV2MemoryCurrent is the name of the cgroupsv2 file containing the current memory usage of a cgroup
+	cgroupV2MemoryCurrent = "memory.current"
+	// CgroupV2MemoryMax is the name of the cgroupsv2 file containing the (hard) memory limit of a cgroup
+	CgroupV2MemoryMax = "memory.max"
+	// CgroupV2MemoryHigh is the name of the cgroupsv2 file containing the memory throttle limit of a cgroup
+	CgroupV2MemoryHigh = "memory.high"
+	// cgroupV2MemoryEvents is the name of the cgroupsv2 file containing the number of memory events (high, max, oom, ...) of a cgroup
+	cgroupV2MemoryEvents = "memory.events"
+	// CgroupV2MemoryMin is the name of the cgroupsv2 file containing the hard memory protection of a cgroup
+	CgroupV2MemoryMin = "memory.min"
+	// CgroupV2MemoryLow is the name of the cgroupsv2 file containing the best-effort memory protection of a cgroup
+	CgroupV2MemoryLow = "memory.low"
+	// cgroupV2MemoryStat is the name of the cgroupsv2 file containing the memory statistics of a cgroup
+	cgroupV2MemoryStat = "memory.stat"
+	// cgroupV2MemoryStatInactiveFile is the key in the cgroupsv2 memory.stat file for the page cache on the inactive LRU list
+	cgroupV2MemoryStatInactiveFile = "inactive_file"
+)
+
+// HistogramOptions are the bucket options for the history of the target reserved memory (in bytes).
+// Buckets grow by 2 percent starting at 1Mi, up to 1Ti.
+var HistogramOptions = histogram.Options{
+	MaxValue:        1 << 40,
+	FirstBucketSize: 1 << 20,
+	Ratio:           1.02,
+}
 
-// TODO: make work with cgroupsv2 where the location of the memory.stat file changed from  (unified controller hierarchy)
-// cat /sys/fs/cgroup/memory/kubepods/memory.stat  -> cat /sys/fs/cgroup/kubepods/memory.stat
 var (
 	metricCurrentReservedMemoryBytes = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "kubelet_reserved_memory_bytes",
@@ -37,6 +74,11 @@ var (
 		Help: "The target kubelet reserved memory calculated as MemTotal - MemAvailable - memory working set kubepods cgroup",
 	})
 
+	metricTargetReservedMemoryBytesSmoothed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kubelet_target_reserved_memory_bytes_smoothed",
+		Help: "The percentile of the target kubelet reserved memory over the recommendation window",
+	})
+
 	metricTargetReservedMemoryBytesMachineType = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "kubelet_target_reserved_memory_bytes_machine_type",
 		Help: "The target kubelet reserved memory calculated based on the machine type",
@@ -97,6 +139,12 @@ var (
 		Help: "The working set memory of the kubelet cgroup in percent of the total memory",
 	})
 
+	metricKubepodsMemoryEvents = newKernelCounterVec(
+		"node_cgroup_kubepods_memory_events_total",
+		"The number of memory events (low, high, max, oom, oom_kill) of the kubepods cgroup from memory.events (cgroupsv2 only)",
+		"event",
+	)
+
 	metricMemTotal = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "node_memory_MemTotal",
 		Help: "The MemTotal from /proc/meminfo",
@@ -114,70 +162,209 @@ var (
 
 	metricMemUsed = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "node_memory_used",
-		Help: "The not reclaimable memory calculated from /proc/meminfo MemTotal - MemAvailable. (unlike measurement from root memory cgroup)",
+		Help: "The not reclaimable memory calculated from /proc/meminfo MemTotal - MemAvailable - pre-allocated hugepages. (unlike measurement from root memory cgroup)",
 	})
 
 	metricMemUsedPercent = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "node_memory_used_percent",
-		Help: "The not reclaimable memory in percent calculated from /proc/meminfo MemTotal - MemAvailable. (unlike measurement from root memory cgroup)",
+		Help: "The not reclaimable memory in percent calculated from /proc/meminfo MemTotal - MemAvailable - pre-allocated hugepages. (unlike measurement from root memory cgroup)",
 	})
 )
 
+// Recommendation is a memory recommendation
+type Recommendation struct {
+	// TargetKubepodsLimitInBytes is the desired memory limit of the kubepods cgroup
+	TargetKubepodsLimitInBytes resource.Quantity
+	// CurrentKubepodsLimitInBytes is the current memory limit of the kubepods cgroup (at most MemTotal)
+	CurrentKubepodsLimitInBytes resource.Quantity
+	// Capacity is the memory capacity usable as regular memory (MemTotal - pre-allocated hugepages)
+	Capacity resource.Quantity
+	// Reservations is the recommended reservation split across kube-reserved, system-reserved and hard eviction
+	Reservations kubelet.Reservations
+	// SystemSliceWorkingSetBytes is the memory working set of the system.slice cgroup
+	SystemSliceWorkingSetBytes resource.Quantity
+	// KubeletWorkingSetBytes is the memory working set of the kubelet's cgroup
+	KubeletWorkingSetBytes resource.Quantity
+	// ContainerdWorkingSetBytes is the memory working set of the containerd's cgroup
+	ContainerdWorkingSetBytes resource.Quantity
+	// Swap is the swap usage and the swap used by non-pod processes (part of the recommendation)
+	Swap SwapRecommendation
+	// HugePages are the pre-allocated hugepages excluded from the capacity
+	HugePages HugePages
+	// QoS is the working set and memory limit per QoS class. Nil if not available.
+	QoS map[string]QoSMemory
+	// SafetyMargin is the safety margin added to the target reserved memory
+	SafetyMargin resource.Quantity
+	// SafetyMarginChanged is true if the safety margin changed with the observed memory used by non-pod processes
+	SafetyMarginChanged bool
+}
+
 // RecommendReservedMemory recommends a memory reservation for non-pod processes.
-// The recommendation can be split across kube- and system-reserved and hard-eviction.
-func RecommendReservedMemory(log *logrus.Logger, minimumReservedMemory, memorySafetyMarginAbsolute resource.Quantity, cgroupRoot string, containerdMemoryCgroupName string, kubeletMemoryCgroupName string) (resource.Quantity, error) {
-	memTotal, memAvailable, err := ParseProcMemInfo()
+// The recommendation is split across kube- and system-reserved and hard-eviction.
+// The current reservations are read from the given kubelet configuration.
+// The hard eviction threshold for memory.available is taken from the kubelet configuration unless
+// evictionHardMemoryAvailable (absolute or in percent of MemTotal) is set.
+// With cgroupsV2 set, the memory statistics are read from the unified hierarchy instead of the cgroupsv1 memory controller.
+// Every target reserved memory is added to the given history. If smoothing is enabled, the recommendation is
+// based on the percentile of the history instead of the latest sample.
+// The swap used by non-pod processes is part of the memory reservation: it is not available to pods and
+// needs memory once it is swapped in.
+// Pre-allocated hugepages are counted in MemTotal, but not in MemAvailable. They are excluded from the capacity.
+// The working set of every child cgroup of system.slice is recorded, the systemSliceTopUnits largest are shown in the table output.
+// If a peak tracker is given, the non-pod memory covers the (estimated) peak working set of system.slice recorded by the kernel
+// instead of only the sampled working set.
+// Every sample of the memory used by non-pod processes is observed by the safety margin to adapt its base to the capacity
+// and the volatility of the non-pod memory.
+func RecommendReservedMemory(log *logrus.Logger, minimumReservedMemory resource.Quantity, safetyMargin *SafetyMargin, cgroupRoot string, cgroupsV2 bool, kubepodsCgroupName string, containerdMemoryCgroupName string, kubeletMemoryCgroupName string, systemSliceTopUnits int, peaks *PeakTracker, kubeletConfig *kubelet.Configuration, evictionHardMemoryAvailable string, history *histogram.Smoother) (Recommendation, error) {
+	meminfo, err := ParseProcMemInfo()
 	if err != nil {
 		log.Fatalf("fatal error during reconciliation: %v", err)
 	}
+	memTotal, memAvailable, kernelMemory := meminfo.MemTotal, meminfo.MemAvailable, meminfo.Kernel
 
-	kubepodsWorkingSetBytes, err := getMemoryWorkingSet(cgroupRoot, types.DefaultkubepodsCgroupName)
+	// if the hugepages cannot be read, they are counted as used by non-pod processes: the recommendation over-reserves
+	hugePages, err := ReadHugePages(meminfo.HugePages, sysKernelHugePages)
 	if err != nil {
-		return resource.Quantity{}, err
+		log.Warnf("failed to read the pre-allocated hugepages, they are not excluded from the capacity: %v", err)
 	}
 
-	systemSliceWorkingSetBytes, err := getMemoryWorkingSet(cgroupRoot, types.SystemSliceCgroupName)
+	// the capacity usable as regular memory (by pods and non-pod processes)
+	capacity := memTotal.DeepCopy()
+	capacity.Sub(hugePages.Total)
+
+	kubepodsWorkingSetBytes, err := getMemoryWorkingSet(cgroupRoot, kubepodsCgroupName, cgroupsV2)
 	if err != nil {
-		return resource.Quantity{}, err
+		return Recommendation{}, err
 	}
 
-	containerdSliceWorkingSetBytes, dockerSliceWorkingSetBytes, err := getContainerRuntimeWorkingSetBytes(cgroupRoot, containerdMemoryCgroupName)
+	systemSliceWorkingSetBytes, err := getMemoryWorkingSet(cgroupRoot, types.SystemSliceCgroupName, cgroupsV2)
 	if err != nil {
-		return resource.Quantity{}, err
+		return Recommendation{}, err
 	}
 
-	kubeletSliceWorkingSetBytes, err := getMemoryWorkingSet(cgroupRoot, kubeletMemoryCgroupName)
+	containerdSliceWorkingSetBytes, dockerSliceWorkingSetBytes, err := getContainerRuntimeWorkingSetBytes(cgroupRoot, containerdMemoryCgroupName, cgroupsV2)
 	if err != nil {
-		return resource.Quantity{}, err
+		return Recommendation{}, err
 	}
 
-	kubepodsLimitInBytes, err := getMemoryLimitInBytes(cgroupRoot, types.DefaultkubepodsCgroupName)
+	kubeletSliceWorkingSetBytes, err := getMemoryWorkingSet(cgroupRoot, kubeletMemoryCgroupName, cgroupsV2)
 	if err != nil {
-		return resource.Quantity{}, err
+		return Recommendation{}, err
+	}
+
+	kubepodsLimitInBytes, err := getMemoryLimitInBytes(cgroupRoot, kubepodsCgroupName, cgroupsV2)
+	if err != nil {
+		return Recommendation{}, err
+	}
+
+	systemSliceUnits, err := GetSystemSliceUnitsMemory(cgroupRoot, cgroupsV2)
+	if err != nil {
+		log.Warnf("failed to read the memory of the system.slice units: %v", err)
+	}
+	recordSystemSliceUnitsMemory(systemSliceUnits)
+
+	// processes outside of system.slice and kubepods (e.g. user.slice, init.scope) are only implicitly
+	// part of the recommendation via /proc/meminfo
+	kubepodsSiblings, err := GetKubepodsSiblingsMemory(cgroupRoot, cgroupsV2, kubepodsCgroupName)
+	if err != nil {
+		log.Warnf("failed to read the memory of the siblings of the kubepods cgroup: %v", err)
+	}
+	recordKubepodsSiblingsMemory(kubepodsSiblings)
+
+	// the breakdown per QoS class is informational only (e.g. not available with --cgroups-per-qos=false)
+	qos, err := GetQoSMemory(cgroupRoot, cgroupsV2, kubepodsCgroupName, kubepodsWorkingSetBytes, capacity)
+	if err != nil {
+		log.Warnf("failed to read the memory per QoS class: %v", err)
+	}
+	recordQoSMemory(qos)
+
+	if err := recordHugePages(hugePages, cgroupRoot, cgroupsV2, kubepodsCgroupName); err != nil {
+		log.Warnf("failed to record the hugepages: %v", err)
+	}
+
+	if cgroupsV2 {
+		if err := recordKubepodsMemoryEvents(cgroupRoot, kubepodsCgroupName); err != nil {
+			log.Warnf("failed to record the memory events of the kubepods cgroup: %v", err)
+		}
 	}
 
 	// Calculate the reserved memory based on the memory limit on the kubepods cgroup
 	// Memory limit on the kubepods cgroup = Capacity - kube-reserved - system-reserved - hard eviction
 	// To know how the reservation is distributed amongst (kube-reserved,system-reserved,hard eviction),
-	// we would have to read the kubelet configuration
-	currentReservedMemory := memTotal
-	currentReservedMemory.Sub(kubepodsLimitInBytes)
+	// the kubelet configuration is read
+	// without a limit (cgroupsv2: "max"), the kubepods cgroup is effectively limited by the capacity
+	currentKubepodsLimitInBytes := kubepodsLimitInBytes
+	if currentKubepodsLimitInBytes.Cmp(capacity) > 0 {
+		currentKubepodsLimitInBytes = capacity.DeepCopy()
+	}
+	currentReservedMemory := memTotal.DeepCopy()
+	currentReservedMemory.Sub(currentKubepodsLimitInBytes)
+
+	currentReservations, err := kubeletConfig.Reservations(kubelet.ResourceMemory, memTotal)
+	if err != nil {
+		return Recommendation{}, fmt.Errorf("failed to read the memory reservations from the kubelet configuration: %w", err)
+	}
+
+	// the configured override is kept separately to not report it as read from the kubelet configuration
+	var evictionHardOverride *resource.Quantity
+	evictionHard := currentReservations.EvictionHard.DeepCopy()
+	if len(evictionHardMemoryAvailable) > 0 {
+		override, err := kubelet.ParseThreshold(evictionHardMemoryAvailable, memTotal)
+		if err != nil {
+			return Recommendation{}, fmt.Errorf("invalid hard eviction threshold for memory.available: %w", err)
+		}
+		evictionHardOverride = &override
+		evictionHard = override.DeepCopy()
+	}
 
 	// Calculation: target reserved memory =
 	// MemTotal
+	// - pre-allocated hugepages
 	// - MemAvailable
 	// - working_set_bytes of kubepods cgroup
+	// + swap used by non-pod processes (SwapTotal - SwapFree - swap usage of kubepods cgroup)
+	// + (peak working set of system.slice - working set of system.slice), if enabled
 	// + safety margin
-	targetReservedMemory := memTotal
+	targetReservedMemory := capacity.DeepCopy()
 	targetReservedMemory.Sub(memAvailable)
 	currentlyUsedMemory := targetReservedMemory
 	targetReservedMemory.Sub(kubepodsWorkingSetBytes)
-	targetReservedMemory.Add(memorySafetyMarginAbsolute)
+
+	swap, err := recommendReservedSwap(cgroupRoot, cgroupsV2, kubepodsCgroupName, meminfo.SwapTotal, meminfo.SwapFree, currentlyUsedMemory)
+	if err != nil {
+		return Recommendation{}, err
+	}
+	targetReservedMemory.Add(swap.TargetReservedSwap)
+
+	// the memory is sampled every few seconds and misses short spikes. The kernel records the peak of system.slice.
+	// + (peak working set of system.slice - working set of system.slice)
+	var systemSlicePeak *PeakMemory
+	systemSliceReservedWorkingSet := systemSliceWorkingSetBytes.DeepCopy()
+	if peaks != nil {
+		peak, err := GetSystemSlicePeakMemory(peaks, systemSliceWorkingSetBytes, systemSliceUnits, time.Now())
+		if err != nil {
+			log.Warnf("failed to read the memory peak of system.slice. Using the sampled working set: %v", err)
+		} else {
+			systemSlicePeak = &peak
+			peakDelta := peak.WorkingSetBytes.DeepCopy()
+			peakDelta.Sub(systemSliceWorkingSetBytes)
+			targetReservedMemory.Add(peakDelta)
+			systemSliceReservedWorkingSet = peak.WorkingSetBytes.DeepCopy()
+			log.Debugf("System.slice peak memory usage: %q (estimated peak working set: %q)", peak.UsageBytes.String(), peak.WorkingSetBytes.String())
+		}
+	}
 
 	log.Debugf("Available memory from /proc/mem: %q (%d percent)", memAvailable.String(), int64(math.Round(float64(memAvailable.Value())/float64(memTotal.Value())*100)))
 	log.Debugf("Used memory: %q (%d percent)", currentlyUsedMemory.String(), int64(math.Round(float64(currentlyUsedMemory.Value())/float64(memTotal.Value())*100)))
 	log.Debugf("Kubepods working set memory: %q (%d percent)", kubepodsWorkingSetBytes.String(), int64(math.Round(float64(kubepodsWorkingSetBytes.Value())/float64(memTotal.Value())*100)))
 	log.Debugf("System.slice working set memory: %q (%d percent)", systemSliceWorkingSetBytes.String(), int64(math.Round(float64(systemSliceWorkingSetBytes.Value())/float64(memTotal.Value())*100)))
+	for _, qosClass := range kubelet.QoSClasses {
+		if qosMemory, ok := qos[qosClass]; ok {
+			log.Debugf("Kubepods %s working set memory: %q (limit: %q)", qosClass, qosMemory.WorkingSetBytes.String(), qosMemory.LimitInBytes.String())
+		}
+	}
+	log.Debugf("Pre-allocated hugepages: %q", hugePages.Total.String())
+	log.Debugf("Used swap: %q of %q (kubepods: %q, system.slice: %q)", swap.Used.String(), swap.Total.String(), swap.KubepodsUsage.String(), swap.SystemSliceUsage.String())
 
 	// record prometheus metrics
 	metricMemAvailable.Set(float64(memAvailable.Value()))
@@ -197,7 +384,7 @@ func RecommendReservedMemory(log *logrus.Logger, minimumReservedMemory, memorySa
 	metricCurrentReservedMemoryBytes.Set(float64(currentReservedMemory.Value()))
 	metricCurrentReservedMemoryPercent.Set(math.Round(float64(currentReservedMemory.Value()) / float64(memTotal.Value()) * 100))
 
-	// in case the target reserved memory is negative, that means that the kubepods cgroup memory working set
+	// in case the target reserved memory (without the safety margin) is negative, that means that the kubepods cgroup memory working set
 	// was larger than the OS thinks is even used overall --> cgroupv1 accounting is most likely off
 	// in this case, we rather choose to not report a target reserved memory via metrics.
 	// If desired, the systemSliceWorkingSetBytes can be used as recommended reservation knowing that this will most
@@ -205,9 +392,15 @@ func RecommendReservedMemory(log *logrus.Logger, minimumReservedMemory, memorySa
 	if targetReservedMemory.Value() < 0 {
 		metricTargetReservedMemoryBytes.Set(-1)
 		metricTargetReservedMemoryPercent.Set(0)
-		return resource.Quantity{}, fmt.Errorf("no memory recommendation can be provided. Memory accounting seems to be off. You can use the working set of system.slice instead, though this will most likely over-reserve memory.")
+		return Recommendation{}, fmt.Errorf("no memory recommendation can be provided. Memory accounting seems to be off. You can use the working set of system.slice instead, though this will most likely over-reserve memory.")
 	}
 
+	// the safety margin depends on the capacity and the volatility of the memory used by non-pod processes.
+	// Only valid samples are observed. The sample includes the peak of system.slice (if enabled), as the margin
+	// covers the fluctuation of exactly the reservation it is added to.
+	memorySafetyMargin, safetyMarginChanged := safetyMargin.ObserveNonPodMemory(targetReservedMemory, capacity, time.Now())
+	targetReservedMemory.Add(memorySafetyMargin)
+
 	log.Debugf("Recommended memory reservation: %q (%s, %d percent). Currenlty reserved (kube-reserved + system-reserved): %q (%d percent)",
 		humanize.IBytes(uint64(targetReservedMemory.Value())),
 		targetReservedMemory.String(),
@@ -220,12 +413,53 @@ func RecommendReservedMemory(log *logrus.Logger, minimumReservedMemory, memorySa
 	metricTargetReservedMemoryBytes.Set(float64(targetReservedMemory.Value()))
 	metricTargetReservedMemoryPercent.Set(math.Round(float64(targetReservedMemory.Value()) / float64(memTotal.Value()) * 100))
 
+	// a single sample is prone to spikes. The percentile over the recommendation window is more stable.
+	smoothedTargetReservedMemory := *resource.NewQuantity(int64(history.Smooth(float64(targetReservedMemory.Value()), time.Now())), resource.BinarySI)
+	metricTargetReservedMemoryBytesSmoothed.Set(float64(smoothedTargetReservedMemory.Value()))
+	log.Debugf("Smoothed memory reservation: %q (enabled: %v)", smoothedTargetReservedMemory.String(), history.Enabled())
+
 	targetReservedMachineType, err := util.CalculateReservationBasedOnCapacity(memTotal)
 	if err != nil {
-		return resource.Quantity{}, err
+		return Recommendation{}, err
 	}
 	metricTargetReservedMemoryBytesMachineType.Set(float64(targetReservedMachineType.Value()))
 
+	// the reservation that is recommended (and potentially enforced) is at least the minimum reserved memory
+	recommendedReservedMemory := targetReservedMemory.DeepCopy()
+	if history.Enabled() {
+		recommendedReservedMemory = smoothedTargetReservedMemory.DeepCopy()
+	}
+	if recommendedReservedMemory.Value() < minimumReservedMemory.Value() {
+		recommendedReservedMemory = minimumReservedMemory.DeepCopy()
+	}
+
+	// the working set of system.slice misses the kernel memory. Show how much of the recommended reservation is kernel memory.
+	// The smoothed or minimum reservation may differ from the current sample: the difference is unaccounted.
+	attributedSafetyMargin := memorySafetyMargin.DeepCopy()
+	if attributedSafetyMargin.Cmp(recommendedReservedMemory) > 0 {
+		attributedSafetyMargin = recommendedReservedMemory.DeepCopy()
+	}
+	nonPodMemory := recommendedReservedMemory.DeepCopy()
+	nonPodMemory.Sub(attributedSafetyMargin)
+	attribution := AttributeReservation(nonPodMemory, systemSliceReservedWorkingSet, swap.TargetReservedSwap, kernelMemory, attributedSafetyMargin)
+	recordKernelMemory(kernelMemory, attribution)
+
+	// kube-reserved is meant for the kubernetes system components (kubelet, container runtime).
+	// Use their peak working sets if the peaks are tracked (only for components running in system.slice).
+	kubeletReservedWorkingSet := kubeletSliceWorkingSetBytes.DeepCopy()
+	containerdReservedWorkingSet := containerdSliceWorkingSetBytes.DeepCopy()
+	dockerReservedWorkingSet := dockerSliceWorkingSetBytes.DeepCopy()
+	if systemSlicePeak != nil {
+		kubeletReservedWorkingSet = systemSlicePeak.UnitWorkingSet(kubeletMemoryCgroupName, kubeletSliceWorkingSetBytes)
+		containerdReservedWorkingSet = systemSlicePeak.UnitWorkingSet(containerdMemoryCgroupName, containerdSliceWorkingSetBytes)
+		dockerReservedWorkingSet = systemSlicePeak.UnitWorkingSet(fmt.Sprintf("%s/%s", types.SystemSliceCgroupName, types.DefaultDockerCgroupName), dockerSliceWorkingSetBytes)
+	}
+	kubernetesComponentsWorkingSetBytes := kubeletReservedWorkingSet
+	kubernetesComponentsWorkingSetBytes.Add(containerdReservedWorkingSet)
+	kubernetesComponentsWorkingSetBytes.Add(dockerReservedWorkingSet)
+	targetReservations := splitReservation(recommendedReservedMemory, kubernetesComponentsWorkingSetBytes, evictionHard)
+	kubelet.RecordReservations(kubelet.ResourceMemory, currentReservations, targetReservations)
+
 	logRecommendation(
 		humanize.IBytes(uint64(memAvailable.Value())),
 		int64(math.Round(float64(memAvailable.Value())/float64(memTotal.Value())*100)),
@@ -246,33 +480,94 @@ func RecommendReservedMemory(log *logrus.Logger, minimumReservedMemory, memorySa
 		humanize.IBytes(uint64(targetReservedMemory.Value())),
 		targetReservedMemory.String(),
 		int64(math.Round(float64(targetReservedMemory.Value())/float64(memTotal.Value())*100)),
+		humanize.IBytes(uint64(smoothedTargetReservedMemory.Value())),
+		history.Enabled(),
+		currentReservations,
+		evictionHardOverride,
+		targetReservations,
+		swap,
+		humanize.IBytes(uint64(hugePages.Total.Value())),
+		kernelMemory,
+		attribution,
+		qos,
+		systemSliceUnits,
+		systemSliceTopUnits,
+		kubepodsSiblings,
+		systemSlicePeak,
+		memTotal,
 	)
 
-	if targetReservedMemory.Value() < minimumReservedMemory.Value() {
-		targetReservedMemory = minimumReservedMemory
+	// calculate the desired kubepods memory limit for direct enforcement on the kubepods cgroup
+	// Same as the kubelet: kubepods limit = capacity - kube-reserved - system-reserved - hard eviction threshold
+	// Otherwise, the kubepods limit could be higher than what the kubelet would set and pods could cause a "global" OOM
+	// before the kubelet starts evicting.
+	// Pods cannot use the pre-allocated hugepages as regular memory
+	targetKubepodsLimitInBytes := capacity.DeepCopy()
+	targetKubepodsLimitInBytes.Sub(recommendedReservedMemory)
+	targetKubepodsLimitInBytes.Sub(targetReservations.EvictionHard)
+	if targetKubepodsLimitInBytes.Value() <= 0 {
+		return Recommendation{}, fmt.Errorf("the recommended reservation (%s) and the hard eviction threshold (%s) exceed the memory capacity (%s)", recommendedReservedMemory.String(), targetReservations.EvictionHard.String(), capacity.String())
+	}
+	log.Debugf("Target kubepods memory limit: %q (reserved: %q, hard eviction threshold: %q)", targetKubepodsLimitInBytes.String(), recommendedReservedMemory.String(), targetReservations.EvictionHard.String())
+
+	// the kubelet limits the burstable and besteffort cgroups based on the memory requests and --qos-reserved.
+	// A QoS limit above the kubepods limit is ineffective: the kubepods limit applies first.
+	for _, qosClass := range []string{kubelet.QoSBurstable, kubelet.QoSBestEffort} {
+		if qosMemory, ok := qos[qosClass]; ok && qosMemory.LimitInBytes.Cmp(capacity) < 0 && qosMemory.LimitInBytes.Cmp(targetKubepodsLimitInBytes) > 0 {
+			log.Debugf("The memory limit of the %s QoS class (%q) exceeds the target kubepods memory limit (%q)", qosClass, qosMemory.LimitInBytes.String(), targetKubepodsLimitInBytes.String())
+		}
 	}
 
-	// calculate the desired kubepods memory limit for direct enforcement on the kubepods cgroup
-	targetKubepodsLimitInBytes := memTotal
-	targetKubepodsLimitInBytes.Sub(targetReservedMemory)
+	return Recommendation{
+		TargetKubepodsLimitInBytes:  targetKubepodsLimitInBytes,
+		CurrentKubepodsLimitInBytes: currentKubepodsLimitInBytes,
+		Capacity:                    capacity,
+		Reservations:                targetReservations,
+		SystemSliceWorkingSetBytes:  systemSliceWorkingSetBytes,
+		KubeletWorkingSetBytes:      kubeletSliceWorkingSetBytes,
+		ContainerdWorkingSetBytes:   containerdSliceWorkingSetBytes,
+		Swap:                        swap,
+		HugePages:                   hugePages,
+		QoS:                         qos,
+		SafetyMargin:                memorySafetyMargin,
+		SafetyMarginChanged:         safetyMarginChanged,
+	}, nil
+}
+
+// splitReservation splits the recommended reservation into kube-reserved and system-reserved.
+// kube-reserved is set to the (peak) memory working set of the kubernetes components (kubelet, container runtime).
+// The remaining reservation (other system daemons, kernel) is assigned to system-reserved.
+// The hard eviction threshold is not changed.
+func splitReservation(reservedMemory, kubernetesComponentsWorkingSetBytes, evictionHard resource.Quantity) kubelet.Reservations {
+	kubeReserved := kubernetesComponentsWorkingSetBytes.DeepCopy()
+	if kubeReserved.Cmp(reservedMemory) > 0 {
+		kubeReserved = reservedMemory.DeepCopy()
+	}
+
+	systemReserved := reservedMemory.DeepCopy()
+	systemReserved.Sub(kubeReserved)
 
-	return targetKubepodsLimitInBytes, nil
+	return kubelet.Reservations{
+		KubeReserved:   kubeReserved,
+		SystemReserved: systemReserved,
+		EvictionHard:   evictionHard.DeepCopy(),
+	}
 }
 
-func getContainerRuntimeWorkingSetBytes(cgroupRoot string, containerdMemoryCgroupName string) (resource.Quantity, resource.Quantity, error) {
+func getContainerRuntimeWorkingSetBytes(cgroupRoot string, containerdMemoryCgroupName string, cgroupsV2 bool) (resource.Quantity, resource.Quantity, error) {
 	var (
 		containerdSliceWorkingSetBytes resource.Quantity
-		dockerSliceWorkingSetBytes resource.Quantity
-		err error
+		dockerSliceWorkingSetBytes     resource.Quantity
+		err                            error
 	)
 
-	containerdSliceWorkingSetBytes, err = getMemoryWorkingSet(cgroupRoot, containerdMemoryCgroupName)
+	containerdSliceWorkingSetBytes, err = getMemoryWorkingSet(cgroupRoot, containerdMemoryCgroupName, cgroupsV2)
 	if err != nil {
 		// this can be the cae if the node uses only docker as the container runtime
 		containerdSliceWorkingSetBytes = resource.Quantity{}
 	}
 
-	dockerSliceWorkingSetBytes, err = getMemoryWorkingSet(cgroupRoot, fmt.Sprintf("%s/%s", types.SystemSliceCgroupName, types.DefaultDockerCgroupName))
+	dockerSliceWorkingSetBytes, err = getMemoryWorkingSet(cgroupRoot, fmt.Sprintf("%s/%s", types.SystemSliceCgroupName, types.DefaultDockerCgroupName), cgroupsV2)
 	if err != nil {
 		dockerSliceWorkingSetBytes = resource.Quantity{}
 	}
@@ -299,35 +594,138 @@ func logRecommendation(
 	currentReservedMemoryPercentTotal int64,
 	targetReservedMemory string,
 	targetReservedMemoryPrecise string,
-	targetReservedMemoryPercentTotal int64) {
+	targetReservedMemoryPercentTotal int64,
+	smoothedTargetReservedMemory string,
+	smoothingEnabled bool,
+	currentReservations kubelet.Reservations,
+	evictionHardOverride *resource.Quantity,
+	targetReservations kubelet.Reservations,
+	swap SwapRecommendation,
+	hugePages string,
+	kernelMemory KernelMemory,
+	attribution ReservationAttribution,
+	qos map[string]QoSMemory,
+	systemSliceUnits []UnitMemory,
+	systemSliceTopUnits int,
+	kubepodsSiblings []UnitMemory,
+	systemSlicePeak *PeakMemory,
+	memTotal resource.Quantity) {
+	kernelUnreclaimable := kernelMemory.Unreclaimable()
+
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
 	t.AppendHeader(table.Row{"Memory Metric", "Value"})
 
 	t.AppendRows([]table.Row{
 		{"Available (/proc/mem)", fmt.Sprintf("%s (%d%%)", availableMemoryProcMem, availableMemoryProcMemPercentTotal)},
-		{"Used (Capacity - Available)", fmt.Sprintf("%s (%d%%)", usedMemoryProcMem, usedMemoryProcMemPercentTotal)},
+		{"Hugepages (pre-allocated)", hugePages},
+		{"Used (Capacity - Hugepages - Available)", fmt.Sprintf("%s (%d%%)", usedMemoryProcMem, usedMemoryProcMemPercentTotal)},
 		{"Kubepods working set", fmt.Sprintf("%s (%d%%)", kubepodsWorkingSet, kubepodsWorkingSetPercentTotal)},
+	})
+
+	for _, qosClass := range kubelet.QoSClasses {
+		qosMemory, ok := qos[qosClass]
+		if !ok {
+			continue
+		}
+		t.AppendRow(table.Row{fmt.Sprintf(" - %s working set (limit)", qosClass), fmt.Sprintf("%s (%d%%) (%s)",
+			humanize.IBytes(uint64(qosMemory.WorkingSetBytes.Value())),
+			int64(math.Round(float64(qosMemory.WorkingSetBytes.Value())/float64(memTotal.Value())*100)),
+			humanize.IBytes(uint64(qosMemory.LimitInBytes.Value())))})
+	}
+
+	t.AppendRows([]table.Row{
 		{"System.slice working set", fmt.Sprintf("%s (%d%%)", systemSliceWorkingSet, systemSliceWorkingSetPercentTotal)},
 		{" - Containerd.slice working set", fmt.Sprintf("%s (%d%%)", containerdServiceWorkingSet, containerdServiceWorkingSetPercentTotal)},
 		{" - Docker.slice working set", fmt.Sprintf("%s (%d%%)", dockerServiceWorkingSet, dockerServiceWorkingSetPercentTotal)},
 		{" - Kubelet.slice working set", fmt.Sprintf("%s (%d%%)", kubeletServiceWorkingSet, kubeletServiceWorkingSetPercentTotal)},
+	})
+
+	if systemSlicePeak != nil {
+		t.AppendRows([]table.Row{
+			{"System.slice peak usage (kernel)", fmt.Sprintf("%s (%d%%)",
+				humanize.IBytes(uint64(systemSlicePeak.UsageBytes.Value())),
+				int64(math.Round(float64(systemSlicePeak.UsageBytes.Value())/float64(memTotal.Value())*100)))},
+			{" - estimated peak working set", fmt.Sprintf("%s (%d%%)",
+				humanize.IBytes(uint64(systemSlicePeak.WorkingSetBytes.Value())),
+				int64(math.Round(float64(systemSlicePeak.WorkingSetBytes.Value())/float64(memTotal.Value())*100)))},
+		})
+	}
+
+	topUnits := systemSliceUnits
+	if len(topUnits) > systemSliceTopUnits {
+		topUnits = topUnits[:systemSliceTopUnits]
+	}
+	if len(topUnits) > 0 {
+		t.AppendRow(table.Row{"Top system.slice units (working set)", fmt.Sprintf("%d of %d units", len(topUnits), len(systemSliceUnits))})
+		for _, unit := range topUnits {
+			t.AppendRow(table.Row{fmt.Sprintf(" - %s", unit.Name), fmt.Sprintf("%s (%d%%)",
+				humanize.IBytes(uint64(unit.WorkingSetBytes.Value())),
+				int64(math.Round(float64(unit.WorkingSetBytes.Value())/float64(memTotal.Value())*100)))})
+		}
+	}
+
+	if len(kubepodsSiblings) > 0 {
+		siblingsWorkingSet := sumWorkingSet(kubepodsSiblings)
+		t.AppendRow(table.Row{"Siblings of kubepods (working set)", fmt.Sprintf("%s (%d%%)",
+			humanize.IBytes(uint64(siblingsWorkingSet.Value())),
+			int64(math.Round(float64(siblingsWorkingSet.Value())/float64(memTotal.Value())*100)))})
+		for _, sibling := range kubepodsSiblings {
+			t.AppendRow(table.Row{fmt.Sprintf(" - %s", sibling.Name), fmt.Sprintf("%s (%d%%)",
+				humanize.IBytes(uint64(sibling.WorkingSetBytes.Value())),
+				int64(math.Round(float64(sibling.WorkingSetBytes.Value())/float64(memTotal.Value())*100)))})
+		}
+	}
+
+	t.AppendRows([]table.Row{
+		{"Swap used (SwapTotal - SwapFree)", fmt.Sprintf("%s of %s", humanize.IBytes(uint64(swap.Used.Value())), humanize.IBytes(uint64(swap.Total.Value())))},
+		{" - Kubepods swap", humanize.IBytes(uint64(swap.KubepodsUsage.Value()))},
+		{" - System.slice swap", humanize.IBytes(uint64(swap.SystemSliceUsage.Value()))},
+		{"Kernel memory (unreclaimable)", humanize.IBytes(uint64(kernelUnreclaimable.Value()))},
+		{" - Slab unreclaimable (SUnreclaim)", humanize.IBytes(uint64(kernelMemory.SlabUnreclaimable.Value()))},
+		{" - PageTables", humanize.IBytes(uint64(kernelMemory.PageTables.Value()))},
+		{" - KernelStack", humanize.IBytes(uint64(kernelMemory.KernelStack.Value()))},
+		{" - VmallocUsed", humanize.IBytes(uint64(kernelMemory.VmallocUsed.Value()))},
+		{" - Percpu", humanize.IBytes(uint64(kernelMemory.Percpu.Value()))},
+		{"Slab reclaimable (SReclaimable)", humanize.IBytes(uint64(kernelMemory.SlabReclaimable.Value()))},
+		{"Shmem", humanize.IBytes(uint64(kernelMemory.Shmem.Value()))},
 		{"Current reservation (kube+system reserved)", fmt.Sprintf("%s (%d%%)", currentReservedMemory, currentReservedMemoryPercentTotal)},
+		{" - kube-reserved (kubelet config)", humanize.IBytes(uint64(currentReservations.KubeReserved.Value()))},
+		{" - system-reserved (kubelet config)", humanize.IBytes(uint64(currentReservations.SystemReserved.Value()))},
+		{" - eviction-hard (kubelet config)", humanize.IBytes(uint64(currentReservations.EvictionHard.Value()))},
 	})
+	if evictionHardOverride != nil {
+		t.AppendRow(table.Row{" - eviction-hard (EVICTION_HARD_MEMORY_AVAILABLE)", humanize.IBytes(uint64(evictionHardOverride.Value()))})
+	}
 
 	t.AppendSeparator()
 	t.AppendRow(table.Row{"RECOMMENDATION", fmt.Sprintf("%s (%s, %d%%)", targetReservedMemory, targetReservedMemoryPrecise, targetReservedMemoryPercentTotal)})
+	t.AppendRows([]table.Row{
+		{" - smoothed", fmt.Sprintf("%s (used: %v)", smoothedTargetReservedMemory, smoothingEnabled)},
+		{" - kube-reserved", humanize.IBytes(uint64(targetReservations.KubeReserved.Value()))},
+		{" - system-reserved", humanize.IBytes(uint64(targetReservations.SystemReserved.Value()))},
+		{" - eviction-hard", humanize.IBytes(uint64(targetReservations.EvictionHard.Value()))},
+		{" - attributed to system.slice", humanize.IBytes(uint64(attribution.SystemSlice.Value()))},
+		{" - attributed to swap", humanize.IBytes(uint64(attribution.Swap.Value()))},
+		{" - attributed to kernel", humanize.IBytes(uint64(attribution.Kernel.Value()))},
+		{" - unaccounted", humanize.IBytes(uint64(attribution.Unaccounted.Value()))},
+		{" - safety margin", humanize.IBytes(uint64(attribution.SafetyMargin.Value()))},
+	})
 	t.Render()
 }
 
 // getMemoryWorkingSet reads the given unit's memory cgroup and calculates
 // the working set bytes
-func getMemoryWorkingSet(cgroupRoot, unit string) (resource.Quantity, error) {
+func getMemoryWorkingSet(cgroupRoot, unit string, cgroupsV2 bool) (resource.Quantity, error) {
+	if cgroupsV2 {
+		return getMemoryWorkingSetV2(cgroupRoot, unit)
+	}
+
 	memoryController := cgroups.NewMemory(cgroupRoot)
 
 	stats := &cgroupstatsv1.Metrics{}
 	if err := memoryController.Stat(unit, stats); err != nil {
-		return resource.Quantity{}, fmt.Errorf("failed to read memory stats for kubepods cgroup: %v", err)
+		return resource.Quantity{}, fmt.Errorf("failed to read memory stats for %s cgroup: %v", unit, err)
 	}
 
 	// https://www.kernel.org/doc/Documentation/cgroup-v1/memory.txt
@@ -342,44 +740,159 @@ func getMemoryWorkingSet(cgroupRoot, unit string) (resource.Quantity, error) {
 	return resource.ParseQuantity(fmt.Sprintf("%d", memoryWorkingSetBytes))
 }
 
-// getMemoryWorkingSet reads the given unit's memory cgroup to return the memory limit in bytes
-func getMemoryLimitInBytes(cgroupRoot, unit string) (resource.Quantity, error) {
+// getMemoryWorkingSetV2 calculates the working set bytes of the given unit from the cgroupsv2 unified hierarchy
+// as memory.current - memory.stat "inactive_file" (same as the kubelet/cAdvisor)
+func getMemoryWorkingSetV2(cgroupRoot, unit string) (resource.Quantity, error) {
+	usage, err := cgroupfs.ReadUint(filepath.Join(cgroupRoot, unit, cgroupV2MemoryCurrent))
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("failed to read memory usage for %s cgroup: %v", unit, err)
+	}
+
+	inactiveFile, err := cgroupfs.ReadFlatKeyed(filepath.Join(cgroupRoot, unit, cgroupV2MemoryStat), cgroupV2MemoryStatInactiveFile)
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("failed to read memory stats for %s cgroup: %v", unit, err)
+	}
+
+	// in cgroupsv2, memory.stat is hierarchical (it includes all descendants, like memory.current), there are no total_* counters.
+	// memory.stat and memory.current are not read atomically: protect against an underflow
+	var memoryWorkingSetBytes uint64
+	if usage > inactiveFile {
+		memoryWorkingSetBytes = usage - inactiveFile
+	}
+	return *resource.NewQuantity(int64(memoryWorkingSetBytes), resource.BinarySI), nil
+}
+
+// recordKubepodsMemoryEvents records the memory events of the kubepods cgroup (cgroupsv2 only) as metrics
+func recordKubepodsMemoryEvents(cgroupRoot, kubepodsCgroupName string) error {
+	events, err := cgroupfs.ReadFlatKeyedAll(filepath.Join(cgroupRoot, kubepodsCgroupName, cgroupV2MemoryEvents))
+	if err != nil {
+		return fmt.Errorf("failed to read memory events for %s cgroup: %v", kubepodsCgroupName, err)
+	}
+
+	for event, count := range events {
+		metricKubepodsMemoryEvents.Set(float64(count), event)
+	}
+	return nil
+}
+
+// GetMemoryWorkingSet reads the current memory working set (usage - inactive_file, same as the kubelet) of the given unit's memory cgroup.
+// Unlike the usage, the working set excludes the inactive page cache the kernel reclaims before OOM killing processes.
+func GetMemoryWorkingSet(cgroupRoot, unit string, cgroupsV2 bool) (resource.Quantity, error) {
+	return getMemoryWorkingSet(cgroupRoot, unit, cgroupsV2)
+}
+
+// getMemoryLimitInBytes reads the given unit's memory cgroup to return the memory limit in bytes
+func getMemoryLimitInBytes(cgroupRoot, unit string, cgroupsV2 bool) (resource.Quantity, error) {
+	if cgroupsV2 {
+		limit, err := cgroupfs.ReadLimit(filepath.Join(cgroupRoot, unit, CgroupV2MemoryMax))
+		if err != nil {
+			return resource.Quantity{}, fmt.Errorf("failed to read memory limit for %s cgroup: %v", unit, err)
+		}
+		return *resource.NewQuantity(limit, resource.BinarySI), nil
+	}
+
 	memoryController := cgroups.NewMemory(cgroupRoot)
 
 	stats := &cgroupstatsv1.Metrics{}
 	if err := memoryController.Stat(unit, stats); err != nil {
-		return resource.Quantity{}, fmt.Errorf("failed to read memory stats for kubepods cgroup: %v", err)
+		return resource.Quantity{}, fmt.Errorf("failed to read memory stats for %s cgroup: %v", unit, err)
 	}
 
-	out := fmt.Sprintf("%d", stats.Memory.Usage.Limit)
-	fmt.Sprintf("memory limit for unit %s is %s", unit, out)
-	return resource.ParseQuantity(out)
+	return resource.ParseQuantity(fmt.Sprintf("%d", stats.Memory.Usage.Limit))
 }
 
-// ParseProcMemInfo parses /proc/meminfo and returns MemTotal, MemAvailable or an error
-func ParseProcMemInfo() (resource.Quantity, resource.Quantity, error) {
-	// meminfo values are given in kiB/kibibytes (1024 bytes) (even though given as "kb")
-	meminfo, err := linuxproc.ReadMemInfo("/proc/meminfo")
+// MemInfo are the memory statistics of the node from /proc/meminfo
+type MemInfo struct {
+	MemTotal     resource.Quantity
+	MemAvailable resource.Quantity
+	SwapTotal    resource.Quantity
+	SwapFree     resource.Quantity
+	Kernel       KernelMemory
+	HugePages    MemInfoHugePages
+}
+
+// ParseProcMemInfo parses /proc/meminfo and returns MemTotal, MemAvailable, the swap, the kernel memory, the hugepages or an error
+func ParseProcMemInfo() (MemInfo, error) {
+	// Percpu is not known to the goprocinfo meminfo parser, hence all fields are read with a single pass over /proc/meminfo
+	meminfo, err := readProcMemInfoFields(procMemInfo, "MemTotal", "MemAvailable", "SwapTotal", "SwapFree",
+		"SReclaimable", "SUnreclaim", "PageTables", "KernelStack", "VmallocUsed", "Percpu", "Shmem",
+		"HugePages_Total", "Hugepagesize", "Hugetlb")
 	if err != nil {
-		return resource.Quantity{}, resource.Quantity{}, fmt.Errorf("failed to read file: /proc/meminfo: %v", err)
+		return MemInfo{}, err
+	}
+
+	hugePages := MemInfoHugePages{
+		Total:    meminfo["HugePages_Total"],
+		PageSize: *resource.NewQuantity(meminfo["Hugepagesize"], resource.BinarySI),
+	}
+	if hugetlb, ok := meminfo["Hugetlb"]; ok {
+		hugePages.Hugetlb = resource.NewQuantity(hugetlb, resource.BinarySI)
 	}
 
 	// for sake of simplicity, expect that "MemAvailable" field is available
 	// alternatively, the available memory (before swapping) could also be calculated from other values in /proc/meminfo.
 	// see here: https://unix.stackexchange.com/questions/261247/how-can-i-get-the-amount-of-available-memory-portably-across-distributions
-	if meminfo.MemAvailable == 0 {
-		return resource.Quantity{}, resource.Quantity{}, fmt.Errorf("MemAvailable field in /proc/meminfo is not set. Please make sure that your Linux kernel includes this commit: https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/commit/?id=34e431b0a")
+	if meminfo["MemAvailable"] == 0 {
+		return MemInfo{}, fmt.Errorf("MemAvailable field in /proc/meminfo is not set. Please make sure that your Linux kernel includes this commit: https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/commit/?id=34e431b0a")
 	}
 
-	memAvailable, err := resource.ParseQuantity(fmt.Sprintf("%dKi", meminfo.MemAvailable))
-	if err != nil {
-		return resource.Quantity{}, resource.Quantity{}, fmt.Errorf("failed to parse MemAvailable field in /proc/meminf (%q) as resource quantity: %v", meminfo.MemAvailable, err)
+	if meminfo["MemTotal"] == 0 {
+		return MemInfo{}, fmt.Errorf("MemTotal field in /proc/meminfo is not set")
 	}
 
-	memTotal, err := resource.ParseQuantity(fmt.Sprintf("%dKi", meminfo.MemTotal))
+	return MemInfo{
+		MemTotal:     *resource.NewQuantity(meminfo["MemTotal"], resource.BinarySI),
+		MemAvailable: *resource.NewQuantity(meminfo["MemAvailable"], resource.BinarySI),
+		SwapTotal:    *resource.NewQuantity(meminfo["SwapTotal"], resource.BinarySI),
+		SwapFree:     *resource.NewQuantity(meminfo["SwapFree"], resource.BinarySI),
+		Kernel: KernelMemory{
+			SlabReclaimable:   *resource.NewQuantity(meminfo["SReclaimable"], resource.BinarySI),
+			SlabUnreclaimable: *resource.NewQuantity(meminfo["SUnreclaim"], resource.BinarySI),
+			PageTables:        *resource.NewQuantity(meminfo["PageTables"], resource.BinarySI),
+			KernelStack:       *resource.NewQuantity(meminfo["KernelStack"], resource.BinarySI),
+			VmallocUsed:       *resource.NewQuantity(meminfo["VmallocUsed"], resource.BinarySI),
+			Percpu:            *resource.NewQuantity(meminfo["Percpu"], resource.BinarySI),
+			Shmem:             *resource.NewQuantity(meminfo["Shmem"], resource.BinarySI),
+		},
+		HugePages: hugePages,
+	}, nil
+}
+
+// readProcMemInfoFields reads the given fields of /proc/meminfo. Sizes are returned in bytes.
+// Fields missing in /proc/meminfo (e.g. on older kernels) are omitted.
+func readProcMemInfoFields(path string, fields ...string) (map[string]int64, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return resource.Quantity{}, resource.Quantity{}, fmt.Errorf("failed to parse MemTotal field in /proc/meminf (%q) as resource quantity: %v", meminfo.MemTotal, err)
+		return nil, fmt.Errorf("failed to read file: %s: %v", path, err)
+	}
+	defer f.Close()
+
+	wanted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		wanted[field] = true
 	}
 
-	return memTotal, memAvailable, nil
+	values := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.Fields(strings.Replace(scanner.Text(), ":", " ", 1))
+		if len(line) < 2 || !wanted[line[0]] {
+			continue
+		}
+
+		value, err := strconv.ParseInt(line[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s field in %s: %v", line[0], path, err)
+		}
+		// sizes are given in kiB (even though given as "kB")
+		if len(line) > 2 && line[2] == "kB" {
+			value *= 1024
+		}
+		values[line[0]] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
 }
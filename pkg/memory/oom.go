@@ -0,0 +1,312 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// OOMScopeGlobal is the scope of an OOM kill caused by the node running out of memory
+	OOMScopeGlobal = "global"
+	// OOMScopeCgroup is the scope of an OOM kill caused by a cgroup reaching its memory limit
+	OOMScopeCgroup = "cgroup"
+	// OOMScopeUnknown is the scope of an OOM kill that cannot be attributed (cgroupsv1 without the kernel log)
+	OOMScopeUnknown = "unknown"
+
+	// kmsgPath is the kernel log device
+	kmsgPath = "/dev/kmsg"
+	// procVMStat is the file containing the kernel's virtual memory statistics
+	procVMStat = "/proc/vmstat"
+	// vmStatOOMKill is the key in /proc/vmstat for the number of OOM kills (global and cgroup)
+	vmStatOOMKill = "oom_kill"
+	// cgroupV1MemoryOOMControl is the name of the cgroupsv1 file containing the OOM state of a cgroup
+	cgroupV1MemoryOOMControl = "memory.oom_control"
+	// cgroupV1MemoryOOMControlOOMKill is the key in the cgroupsv1 memory.oom_control file for the number of OOM kills.
+	// Unlike the cgroupsv2 memory.events, the counter does not include the kills in descendant cgroups (e.g. containers).
+	cgroupV1MemoryOOMControlOOMKill = "oom_kill"
+	// cgroupV2MemoryEventsOOM is the key in the cgroupsv2 memory.events file for the number of times the cgroup reached its memory limit
+	// and the OOM killer was invoked. A single OOM can kill several processes (e.g. with memory.oom.group).
+	cgroupV2MemoryEventsOOM = "oom"
+	// cgroupV2MemoryEventsOOMKill is the key in the cgroupsv2 memory.events file for the number of processes in the cgroup killed
+	// by any OOM killer (global and cgroup)
+	cgroupV2MemoryEventsOOMKill = "oom_kill"
+	// oomPollInterval is the interval in which the OOM counters are read
+	oomPollInterval = time.Second
+	// kmsgMaxRecordSize is the maximum size of a single kernel log record
+	kmsgMaxRecordSize = 8192
+)
+
+var (
+	metricOOMKills = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "node_oom_kills_total",
+		Help: "The number of OOM kills by scope (global: the node ran out of memory, cgroup: a cgroup reached its memory limit, unknown: cannot be attributed)",
+	}, []string{"scope"})
+
+	metricVMStatOOMKill = newKernelCounterVec(
+		"node_vmstat_oom_kill_total",
+		"The number of OOM kills (global and cgroup) from /proc/vmstat",
+	)
+
+	metricCgroupOOMs = newKernelCounterVec(
+		"node_cgroup_memory_oom_total",
+		"The number of times a cgroup reached its memory limit and invoked the OOM killer from memory.events \"oom\" (cgroupsv2 only, including descendant cgroups)",
+		"cgroup",
+	)
+
+	metricCgroupOOMKills = newKernelCounterVec(
+		"node_cgroup_memory_oom_kill_total",
+		"The number of processes of a cgroup killed by the OOM killer from memory.events \"oom_kill\" (cgroupsv2, including descendant cgroups) or memory.oom_control \"oom_kill\" (cgroupsv1, only the cgroup itself)",
+		"cgroup",
+	)
+)
+
+// OOMHandler is called for every OOM kill with its scope and the kernel log message (empty if the kill was detected via the counters)
+type OOMHandler func(scope, message string)
+
+// OOMWatcher watches for OOM kills and attributes them to the global or cgroup scope.
+// The kill messages from the kernel log (/dev/kmsg) are used if readable.
+// Otherwise, on cgroupsv2, the kills counted in /proc/vmstat that are not explained by kills in the watched cgroups during their own OOMs
+// are attributed to the global scope.
+// On cgroupsv1, the OOMs of the watched cgroups do not include the kills of their descendants (e.g. containers below kubepods),
+// hence the kills counted in /proc/vmstat are attributed to the unknown scope.
+type OOMWatcher struct {
+	log         *logrus.Logger
+	cgroupRoot  string
+	cgroupsV2   bool
+	cgroupNames []string
+	handler     OOMHandler
+	// kmsg is 1 while the kill messages from the kernel log are used to attribute the kills.
+	// Accessed atomically as it is cleared once reading the kernel log stopped.
+	kmsg int32
+
+	// vmStatPath is the path of /proc/vmstat
+	vmStatPath string
+
+	initialized  bool
+	lastOOMKills uint64
+	// lastCgroupOOMs are the OOM counters of the previous poll by cgroup
+	lastCgroupOOMs map[string]cgroupOOMs
+}
+
+// cgroupOOMs are the OOM counters of a cgroup
+type cgroupOOMs struct {
+	// ooms is the number of times the cgroup reached its memory limit and invoked the OOM killer (cgroupsv2 only)
+	ooms uint64
+	// kills is the number of processes of the cgroup killed by the OOM killer
+	kills uint64
+}
+
+// NewOOMWatcher returns a new OOMWatcher calling the handler for every OOM kill.
+// The OOMs of the given cgroups (e.g. kubepods and system.slice) are exported and,
+// if the kernel log is not readable, used to tell cgroup OOM kills from global OOM kills.
+func NewOOMWatcher(log *logrus.Logger, cgroupRoot string, cgroupsV2 bool, handler OOMHandler, cgroupNames ...string) *OOMWatcher {
+	return &OOMWatcher{
+		log:         log,
+		cgroupRoot:  cgroupRoot,
+		cgroupsV2:   cgroupsV2,
+		cgroupNames: cgroupNames,
+		handler:     handler,
+		vmStatPath:  procVMStat,
+	}
+}
+
+// Run watches for OOM kills until stop is closed
+func (w *OOMWatcher) Run(stop <-chan struct{}) {
+	kmsg, err := os.Open(kmsgPath)
+	if err == nil {
+		// only watch for new messages
+		_, err = kmsg.Seek(0, io.SeekEnd)
+		if err != nil {
+			kmsg.Close()
+			kmsg = nil
+		}
+	}
+
+	switch {
+	case err != nil && w.cgroupsV2:
+		w.log.Warnf("Failed to read the kernel log. OOM kills are attributed based on %s and the OOMs of the cgroups %v: %v", procVMStat, w.cgroupNames, err)
+	case err != nil:
+		w.log.Warnf("Failed to read the kernel log. OOM kills counted in %s cannot be attributed on cgroupsv1 and are not considered global: %v", procVMStat, err)
+	default:
+		atomic.StoreInt32(&w.kmsg, 1)
+		go w.watchKmsg(kmsg)
+	}
+
+	ticker := time.NewTicker(oomPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(); err != nil {
+			w.log.Warnf("Failed to read the OOM counters: %v", err)
+		}
+
+		select {
+		case <-stop:
+			if kmsg != nil {
+				// unblocks the pending read
+				kmsg.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchKmsg reads the kernel log and handles the OOM kill messages.
+// Once reading the kernel log stopped, the kills are attributed based on the counters again.
+func (w *OOMWatcher) watchKmsg(kmsg *os.File) {
+	defer kmsg.Close()
+	defer atomic.StoreInt32(&w.kmsg, 0)
+
+	// each read returns a single record
+	buf := make([]byte, kmsgMaxRecordSize)
+	for {
+		n, err := kmsg.Read(buf)
+		if errors.Is(err, syscall.EPIPE) {
+			// records were overwritten before they have been read
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.log.Warnf("Stopped reading the kernel log: %v", err)
+			}
+			return
+		}
+
+		message := ParseKmsgRecord(string(buf[:n]))
+		if scope, ok := ParseOOMKill(message); ok {
+			w.handle(scope, message)
+		}
+	}
+}
+
+// poll reads the OOM counters and exports them.
+// If the kernel log is not used, new kills are attributed based on the counters.
+func (w *OOMWatcher) poll() error {
+	oomKills, err := cgroupfs.ReadFlatKeyed(w.vmStatPath, vmStatOOMKill)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", w.vmStatPath, err)
+	}
+	metricVMStatOOMKill.Set(float64(oomKills))
+
+	counters := make(map[string]cgroupOOMs, len(w.cgroupNames))
+	for _, name := range w.cgroupNames {
+		ooms, err := w.readCgroupOOMs(name)
+		if err != nil {
+			return err
+		}
+		if w.cgroupsV2 {
+			metricCgroupOOMs.Set(float64(ooms.ooms), name)
+		}
+		metricCgroupOOMKills.Set(float64(ooms.kills), name)
+		counters[name] = ooms
+	}
+
+	defer func() {
+		w.initialized = true
+		w.lastOOMKills = oomKills
+		w.lastCgroupOOMs = counters
+	}()
+
+	if !w.initialized || atomic.LoadInt32(&w.kmsg) == 1 {
+		return nil
+	}
+
+	newOOMKills := delta(oomKills, w.lastOOMKills)
+	if !w.cgroupsV2 {
+		// a kill below the watched cgroups would be attributed to the global scope
+		for i := uint64(0); i < newOOMKills; i++ {
+			w.handle(OOMScopeUnknown, "")
+		}
+		return nil
+	}
+
+	// oom_kill counts the kills of the processes in a cgroup by any OOM killer, including global OOMs.
+	// The kills are only attributed to the cgroup if the cgroup invoked the OOM killer itself in the meantime.
+	var newCgroupKills uint64
+	for name, current := range counters {
+		last := w.lastCgroupOOMs[name]
+		if delta(current.ooms, last.ooms) > 0 {
+			newCgroupKills += delta(current.kills, last.kills)
+		}
+	}
+	if newCgroupKills > newOOMKills {
+		newCgroupKills = newOOMKills
+	}
+
+	for i := uint64(0); i < newCgroupKills; i++ {
+		w.handle(OOMScopeCgroup, "")
+	}
+	for i := uint64(0); i < newOOMKills-newCgroupKills; i++ {
+		w.handle(OOMScopeGlobal, "")
+	}
+	return nil
+}
+
+// readCgroupOOMs reads the OOM counters of the given cgroup
+func (w *OOMWatcher) readCgroupOOMs(name string) (cgroupOOMs, error) {
+	if !w.cgroupsV2 {
+		kills, err := cgroupfs.ReadFlatKeyed(filepath.Join(w.cgroupRoot, string(cgroups.Memory), name, cgroupV1MemoryOOMControl), cgroupV1MemoryOOMControlOOMKill)
+		if err != nil {
+			return cgroupOOMs{}, fmt.Errorf("failed to read the OOM kills of the %s cgroup: %w", name, err)
+		}
+		return cgroupOOMs{kills: kills}, nil
+	}
+
+	events, err := cgroupfs.ReadFlatKeyedAll(filepath.Join(w.cgroupRoot, name, cgroupV2MemoryEvents))
+	if err != nil {
+		return cgroupOOMs{}, fmt.Errorf("failed to read the OOMs of the %s cgroup: %w", name, err)
+	}
+	return cgroupOOMs{ooms: events[cgroupV2MemoryEventsOOM], kills: events[cgroupV2MemoryEventsOOMKill]}, nil
+}
+
+func (w *OOMWatcher) handle(scope, message string) {
+	metricOOMKills.WithLabelValues(scope).Inc()
+	w.handler(scope, message)
+}
+
+// delta returns the increase of a counter. A reset counter (e.g. a re-created cgroup) counts from 0.
+func delta(current, last uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// ParseKmsgRecord returns the message of a /dev/kmsg record ("<priority>,<sequence>,<timestamp>,<flags>;<message>")
+func ParseKmsgRecord(record string) string {
+	if i := strings.IndexByte(record, ';'); i >= 0 {
+		record = record[i+1:]
+	}
+
+	// continuation lines (" KEY=value") follow the message
+	if i := strings.IndexByte(record, '\n'); i >= 0 {
+		record = record[:i]
+	}
+	return record
+}
+
+// ParseOOMKill determines if the given kernel log message reports an OOM kill and returns its scope.
+// The kernel logs exactly one "[Memory cgroup ]Out of memory: Kill[ed] process" message per OOM kill.
+func ParseOOMKill(message string) (string, bool) {
+	switch {
+	case strings.HasPrefix(message, "Memory cgroup out of memory: Kill"):
+		return OOMScopeCgroup, true
+	case strings.HasPrefix(message, "Out of memory") && strings.Contains(message, ": Kill"):
+		// includes "Out of memory (oom_kill_allocating_task): Kill..."
+		return OOMScopeGlobal, true
+	}
+	return "", false
+}
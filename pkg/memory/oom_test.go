@@ -0,0 +1,110 @@
+package memory_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("OOM", func() {
+	It("should parse kernel log records", func() {
+		Expect(memory.ParseKmsgRecord("3,1234,5678901,-;Out of memory: Killed process 4242 (stress) total-vm:1052516kB\n SUBSYSTEM=memory\n")).
+			To(Equal("Out of memory: Killed process 4242 (stress) total-vm:1052516kB"))
+		Expect(memory.ParseKmsgRecord("6,1,2,-;hello\n")).To(Equal("hello"))
+	})
+
+	It("should attribute global OOM kills", func() {
+		scope, ok := memory.ParseOOMKill("Out of memory: Killed process 4242 (stress) total-vm:1052516kB, anon-rss:1048576kB")
+		Expect(ok).To(BeTrue())
+		Expect(scope).To(Equal(memory.OOMScopeGlobal))
+
+		// older kernels
+		scope, ok = memory.ParseOOMKill("Out of memory: Kill process 4242 (stress) score 999 or sacrifice child")
+		Expect(ok).To(BeTrue())
+		Expect(scope).To(Equal(memory.OOMScopeGlobal))
+
+		scope, ok = memory.ParseOOMKill("Out of memory (oom_kill_allocating_task): Killed process 4242 (stress)")
+		Expect(ok).To(BeTrue())
+		Expect(scope).To(Equal(memory.OOMScopeGlobal))
+	})
+
+	It("should attribute cgroup OOM kills", func() {
+		scope, ok := memory.ParseOOMKill("Memory cgroup out of memory: Killed process 4242 (stress) total-vm:1052516kB")
+		Expect(ok).To(BeTrue())
+		Expect(scope).To(Equal(memory.OOMScopeCgroup))
+	})
+
+	It("should ignore other messages", func() {
+		for _, message := range []string{
+			"stress invoked oom-killer: gfp_mask=0xcc0(GFP_KERNEL), order=0, oom_score_adj=0",
+			"oom-kill:constraint=CONSTRAINT_NONE,nodemask=(null),task=stress,pid=4242,uid=0",
+			"Killed process 4242 (stress) total-vm:1052516kB",
+			"oom_reaper: reaped process 4242 (stress), now anon-rss:0kB",
+		} {
+			_, ok := memory.ParseOOMKill(message)
+			Expect(ok).To(BeFalse(), message)
+		}
+	})
+})
+
+var _ = Describe("OOMWatcher", func() {
+	var (
+		cgroupRoot string
+		vmStat     string
+		scopes     []string
+		watcher    *memory.OOMWatcher
+	)
+
+	writeCounters := func(vmStatOOMKill, kubepodsOOM, kubepodsOOMKill int) {
+		Expect(ioutil.WriteFile(vmStat, []byte(fmt.Sprintf("pgfault 100\noom_kill %d\n", vmStatOOMKill)), 0644)).To(Succeed())
+		events := fmt.Sprintf("low 0\nhigh 0\nmax 5\noom %d\noom_kill %d\n", kubepodsOOM, kubepodsOOMKill)
+		Expect(ioutil.WriteFile(filepath.Join(cgroupRoot, "kubepods.slice", "memory.events"), []byte(events), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		cgroupRoot, err = ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(cgroupRoot, "kubepods.slice"), 0755)).To(Succeed())
+		vmStat = filepath.Join(cgroupRoot, "vmstat")
+
+		scopes = nil
+		watcher = memory.NewOOMWatcher(logrus.New(), cgroupRoot, true, func(scope, _ string) {
+			scopes = append(scopes, scope)
+		}, "kubepods.slice")
+
+		writeCounters(2, 1, 1)
+		Expect(memory.PollOOMCounters(watcher, vmStat)).To(Succeed())
+		Expect(scopes).To(BeEmpty())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cgroupRoot)).To(Succeed())
+	})
+
+	It("should attribute all kills of a cgroup OOM to the cgroup scope", func() {
+		// a single cgroup OOM killing three processes (e.g. memory.oom.group)
+		writeCounters(5, 2, 4)
+		Expect(memory.PollOOMCounters(watcher, vmStat)).To(Succeed())
+		Expect(scopes).To(Equal([]string{memory.OOMScopeCgroup, memory.OOMScopeCgroup, memory.OOMScopeCgroup}))
+	})
+
+	It("should attribute kills in a cgroup without a cgroup OOM to the global scope", func() {
+		// a global OOM killing two processes in kubepods
+		writeCounters(4, 1, 3)
+		Expect(memory.PollOOMCounters(watcher, vmStat)).To(Succeed())
+		Expect(scopes).To(Equal([]string{memory.OOMScopeGlobal, memory.OOMScopeGlobal}))
+	})
+
+	It("should attribute the kills not explained by cgroup OOMs to the global scope", func() {
+		writeCounters(6, 2, 3)
+		Expect(memory.PollOOMCounters(watcher, vmStat)).To(Succeed())
+		Expect(scopes).To(Equal([]string{memory.OOMScopeCgroup, memory.OOMScopeCgroup, memory.OOMScopeGlobal, memory.OOMScopeGlobal}))
+	})
+})
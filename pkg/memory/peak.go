@@ -0,0 +1,262 @@
+package memory
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/metrics"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// cgroupV1MemoryMaxUsage is the high-water mark of the memory usage. It is only lowered if a consumer writes 0 to it.
+	cgroupV1MemoryMaxUsage = "memory.max_usage_in_bytes"
+	// cgroupV2MemoryPeak is the high-water mark of the memory usage since the creation of the cgroup
+	cgroupV2MemoryPeak = "memory.peak"
+)
+
+var (
+	metricSystemSlicePeakMemory = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_cgroup_system_slice_memory_peak_bytes",
+		Help: "The peak memory usage (including the page cache) of system.slice in the current and the previous peak window in bytes",
+	})
+
+	metricSystemSlicePeakWorkingSetMemory = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_cgroup_system_slice_memory_peak_working_set_bytes",
+		Help: "The estimated peak working set of system.slice (peak usage minus the current inactive file cache) in bytes",
+	})
+
+	metricSystemSliceUnitPeakMemory = metrics.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_system_slice_unit_memory_peak_bytes",
+		Help: "The peak memory usage (including the page cache) of the child cgroups of system.slice in the current and the previous peak window in bytes",
+	}, "unit")
+)
+
+// PeakMemory is the peak memory of system.slice and its units
+type PeakMemory struct {
+	// UsageBytes is the peak memory usage of system.slice including the page cache
+	UsageBytes resource.Quantity
+	// WorkingSetBytes is the estimated peak working set of system.slice.
+	// The kernel only records the peak usage: the current inactive file cache is subtracted (at least the current working set).
+	WorkingSetBytes resource.Quantity
+	// Units is the estimated peak working set of the system.slice units by cgroup (e.g. system.slice/containerd.service)
+	Units map[string]resource.Quantity
+}
+
+// UnitWorkingSet returns the estimated peak working set of the given cgroup (relative to the hierarchy root) if it is a tracked
+// system.slice unit. Otherwise, the given working set is returned.
+func (p PeakMemory) UnitWorkingSet(cgroupName string, workingSet resource.Quantity) resource.Quantity {
+	if peak, ok := p.Units[strings.Trim(cgroupName, "/")]; ok {
+		return peak.DeepCopy()
+	}
+	return workingSet.DeepCopy()
+}
+
+// CgroupPeak is the peak memory usage of a cgroup
+type CgroupPeak struct {
+	// PeakBytes is the peak memory usage in the current and the previous window in bytes
+	PeakBytes uint64
+	// UsageBytes is the current memory usage in bytes
+	UsageBytes uint64
+}
+
+// cgroupPeak is the state of the peak of a single cgroup
+type cgroupPeak struct {
+	// highWaterMark is the high-water mark recorded by the kernel at the last observation
+	highWaterMark uint64
+	// current is the peak of the current window
+	current uint64
+	// previous is the peak of the previous window
+	previous uint64
+}
+
+// PeakTracker tracks the peak memory usage of cgroups per window.
+// The kernel records the high-water mark of the memory usage (memory.max_usage_in_bytes / memory.peak) and, unlike sampling
+// the memory usage, catches every spike. The high-water marks are never reset: on cgroupsv1, writing to memory.max_usage_in_bytes
+// resets it for all consumers (e.g. cAdvisor's container_memory_max_usage_bytes), on cgroupsv2 resetting memory.peak requires Linux 6.12.
+// Instead, the peak of a window is the maximum of the sampled usages and of the high-water mark whenever it changed within the window.
+// A spike below an earlier high-water mark is hence only covered if it is sampled.
+// To not lower the peak right after a new window started, the peak of a cgroup is the maximum of the current and the previous window.
+// The first window covers the high-water mark since the creation of the cgroup.
+// Not safe for concurrent use.
+type PeakTracker struct {
+	log        *logrus.Logger
+	cgroupRoot string
+	cgroupsV2  bool
+	window     time.Duration
+	// windowStart is the start of the current window
+	windowStart time.Time
+	cgroups     map[string]*cgroupPeak
+}
+
+// NewPeakTracker creates a new PeakTracker starting a new window every window
+func NewPeakTracker(log *logrus.Logger, cgroupRoot string, cgroupsV2 bool, window time.Duration) *PeakTracker {
+	return &PeakTracker{
+		log:        log,
+		cgroupRoot: cgroupRoot,
+		cgroupsV2:  cgroupsV2,
+		window:     window,
+		cgroups:    map[string]*cgroupPeak{},
+	}
+}
+
+// Observe returns the peak memory usage of the given cgroups (relative to the hierarchy root) in the current and the previous
+// window and their current usage. Cgroups that cannot be read are omitted. Cgroups that are no longer observed are forgotten.
+func (t *PeakTracker) Observe(cgroupNames []string, now time.Time) map[string]CgroupPeak {
+	if t.windowStart.IsZero() {
+		t.windowStart = now
+	}
+	newWindow := now.Sub(t.windowStart) >= t.window
+	if newWindow {
+		t.windowStart = now
+	}
+
+	peaks := map[string]CgroupPeak{}
+	observed := map[string]struct{}{}
+	for _, cgroupName := range cgroupNames {
+		observed[cgroupName] = struct{}{}
+
+		highWaterMark, err := t.readHighWaterMark(cgroupName)
+		if err != nil {
+			t.log.Debugf("failed to read the memory high-water mark of the %s cgroup: %v", cgroupName, err)
+			continue
+		}
+
+		usage, err := readMemoryUsage(t.cgroupRoot, cgroupName, t.cgroupsV2)
+		if err != nil {
+			t.log.Debugf("failed to read the memory usage of the %s cgroup: %v", cgroupName, err)
+			continue
+		}
+
+		peak, ok := t.cgroups[cgroupName]
+		switch {
+		case !ok:
+			peak = &cgroupPeak{current: highWaterMark}
+			t.cgroups[cgroupName] = peak
+		case newWindow:
+			peak.previous = peak.current
+			peak.current = 0
+		}
+
+		// the high-water mark changed since the last observation (on cgroupsv1, it may have been reset by another consumer):
+		// the spike happened within the current window
+		if ok && highWaterMark != peak.highWaterMark && highWaterMark > peak.current {
+			peak.current = highWaterMark
+		}
+		if usage > peak.current {
+			peak.current = usage
+		}
+		peak.highWaterMark = highWaterMark
+
+		peaks[cgroupName] = CgroupPeak{PeakBytes: peak.current, UsageBytes: usage}
+		if peak.previous > peak.current {
+			peaks[cgroupName] = CgroupPeak{PeakBytes: peak.previous, UsageBytes: usage}
+		}
+	}
+
+	for cgroupName := range t.cgroups {
+		if _, ok := observed[cgroupName]; !ok {
+			delete(t.cgroups, cgroupName)
+		}
+	}
+	return peaks
+}
+
+// readHighWaterMark reads the high-water mark of the memory usage of the given cgroup in bytes
+func (t *PeakTracker) readHighWaterMark(cgroupName string) (uint64, error) {
+	if t.cgroupsV2 {
+		return cgroupfs.ReadUint(filepath.Join(t.cgroupRoot, cgroupName, cgroupV2MemoryPeak))
+	}
+	return cgroupfs.ReadUint(filepath.Join(t.cgroupRoot, string(cgroups.Memory), cgroupName, cgroupV1MemoryMaxUsage))
+}
+
+// GetSystemSlicePeakMemory observes the peaks of system.slice and the given system.slice units.
+// The peak working sets are estimated from the peak usages given the current working sets.
+func GetSystemSlicePeakMemory(tracker *PeakTracker, systemSliceWorkingSet resource.Quantity, units []UnitMemory, now time.Time) (PeakMemory, error) {
+	cgroupNames := []string{types.SystemSliceCgroupName}
+	for _, unit := range units {
+		cgroupNames = append(cgroupNames, filepath.Join(types.SystemSliceCgroupName, unit.Name))
+	}
+
+	peaks := tracker.Observe(cgroupNames, now)
+	recordSystemSliceUnitsPeakMemory(peaks)
+
+	peak, ok := peaks[types.SystemSliceCgroupName]
+	if !ok {
+		return PeakMemory{}, fmt.Errorf("the memory peak of the %s cgroup is not available", types.SystemSliceCgroupName)
+	}
+
+	peakMemory := PeakMemory{
+		UsageBytes:      *resource.NewQuantity(int64(peak.PeakBytes), resource.BinarySI),
+		WorkingSetBytes: estimatePeakWorkingSet(peak, systemSliceWorkingSet),
+		Units:           make(map[string]resource.Quantity, len(units)),
+	}
+	for _, unit := range units {
+		cgroupName := filepath.Join(types.SystemSliceCgroupName, unit.Name)
+		if unitPeak, ok := peaks[cgroupName]; ok {
+			peakMemory.Units[cgroupName] = estimatePeakWorkingSet(unitPeak, unit.WorkingSetBytes)
+		}
+	}
+
+	metricSystemSlicePeakMemory.Set(float64(peakMemory.UsageBytes.Value()))
+	metricSystemSlicePeakWorkingSetMemory.Set(float64(peakMemory.WorkingSetBytes.Value()))
+	return peakMemory, nil
+}
+
+// estimatePeakWorkingSet estimates the peak working set of a cgroup given its peak and current working set
+func estimatePeakWorkingSet(peak CgroupPeak, workingSet resource.Quantity) resource.Quantity {
+	return PeakWorkingSet(*resource.NewQuantity(int64(peak.PeakBytes), resource.BinarySI), *resource.NewQuantity(int64(peak.UsageBytes), resource.BinarySI), workingSet)
+}
+
+// PeakWorkingSet estimates the peak working set given the peak usage and the current usage and working set.
+// The difference between the current usage and working set (the inactive file cache) is subtracted from the peak usage.
+// The estimate is at least the current working set.
+func PeakWorkingSet(peakUsage, usage, workingSet resource.Quantity) resource.Quantity {
+	inactiveFile := usage.DeepCopy()
+	inactiveFile.Sub(workingSet)
+
+	peakWorkingSet := peakUsage.DeepCopy()
+	if inactiveFile.Sign() > 0 {
+		peakWorkingSet.Sub(inactiveFile)
+	}
+
+	if peakWorkingSet.Cmp(workingSet) < 0 {
+		return workingSet.DeepCopy()
+	}
+	return peakWorkingSet
+}
+
+// recordSystemSliceUnitsPeakMemory records the peak per system.slice unit.
+// Units that no longer exist are removed from the metric.
+func recordSystemSliceUnitsPeakMemory(peaks map[string]CgroupPeak) {
+	unitPeaks := make(map[string]float64, len(peaks))
+	for cgroupName, peak := range peaks {
+		if cgroupName == types.SystemSliceCgroupName {
+			continue
+		}
+		unitPeaks[filepath.Base(cgroupName)] = float64(peak.PeakBytes)
+	}
+	metricSystemSliceUnitPeakMemory.Update(unitPeaks)
+}
+
+// readMemoryUsage reads the current memory usage (including the page cache) of the given cgroup in bytes
+func readMemoryUsage(cgroupRoot, cgroupName string, cgroupsV2 bool) (uint64, error) {
+	path := filepath.Join(cgroupRoot, string(cgroups.Memory), cgroupName, cgroupV1MemoryUsage)
+	if cgroupsV2 {
+		path = filepath.Join(cgroupRoot, cgroupName, cgroupV2MemoryCurrent)
+	}
+
+	usage, err := cgroupfs.ReadUint(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read memory usage for %s cgroup: %v", cgroupName, err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,163 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = Describe("memory peaks", func() {
+	var (
+		cgroupRoot string
+		start      time.Time
+	)
+
+	writePeak := func(path, value string) {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(value), 0644)).To(Succeed())
+	}
+
+	readPeak := func(path string) string {
+		content, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		return string(content)
+	}
+
+	BeforeEach(func() {
+		var err error
+		cgroupRoot, err = ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+		start = time.Now()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cgroupRoot)).To(Succeed())
+	})
+
+	peakOf := func(peaks map[string]memory.CgroupPeak, cgroupName string) uint64 {
+		Expect(peaks).To(HaveKey(cgroupName))
+		return peaks[cgroupName].PeakBytes
+	}
+
+	Context("cgroupsv1", func() {
+		var path, usagePath string
+
+		BeforeEach(func() {
+			path = filepath.Join(cgroupRoot, "memory", "system.slice", "memory.max_usage_in_bytes")
+			usagePath = filepath.Join(cgroupRoot, "memory", "system.slice", "memory.usage_in_bytes")
+			writePeak(path, "5000\n")
+			writePeak(usagePath, "1000\n")
+		})
+
+		It("should track the peak per window without resetting the high-water mark", func() {
+			tracker := memory.NewPeakTracker(logrus.New(), cgroupRoot, false, time.Hour)
+
+			// the first window covers the high-water mark since the creation of the cgroup
+			peaks := tracker.Observe([]string{"system.slice"}, start)
+			Expect(peakOf(peaks, "system.slice")).To(Equal(uint64(5000)))
+			Expect(peaks["system.slice"].UsageBytes).To(Equal(uint64(1000)))
+
+			// a new window started: the peak of the previous window is kept
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(time.Hour)), "system.slice")).To(Equal(uint64(5000)))
+
+			// the usage grew without exceeding the high-water mark
+			writePeak(usagePath, "1500\n")
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(90*time.Minute)), "system.slice")).To(Equal(uint64(5000)))
+
+			// after another window, the peak of the first window is dropped. The unchanged high-water mark is not part of the window.
+			writePeak(usagePath, "1200\n")
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(2*time.Hour)), "system.slice")).To(Equal(uint64(1500)))
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(3*time.Hour)), "system.slice")).To(Equal(uint64(1200)))
+
+			// the high-water mark is never written
+			Expect(readPeak(path)).To(Equal("5000\n"))
+		})
+
+		It("should use the high-water mark after it was reset by another consumer", func() {
+			tracker := memory.NewPeakTracker(logrus.New(), cgroupRoot, false, time.Hour)
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start), "system.slice")).To(Equal(uint64(5000)))
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(time.Hour)), "system.slice")).To(Equal(uint64(5000)))
+
+			// e.g. another consumer wrote 0 and a spike between the samples raised the high-water mark again
+			writePeak(path, "3000\n")
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(90*time.Minute)), "system.slice")).To(Equal(uint64(5000)))
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(2*time.Hour)), "system.slice")).To(Equal(uint64(3000)))
+		})
+
+		It("should omit cgroups that do not exist", func() {
+			tracker := memory.NewPeakTracker(logrus.New(), cgroupRoot, false, time.Hour)
+			peaks := tracker.Observe([]string{"system.slice", "system.slice/stopped.service"}, start)
+			Expect(peaks).To(HaveLen(1))
+			Expect(peaks).To(HaveKey("system.slice"))
+		})
+	})
+
+	Context("cgroupsv2", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(cgroupRoot, "system.slice", "memory.peak")
+			writePeak(path, "5000\n")
+			writePeak(filepath.Join(cgroupRoot, "system.slice", "memory.current"), "1000\n")
+		})
+
+		It("should cover a spike between the samples once the high-water mark rose", func() {
+			tracker := memory.NewPeakTracker(logrus.New(), cgroupRoot, true, time.Hour)
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start), "system.slice")).To(Equal(uint64(5000)))
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(time.Hour)), "system.slice")).To(Equal(uint64(5000)))
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(2*time.Hour)), "system.slice")).To(Equal(uint64(1000)))
+
+			writePeak(path, "7000\n")
+			Expect(peakOf(tracker.Observe([]string{"system.slice"}, start.Add(150*time.Minute)), "system.slice")).To(Equal(uint64(7000)))
+			Expect(readPeak(path)).To(Equal("7000\n"))
+		})
+
+		It("should estimate the peak working sets of system.slice and its units", func() {
+			writePeak(filepath.Join(cgroupRoot, "system.slice", "kubelet.service", "memory.peak"), "3000\n")
+			writePeak(filepath.Join(cgroupRoot, "system.slice", "kubelet.service", "memory.current"), "800\n")
+
+			tracker := memory.NewPeakTracker(logrus.New(), cgroupRoot, true, time.Hour)
+			units := []memory.UnitMemory{
+				{Name: "kubelet.service", WorkingSetBytes: resource.MustParse("600")},
+				{Name: "stopped.service", WorkingSetBytes: resource.MustParse("100")},
+			}
+			peak, err := memory.GetSystemSlicePeakMemory(tracker, resource.MustParse("900"), units, start)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(peak.UsageBytes.Value()).To(Equal(int64(5000)))
+			// 100 bytes of inactive file cache
+			Expect(peak.WorkingSetBytes.Value()).To(Equal(int64(4900)))
+			// 200 bytes of inactive file cache
+			Expect(peak.Units).To(HaveLen(1))
+			kubelet := peak.UnitWorkingSet("/system.slice/kubelet.service", resource.MustParse("600"))
+			Expect(kubelet.Value()).To(Equal(int64(2800)))
+
+			// cgroups outside of the tracked units use the given working set
+			containerd := peak.UnitWorkingSet("system.slice/containerd.service", resource.MustParse("400"))
+			Expect(containerd.Value()).To(Equal(int64(400)))
+		})
+
+		It("should fail if the peak of system.slice is not available", func() {
+			Expect(os.Remove(path)).To(Succeed())
+			tracker := memory.NewPeakTracker(logrus.New(), cgroupRoot, true, time.Hour)
+			_, err := memory.GetSystemSlicePeakMemory(tracker, resource.MustParse("900"), nil, start)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("should estimate the peak working set", func() {
+		// 300 bytes of inactive file cache
+		peakWorkingSet := memory.PeakWorkingSet(resource.MustParse("5000"), resource.MustParse("1300"), resource.MustParse("1000"))
+		Expect(peakWorkingSet.Value()).To(Equal(int64(4700)))
+
+		// the inactive file cache grew since the peak
+		peakWorkingSet = memory.PeakWorkingSet(resource.MustParse("2000"), resource.MustParse("2500"), resource.MustParse("1000"))
+		Expect(peakWorkingSet.Value()).To(Equal(int64(1000)))
+	})
+})
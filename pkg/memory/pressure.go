@@ -0,0 +1,109 @@
+package memory
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/psi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SystemWidePressure is the cgroup label value of the system-wide memory pressure read from /proc/pressure/memory
+	SystemWidePressure = "/"
+	// triggerWaitTimeout is the maximum time to wait for a memory pressure trigger before checking if the watch should be stopped
+	triggerWaitTimeout = time.Second
+)
+
+var (
+	metricMemoryPressureAvg10 = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_memory_pressure_avg10_percent",
+		Help: "The share of time in percent in which some (or all) tasks were stalled on memory over the last 10 seconds",
+	}, []string{"cgroup", "kind"})
+
+	metricMemoryPressureAvg60 = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_memory_pressure_avg60_percent",
+		Help: "The share of time in percent in which some (or all) tasks were stalled on memory over the last 60 seconds",
+	}, []string{"cgroup", "kind"})
+
+	metricMemoryPressureTotal = newKernelCounterVec(
+		"node_memory_pressure_stalled_seconds_total",
+		"The total time in seconds in which some (or all) tasks were stalled on memory",
+		"cgroup", "kind",
+	)
+
+	metricMemoryPressureTriggers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "node_memory_pressure_triggers_total",
+		Help: "The number of times the memory pressure trigger on /proc/pressure/memory fired",
+	})
+)
+
+// RecordMemoryPressure reads the system-wide memory pressure stall information and (cgroupsv2 only) the one of the given cgroups
+// and records them as metrics.
+// Returns the pressure by cgroup (SystemWidePressure for the system-wide pressure). Cgroups that could not be read are omitted.
+func RecordMemoryPressure(cgroupRoot string, cgroupsV2 bool, cgroupNames ...string) (map[string]psi.Stats, error) {
+	paths := map[string]string{SystemWidePressure: psi.ProcPressureMemory}
+	if cgroupsV2 {
+		// cgroupsv1 does not expose pressure stall information per cgroup
+		for _, name := range cgroupNames {
+			paths[name] = filepath.Join(cgroupRoot, name, psi.CgroupV2MemoryPressure)
+		}
+	}
+
+	pressure := make(map[string]psi.Stats, len(paths))
+	var errs []error
+	for name, path := range paths {
+		stats, err := psi.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		pressure[name] = stats
+		recordPressureLine(name, "some", stats.Some)
+		recordPressureLine(name, "full", stats.Full)
+	}
+
+	if len(errs) > 0 {
+		return pressure, fmt.Errorf("failed to read the memory pressure: %v", errs)
+	}
+	return pressure, nil
+}
+
+func recordPressureLine(cgroup, kind string, line psi.Line) {
+	metricMemoryPressureAvg10.WithLabelValues(cgroup, kind).Set(line.Avg10)
+	metricMemoryPressureAvg60.WithLabelValues(cgroup, kind).Set(line.Avg60)
+	metricMemoryPressureTotal.Set(line.Total.Seconds(), cgroup, kind)
+}
+
+// WatchMemoryPressure waits for the given memory pressure trigger to fire and notifies the given channel until stop is closed.
+// Notifications are dropped while a previous notification has not been received yet.
+func WatchMemoryPressure(log *logrus.Logger, trigger *psi.Trigger, notify chan<- struct{}, stop <-chan struct{}) {
+	defer trigger.Close()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		fired, err := trigger.Wait(triggerWaitTimeout)
+		if err != nil {
+			log.Warnf("Stopped watching the memory pressure: %v", err)
+			return
+		}
+		if !fired {
+			continue
+		}
+
+		metricMemoryPressureTriggers.Inc()
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/psi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var _ = Describe("RecordMemoryPressure", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pressure")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(os.MkdirAll(filepath.Join(dir, "system.slice"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "system.slice", psi.CgroupV2MemoryPressure), []byte("some avg10=20.00 avg60=12.50 avg300=4.00 total=5000000\nfull avg10=1.00 avg60=0.50 avg300=0.10 total=100000\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should return the memory pressure of the cgroups", func() {
+		pressure, _ := memory.RecordMemoryPressure(dir, true, "system.slice")
+		Expect(pressure).To(HaveKey("system.slice"))
+		Expect(pressure["system.slice"].Some.Avg60).To(Equal(12.5))
+		Expect(pressure["system.slice"].Full.Avg10).To(Equal(1.0))
+	})
+
+	It("should fail for missing pressure files and return the remaining cgroups", func() {
+		pressure, err := memory.RecordMemoryPressure(dir, true, "system.slice", "kubepods.slice")
+		Expect(err).To(HaveOccurred())
+		Expect(pressure).To(HaveKey("system.slice"))
+		Expect(pressure).ToNot(HaveKey("kubepods.slice"))
+	})
+
+	It("should not read the per-cgroup memory pressure on cgroupsv1", func() {
+		pressure, _ := memory.RecordMemoryPressure(dir, false, "system.slice")
+		Expect(pressure).ToNot(HaveKey("system.slice"))
+	})
+})
+
+var _ = Describe("WatchMemoryPressure", func() {
+	var (
+		listener net.Listener
+		sender   net.Conn
+		trigger  *psi.Trigger
+	)
+
+	// Like a registered PSI trigger, a TCP socket signals POLLPRI once out-of-band data is pending.
+	// The receiving socket is used as the trigger's file descriptor.
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+
+		sender, err = net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+
+		receiver, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer receiver.Close()
+
+		file, err := receiver.(*net.TCPConn).File()
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+
+		fd, err := unix.Dup(int(file.Fd()))
+		Expect(err).ToNot(HaveOccurred())
+		trigger = psi.NewTriggerFromFd(fd)
+	})
+
+	AfterEach(func() {
+		sender.Close()
+		listener.Close()
+	})
+
+	fire := func() {
+		raw, err := sender.(*net.TCPConn).SyscallConn()
+		Expect(err).ToNot(HaveOccurred())
+
+		var sendErr error
+		Expect(raw.Control(func(fd uintptr) {
+			sendErr = unix.Sendmsg(int(fd), []byte{1}, nil, nil, unix.MSG_OOB)
+		})).To(Succeed())
+		Expect(sendErr).ToNot(HaveOccurred())
+	}
+
+	It("should notify the channel when the trigger fires", func() {
+		notify := make(chan struct{}, 1)
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			memory.WatchMemoryPressure(logrus.New(), trigger, notify, stop)
+		}()
+
+		Consistently(notify, 100*time.Millisecond).ShouldNot(Receive())
+
+		fire()
+		Eventually(notify).Should(Receive())
+
+		close(stop)
+		Eventually(done, 3*time.Second).Should(BeClosed())
+	})
+})
@@ -0,0 +1,109 @@
+package memory
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	metricQoSWorkingSetMemory = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_kubepods_qos_memory_working_set_bytes",
+		Help: "The memory working set of the pods of a QoS class (guaranteed, burstable, besteffort) in bytes",
+	}, []string{"qos"})
+
+	metricQoSMemoryLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_kubepods_qos_memory_limit_bytes",
+		Help: "The memory limit of the pods of a QoS class (guaranteed: sum of the pod limits) in bytes. Capped at the memory capacity.",
+	}, []string{"qos"})
+)
+
+// QoSMemory is the memory of the pods of a single QoS class
+type QoSMemory struct {
+	// WorkingSetBytes is the working set of the QoS class
+	WorkingSetBytes resource.Quantity
+	// LimitInBytes is the memory limit of the QoS class. Capped at the memory capacity.
+	LimitInBytes resource.Quantity
+}
+
+// GetQoSMemory returns the working set and memory limit per QoS class below the kubepods cgroup.
+// The kubelet creates a cgroup for the burstable and besteffort QoS classes. Guaranteed pods are placed directly
+// below the kubepods cgroup: their working set is the kubepods working set minus the working set of the burstable and
+// besteffort cgroups, their limit is the sum of the limits of the guaranteed pod cgroups.
+func GetQoSMemory(cgroupRoot string, cgroupsV2 bool, kubepodsCgroupName string, kubepodsWorkingSet, capacity resource.Quantity) (map[string]QoSMemory, error) {
+	qos := map[string]QoSMemory{}
+
+	guaranteedWorkingSet := kubepodsWorkingSet.DeepCopy()
+	for _, qosClass := range []string{kubelet.QoSBurstable, kubelet.QoSBestEffort} {
+		cgroupName := kubelet.QoSCgroupName(kubepodsCgroupName, qosClass)
+
+		workingSet, err := getMemoryWorkingSet(cgroupRoot, cgroupName, cgroupsV2)
+		if err != nil {
+			return nil, err
+		}
+
+		limit, err := getMemoryLimitInBytes(cgroupRoot, cgroupName, cgroupsV2)
+		if err != nil {
+			return nil, err
+		}
+
+		guaranteedWorkingSet.Sub(workingSet)
+		qos[qosClass] = QoSMemory{
+			WorkingSetBytes: workingSet,
+			LimitInBytes:    capQuantity(limit, capacity),
+		}
+	}
+
+	// the working sets are not read atomically
+	if guaranteedWorkingSet.Sign() < 0 {
+		guaranteedWorkingSet = resource.Quantity{}
+	}
+
+	memoryHierarchy := cgroupRoot
+	if !cgroupsV2 {
+		memoryHierarchy = filepath.Join(cgroupRoot, string(cgroups.Memory))
+	}
+
+	podCgroupNames, err := kubelet.GuaranteedPodCgroupNames(memoryHierarchy, kubepodsCgroupName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the guaranteed pod cgroups: %w", err)
+	}
+
+	guaranteedLimit := resource.Quantity{}
+	for _, podCgroupName := range podCgroupNames {
+		limit, err := getMemoryLimitInBytes(cgroupRoot, podCgroupName, cgroupsV2)
+		if err != nil {
+			// the pod has been deleted in the meantime
+			continue
+		}
+		guaranteedLimit.Add(capQuantity(limit, capacity))
+	}
+
+	qos[kubelet.QoSGuaranteed] = QoSMemory{
+		WorkingSetBytes: guaranteedWorkingSet,
+		LimitInBytes:    capQuantity(guaranteedLimit, capacity),
+	}
+	return qos, nil
+}
+
+// recordQoSMemory records the memory per QoS class
+func recordQoSMemory(qos map[string]QoSMemory) {
+	for qosClass, qosMemory := range qos {
+		metricQoSWorkingSetMemory.WithLabelValues(qosClass).Set(float64(qosMemory.WorkingSetBytes.Value()))
+		metricQoSMemoryLimit.WithLabelValues(qosClass).Set(float64(qosMemory.LimitInBytes.Value()))
+	}
+}
+
+// capQuantity returns the quantity, but at most max.
+// Without a limit, a cgroup is effectively limited by the capacity.
+func capQuantity(quantity, max resource.Quantity) resource.Quantity {
+	if quantity.Cmp(max) > 0 {
+		return max.DeepCopy()
+	}
+	return quantity.DeepCopy()
+}
@@ -0,0 +1,71 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ = Describe("QoS memory", func() {
+	var cgroupRoot string
+
+	writeCgroup := func(name, current, inactiveFile, max string) {
+		dir := filepath.Join(cgroupRoot, name)
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "memory.current"), []byte(current), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "memory.stat"), []byte("anon 0\ninactive_file "+inactiveFile+"\n"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, memory.CgroupV2MemoryMax), []byte(max), 0644)).To(Succeed())
+	}
+
+	expectQoS := func(qos map[string]memory.QoSMemory, qosClass string, workingSet, limit int64) {
+		qosMemory, ok := qos[qosClass]
+		ExpectWithOffset(1, ok).To(BeTrue())
+		ExpectWithOffset(1, qosMemory.WorkingSetBytes.Value()).To(Equal(workingSet))
+		ExpectWithOffset(1, qosMemory.LimitInBytes.Value()).To(Equal(limit))
+	}
+
+	BeforeEach(func() {
+		var err error
+		cgroupRoot, err = ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cgroupRoot)).To(Succeed())
+	})
+
+	It("should break down the working set and limit per QoS class", func() {
+		writeCgroup("kubepods.slice/kubepods-burstable.slice", "3000", "1000", "8000")
+		writeCgroup("kubepods.slice/kubepods-besteffort.slice", "500", "0", "max")
+		writeCgroup("kubepods.slice/kubepods-poda.slice", "1000", "0", "1500")
+		writeCgroup("kubepods.slice/kubepods-podb.slice", "1000", "0", "2500")
+
+		qos, err := memory.GetQoSMemory(cgroupRoot, true, "kubepods.slice", resource.MustParse("5000"), resource.MustParse("10000"))
+		Expect(err).ToNot(HaveOccurred())
+
+		expectQoS(qos, kubelet.QoSBurstable, 2000, 8000)
+		expectQoS(qos, kubelet.QoSBestEffort, 500, 10000)
+		expectQoS(qos, kubelet.QoSGuaranteed, 2500, 4000)
+	})
+
+	It("should not return a negative guaranteed working set", func() {
+		writeCgroup("kubepods/burstable", "3000", "0", "max")
+		writeCgroup("kubepods/besteffort", "500", "0", "max")
+
+		qos, err := memory.GetQoSMemory(cgroupRoot, true, "kubepods", resource.MustParse("3000"), resource.MustParse("10000"))
+		Expect(err).ToNot(HaveOccurred())
+		expectQoS(qos, kubelet.QoSGuaranteed, 0, 0)
+	})
+
+	It("should fail without QoS cgroups", func() {
+		Expect(os.MkdirAll(filepath.Join(cgroupRoot, "kubepods"), 0755)).To(Succeed())
+		_, err := memory.GetQoSMemory(cgroupRoot, true, "kubepods", resource.MustParse("3000"), resource.MustParse("10000"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,68 @@
+package memory
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/kubelet"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	metricTopLevelWorkingSetMemory = metrics.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_top_level_memory_working_set_bytes",
+		Help: "The working set memory of the siblings of kubepods (the top-level cgroups besides kubepods unless it is nested, e.g. system.slice, user.slice, init.scope) in bytes",
+	}, "cgroup")
+)
+
+// GetKubepodsSiblingsMemory returns the working set of every sibling of kubepods sorted by working set (descending).
+// If kubepods is nested, its siblings are the other children of its parent.
+// Cgroups that disappear while being read are omitted.
+// Processes in the root cgroup itself are not covered.
+func GetKubepodsSiblingsMemory(cgroupRoot string, cgroupsV2 bool, kubepodsCgroupName string) ([]UnitMemory, error) {
+	memoryHierarchy := cgroupRoot
+	if !cgroupsV2 {
+		memoryHierarchy = filepath.Join(cgroupRoot, string(cgroups.Memory))
+	}
+
+	names, err := kubelet.KubepodsSiblingCgroupNames(memoryHierarchy, kubepodsCgroupName)
+	if err != nil {
+		return nil, err
+	}
+
+	var siblings []UnitMemory
+	for _, name := range names {
+		workingSet, err := getMemoryWorkingSet(cgroupRoot, name, cgroupsV2)
+		if err != nil {
+			continue
+		}
+		siblings = append(siblings, UnitMemory{Name: name, WorkingSetBytes: workingSet})
+	}
+
+	sort.SliceStable(siblings, func(i, j int) bool {
+		return siblings[i].WorkingSetBytes.Cmp(siblings[j].WorkingSetBytes) > 0
+	})
+	return siblings, nil
+}
+
+// sumWorkingSet returns the total working set of the given cgroups
+func sumWorkingSet(cgroups []UnitMemory) resource.Quantity {
+	sum := resource.Quantity{}
+	for _, cgroup := range cgroups {
+		sum.Add(cgroup.WorkingSetBytes)
+	}
+	return sum
+}
+
+// recordKubepodsSiblingsMemory records the working set per sibling of kubepods.
+// Cgroups that no longer exist are removed from the metric.
+func recordKubepodsSiblingsMemory(siblings []UnitMemory) {
+	workingSet := make(map[string]float64, len(siblings))
+	for _, sibling := range siblings {
+		workingSet[sibling.Name] = float64(sibling.WorkingSetBytes.Value())
+	}
+	metricTopLevelWorkingSetMemory.Update(workingSet)
+}
@@ -0,0 +1,36 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Kubepods siblings", func() {
+	It("should return the working set of the top-level cgroups besides kubepods", func() {
+		cgroupRoot, err := ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(cgroupRoot)
+
+		for name, current := range map[string]string{"kubepods.slice": "9000", "system.slice": "3000", "user.slice": "4000", "init.scope": "200"} {
+			dir := filepath.Join(cgroupRoot, name)
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "memory.current"), []byte(current), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "memory.stat"), []byte("inactive_file 0\n"), 0644)).To(Succeed())
+		}
+
+		siblings, err := memory.GetKubepodsSiblingsMemory(cgroupRoot, true, "kubepods.slice")
+		Expect(err).ToNot(HaveOccurred())
+
+		var names []string
+		for _, sibling := range siblings {
+			names = append(names, sibling.Name)
+		}
+		Expect(names).To(Equal([]string{"user.slice", "system.slice", "init.scope"}))
+		Expect(siblings[0].WorkingSetBytes.Value()).To(Equal(int64(4000)))
+	})
+})
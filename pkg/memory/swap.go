@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// cgroupV1MemorySwapUsage is the name of the cgroupsv1 file containing the current memory + swap usage of a cgroup
+	// (only present with swap accounting enabled)
+	cgroupV1MemorySwapUsage = "memory.memsw.usage_in_bytes"
+	// cgroupV2MemorySwapCurrent is the name of the cgroupsv2 file containing the current swap usage of a cgroup
+	cgroupV2MemorySwapCurrent = "memory.swap.current"
+)
+
+var (
+	metricSwapTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_SwapTotal",
+		Help: "The SwapTotal from /proc/meminfo",
+	})
+
+	metricSwapFree = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_SwapFree",
+		Help: "The SwapFree from /proc/meminfo",
+	})
+
+	metricSwapUsed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_swap_used",
+		Help: "The used swap calculated from /proc/meminfo SwapTotal - SwapFree",
+	})
+
+	metricMemUsedIncludingSwap = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_memory_used_including_swap",
+		Help: "The not reclaimable memory (node_memory_used) including the used swap (SwapTotal - SwapFree)",
+	})
+
+	metricKubepodsSwap = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_cgroup_kubepods_memory_swap_bytes",
+		Help: "The swap usage of the kubepods cgroup in bytes",
+	})
+
+	metricSystemSliceSwap = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "node_cgroup_system_slice_memory_swap_bytes",
+		Help: "The swap usage of the system slice cgroup in bytes",
+	})
+
+	metricTargetReservedSwapBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kubelet_target_reserved_swap_bytes",
+		Help: "The swap used by non-pod processes calculated as SwapTotal - SwapFree - swap usage of the kubepods cgroup. Part of the target reserved memory.",
+	})
+)
+
+// SwapRecommendation is the swap usage of the node and the swap used by non-pod processes
+type SwapRecommendation struct {
+	// Total is the SwapTotal from /proc/meminfo
+	Total resource.Quantity
+	// Used is SwapTotal - SwapFree from /proc/meminfo
+	Used resource.Quantity
+	// KubepodsUsage is the swap usage of the kubepods cgroup
+	KubepodsUsage resource.Quantity
+	// SystemSliceUsage is the swap usage of the system.slice cgroup
+	SystemSliceUsage resource.Quantity
+	// TargetReservedSwap is the swap used by the non-pod processes (Used - KubepodsUsage).
+	// It is part of the target reserved memory.
+	TargetReservedSwap resource.Quantity
+}
+
+// recommendReservedSwap calculates the swap used by non-pod processes given SwapTotal and SwapFree from /proc/meminfo.
+// Analogous to the memory, this is the swap used outside of the kubepods cgroup.
+// The used memory (MemTotal - MemAvailable) is only used to record the used memory including swap.
+func recommendReservedSwap(cgroupRoot string, cgroupsV2 bool, kubepodsCgroupName string, swapTotal, swapFree, memUsed resource.Quantity) (SwapRecommendation, error) {
+	recommendation := SwapRecommendation{Total: swapTotal}
+	recommendation.Used = swapTotal.DeepCopy()
+	recommendation.Used.Sub(swapFree)
+
+	// without swap, the cgroups cannot use any swap
+	if !swapTotal.IsZero() {
+		var err error
+		recommendation.KubepodsUsage, err = GetSwapUsage(cgroupRoot, kubepodsCgroupName, cgroupsV2)
+		if err != nil {
+			return SwapRecommendation{}, err
+		}
+
+		recommendation.SystemSliceUsage, err = GetSwapUsage(cgroupRoot, types.SystemSliceCgroupName, cgroupsV2)
+		if err != nil {
+			return SwapRecommendation{}, err
+		}
+	}
+
+	recommendation.TargetReservedSwap = recommendation.Used.DeepCopy()
+	recommendation.TargetReservedSwap.Sub(recommendation.KubepodsUsage)
+	if recommendation.TargetReservedSwap.Sign() < 0 {
+		recommendation.TargetReservedSwap = resource.Quantity{}
+	}
+
+	memUsedIncludingSwap := memUsed.DeepCopy()
+	memUsedIncludingSwap.Add(recommendation.Used)
+
+	metricSwapTotal.Set(float64(swapTotal.Value()))
+	metricSwapFree.Set(float64(swapFree.Value()))
+	metricSwapUsed.Set(float64(recommendation.Used.Value()))
+	metricMemUsedIncludingSwap.Set(float64(memUsedIncludingSwap.Value()))
+	metricKubepodsSwap.Set(float64(recommendation.KubepodsUsage.Value()))
+	metricSystemSliceSwap.Set(float64(recommendation.SystemSliceUsage.Value()))
+	metricTargetReservedSwapBytes.Set(float64(recommendation.TargetReservedSwap.Value()))
+	return recommendation, nil
+}
+
+// GetSwapUsage reads the swap usage of the given unit's memory cgroup.
+// Returns 0 if swap accounting is not enabled.
+func GetSwapUsage(cgroupRoot, unit string, cgroupsV2 bool) (resource.Quantity, error) {
+	if cgroupsV2 {
+		swap, err := cgroupfs.ReadUint(filepath.Join(cgroupRoot, unit, cgroupV2MemorySwapCurrent))
+		if errors.Is(err, os.ErrNotExist) {
+			return resource.Quantity{}, nil
+		}
+		if err != nil {
+			return resource.Quantity{}, fmt.Errorf("failed to read swap usage for %s cgroup: %v", unit, err)
+		}
+		return *resource.NewQuantity(int64(swap), resource.BinarySI), nil
+	}
+
+	// cgroupsv1 only accounts memory + swap
+	memorySwap, err := cgroupfs.ReadUint(filepath.Join(cgroupRoot, string(cgroups.Memory), unit, cgroupV1MemorySwapUsage))
+	if errors.Is(err, os.ErrNotExist) {
+		return resource.Quantity{}, nil
+	}
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("failed to read memory+swap usage for %s cgroup: %v", unit, err)
+	}
+
+	usage, err := cgroupfs.ReadUint(filepath.Join(cgroupRoot, string(cgroups.Memory), unit, cgroupV1MemoryUsage))
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("failed to read memory usage for %s cgroup: %v", unit, err)
+	}
+
+	// both files are read separately, protect against an underflow
+	if memorySwap < usage {
+		return resource.Quantity{}, nil
+	}
+	return *resource.NewQuantity(int64(memorySwap-usage), resource.BinarySI), nil
+}
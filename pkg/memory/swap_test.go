@@ -0,0 +1,83 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Swap usage", func() {
+	var cgroupRoot string
+
+	writeFile := func(path, value string) {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(value), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		cgroupRoot, err = ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cgroupRoot)).To(Succeed())
+	})
+
+	Context("cgroupsv1", func() {
+		It("should subtract the memory usage from the memory + swap usage", func() {
+			writeFile(filepath.Join(cgroupRoot, "memory", "kubepods", "memory.memsw.usage_in_bytes"), "5000\n")
+			writeFile(filepath.Join(cgroupRoot, "memory", "kubepods", "memory.usage_in_bytes"), "3000\n")
+
+			swap, err := memory.GetSwapUsage(cgroupRoot, "kubepods", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(swap.Value()).To(Equal(int64(2000)))
+		})
+
+		It("should not underflow if the memory usage grew in between the reads", func() {
+			writeFile(filepath.Join(cgroupRoot, "memory", "kubepods", "memory.memsw.usage_in_bytes"), "3000\n")
+			writeFile(filepath.Join(cgroupRoot, "memory", "kubepods", "memory.usage_in_bytes"), "3500\n")
+
+			swap, err := memory.GetSwapUsage(cgroupRoot, "kubepods", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(swap.IsZero()).To(BeTrue())
+		})
+
+		It("should return no swap usage without swap accounting", func() {
+			writeFile(filepath.Join(cgroupRoot, "memory", "kubepods", "memory.usage_in_bytes"), "3000\n")
+
+			swap, err := memory.GetSwapUsage(cgroupRoot, "kubepods", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(swap.IsZero()).To(BeTrue())
+		})
+	})
+
+	Context("cgroupsv2", func() {
+		It("should read the swap usage", func() {
+			writeFile(filepath.Join(cgroupRoot, "kubepods.slice", "memory.swap.current"), "4096\n")
+
+			swap, err := memory.GetSwapUsage(cgroupRoot, "kubepods.slice", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(swap.Value()).To(Equal(int64(4096)))
+		})
+
+		It("should return no swap usage without swap accounting", func() {
+			Expect(os.MkdirAll(filepath.Join(cgroupRoot, "kubepods.slice"), 0755)).To(Succeed())
+
+			swap, err := memory.GetSwapUsage(cgroupRoot, "kubepods.slice", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(swap.IsZero()).To(BeTrue())
+		})
+
+		It("should fail on an invalid swap usage", func() {
+			writeFile(filepath.Join(cgroupRoot, "kubepods.slice", "memory.swap.current"), "invalid\n")
+
+			_, err := memory.GetSwapUsage(cgroupRoot, "kubepods.slice", true)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/containerd/cgroups"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/cgroupfs"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/metrics"
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	metricSystemSliceUnitWorkingSetMemory = metrics.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "node_cgroup_system_slice_unit_memory_working_set_bytes",
+		Help: "The working set memory of the child cgroups of system.slice (e.g. journald.service) in bytes",
+	}, "unit")
+)
+
+// UnitMemory is the working set of a cgroup of a systemd unit (e.g. a child cgroup of system.slice or a top-level slice)
+type UnitMemory struct {
+	// Name is the name of the cgroup (e.g. systemd-journald.service)
+	Name string
+	// WorkingSetBytes is the working set of the cgroup
+	WorkingSetBytes resource.Quantity
+}
+
+// GetSystemSliceUnitsMemory returns the working set of every child cgroup of system.slice sorted by working set (descending).
+// Child cgroups that disappear while being read (e.g. stopped units) are omitted.
+func GetSystemSliceUnitsMemory(cgroupRoot string, cgroupsV2 bool) ([]UnitMemory, error) {
+	memoryHierarchy := cgroupRoot
+	if !cgroupsV2 {
+		memoryHierarchy = filepath.Join(cgroupRoot, string(cgroups.Memory))
+	}
+
+	children, err := cgroupfs.ListChildren(filepath.Join(memoryHierarchy, types.SystemSliceCgroupName))
+	if err != nil {
+		return nil, err
+	}
+
+	var units []UnitMemory
+	for _, child := range children {
+		workingSet, err := getMemoryWorkingSet(cgroupRoot, filepath.Join(types.SystemSliceCgroupName, child), cgroupsV2)
+		if err != nil {
+			continue
+		}
+		units = append(units, UnitMemory{Name: child, WorkingSetBytes: workingSet})
+	}
+
+	sort.SliceStable(units, func(i, j int) bool {
+		return units[i].WorkingSetBytes.Cmp(units[j].WorkingSetBytes) > 0
+	})
+	return units, nil
+}
+
+// recordSystemSliceUnitsMemory records the working set per system.slice unit.
+// Units that no longer exist are removed from the metric.
+func recordSystemSliceUnitsMemory(units []UnitMemory) {
+	workingSet := make(map[string]float64, len(units))
+	for _, unit := range units {
+		workingSet[unit.Name] = float64(unit.WorkingSetBytes.Value())
+	}
+	metricSystemSliceUnitWorkingSetMemory.Update(workingSet)
+}
@@ -0,0 +1,58 @@
+package memory_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/memory"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("system.slice units", func() {
+	var cgroupRoot string
+
+	writeUnit := func(name, current string) {
+		dir := filepath.Join(cgroupRoot, "system.slice", name)
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "memory.current"), []byte(current), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "memory.stat"), []byte("inactive_file 100\n"), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		cgroupRoot, err = ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cgroupRoot)).To(Succeed())
+	})
+
+	It("should return the working set of every unit sorted by working set", func() {
+		writeUnit("kubelet.service", "2000")
+		writeUnit("systemd-journald.service", "5000")
+		writeUnit("sshd.service", "500")
+		// a stopped unit without memory files
+		Expect(os.MkdirAll(filepath.Join(cgroupRoot, "system.slice", "stopped.service"), 0755)).To(Succeed())
+
+		units, err := memory.GetSystemSliceUnitsMemory(cgroupRoot, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(units).To(HaveLen(3))
+
+		var names []string
+		var workingSets []int64
+		for _, unit := range units {
+			names = append(names, unit.Name)
+			workingSets = append(workingSets, unit.WorkingSetBytes.Value())
+		}
+		Expect(names).To(Equal([]string{"systemd-journald.service", "kubelet.service", "sshd.service"}))
+		Expect(workingSets).To(Equal([]int64{4900, 1900, 400}))
+	})
+
+	It("should fail if system.slice does not exist", func() {
+		_, err := memory.GetSystemSliceUnitsMemory(cgroupRoot, true)
+		Expect(err).To(HaveOccurred())
+	})
+})
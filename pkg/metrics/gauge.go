@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// GaugeVec is a gauge vector with a single label whose label values are replaced as a whole on every update
+// (e.g. one gauge per cgroup). Label values missing in an update are deleted.
+// Unlike resetting the vector before setting the new values, a concurrent scrape never misses the label values that are still present.
+type GaugeVec struct {
+	*prometheus.GaugeVec
+
+	mu sync.Mutex
+	// labelValues are the label values set by the last update
+	labelValues map[string]struct{}
+}
+
+// NewGaugeVec creates a GaugeVec with the given label and registers it with the default registry
+func NewGaugeVec(opts prometheus.GaugeOpts, label string) *GaugeVec {
+	return &GaugeVec{
+		GaugeVec:    promauto.NewGaugeVec(opts, []string{label}),
+		labelValues: map[string]struct{}{},
+	}
+}
+
+// Update sets the gauges of the given label values and deletes the gauges of all other label values
+func (g *GaugeVec) Update(values map[string]float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for labelValue, value := range values {
+		g.WithLabelValues(labelValue).Set(value)
+	}
+
+	for labelValue := range g.labelValues {
+		if _, ok := values[labelValue]; !ok {
+			g.DeleteLabelValues(labelValue)
+		}
+	}
+
+	g.labelValues = make(map[string]struct{}, len(values))
+	for labelValue := range values {
+		g.labelValues[labelValue] = struct{}{}
+	}
+}
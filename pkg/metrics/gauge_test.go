@@ -0,0 +1,32 @@
+package metrics_test
+
+import (
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/metrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("GaugeVec", func() {
+	collect := func(collector prometheus.Collector) int {
+		ch := make(chan prometheus.Metric, 10)
+		collector.Collect(ch)
+		close(ch)
+		return len(ch)
+	}
+
+	It("should delete the label values missing in an update", func() {
+		gauge := metrics.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge_vec", Help: "test"}, "unit")
+
+		gauge.Update(map[string]float64{"a.service": 1, "b.service": 2})
+		Expect(collect(gauge)).To(Equal(2))
+
+		gauge.Update(map[string]float64{"b.service": 3, "c.service": 4})
+		Expect(collect(gauge)).To(Equal(2))
+		Expect(gauge.DeleteLabelValues("a.service")).To(BeFalse())
+		Expect(gauge.DeleteLabelValues("c.service")).To(BeTrue())
+
+		gauge.Update(nil)
+		Expect(collect(gauge)).To(Equal(0))
+	})
+})
@@ -0,0 +1,361 @@
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/cgroups"
+	"github.com/dustin/go-humanize"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+)
+
+// Process is a process running outside of the kubepods cgroup
+type Process struct {
+	// PID is the process ID in the PID namespace of the proc filesystem
+	PID int `json:"pid"`
+	// Command is the (truncated) command line of the process
+	Command string `json:"command"`
+	// Cgroup is the cgroup of the process relative to the hierarchy root (e.g. system.slice/containerd.service)
+	Cgroup string `json:"cgroup"`
+	// RSSBytes is the resident set size of the process
+	RSSBytes int64 `json:"rssBytes"`
+	// PSSBytes is the proportional set size of the process (shared pages are divided among the processes sharing them)
+	PSSBytes int64 `json:"pssBytes"`
+	// CPU is the CPU usage since the previous collection relative to one core (1.1 = 110% of one core).
+	// 0 for processes seen for the first time.
+	CPU float64 `json:"cpu"`
+}
+
+// Cgroup is the usage of all non-pod processes in a cgroup
+type Cgroup struct {
+	// Name is the cgroup relative to the hierarchy root
+	Name string `json:"cgroup"`
+	// Processes is the number of processes in the cgroup
+	Processes int `json:"processes"`
+	// RSSBytes is the total resident set size of the processes
+	RSSBytes int64 `json:"rssBytes"`
+	// PSSBytes is the total proportional set size of the processes
+	PSSBytes int64 `json:"pssBytes"`
+	// CPU is the total CPU usage of the processes relative to one core
+	CPU float64 `json:"cpu"`
+}
+
+// Snapshot are the top non-pod consumers at a point in time
+type Snapshot struct {
+	// Time is the time of the collection
+	Time time.Time `json:"time"`
+	// TopMemory are the processes with the highest PSS
+	TopMemory []Process `json:"topMemory"`
+	// TopCPU are the processes with the highest CPU usage
+	TopCPU []Process `json:"topCPU"`
+	// Cgroups are the cgroups with the highest PSS of their processes
+	Cgroups []Cgroup `json:"cgroups"`
+}
+
+// cpuSample is the CPU time consumed by a process at a point in time
+type cpuSample struct {
+	ticks     uint64
+	startTime uint64
+	time      time.Time
+}
+
+// Collector walks the proc filesystem to attribute the memory and CPU usage outside of the kubepods cgroup to processes.
+// Requires the host PID namespace (hostPID) to see the processes of the node.
+// The last snapshot is exposed via HTTP.
+type Collector struct {
+	// mu guards the previous samples and the snapshot
+	mu sync.Mutex
+
+	log                *logrus.Logger
+	procRoot           string
+	cgroupRoot         string
+	cgroupsV2          bool
+	kubepodsCgroupName string
+	topN               int
+	// pid is the PID of the collector
+	pid int
+	// namespaceRoot is the cgroup namespace root (the cgroup of the collector) relative to the hierarchy root.
+	// Only resolved in a private cgroup namespace.
+	namespaceRoot string
+	// previous are the CPU samples of the previous collection by PID
+	previous map[int]cpuSample
+	snapshot Snapshot
+	now      func() time.Time
+}
+
+// NewCollector creates a new Collector reporting the topN non-pod processes and cgroups.
+// The cgroup hierarchy is used to resolve the cgroups of the processes in a private cgroup namespace.
+func NewCollector(log *logrus.Logger, procRoot, cgroupRoot string, cgroupsV2 bool, kubepodsCgroupName string, topN int) *Collector {
+	return &Collector{
+		log:                log,
+		procRoot:           procRoot,
+		cgroupRoot:         cgroupRoot,
+		cgroupsV2:          cgroupsV2,
+		kubepodsCgroupName: strings.Trim(kubepodsCgroupName, "/"),
+		topN:               topN,
+		pid:                os.Getpid(),
+		previous:           map[int]cpuSample{},
+		now:                time.Now,
+	}
+}
+
+// Collect reads all processes from the proc filesystem and returns the top non-pod consumers.
+// Processes that exit while being read are skipped.
+func (c *Collector) Collect() (Snapshot, error) {
+	entries, err := ioutil.ReadDir(c.procRoot)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read %s: %w", c.procRoot, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	samples := map[int]cpuSample{}
+	cgroups := map[string]*Cgroup{}
+	var processes []Process
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		procDir := filepath.Join(c.procRoot, entry.Name())
+
+		cgroup, err := readCgroup(procDir)
+		if err != nil {
+			continue
+		}
+
+		cgroup, err = c.resolveCgroup(cgroup)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		if c.isPodCgroup(cgroup) {
+			continue
+		}
+
+		stat, err := readStat(procDir)
+		if err != nil {
+			continue
+		}
+
+		// smaps_rollup requires ptrace read access. Kernel threads have no memory mappings.
+		rss, pss, err := readMemory(procDir)
+		if err != nil && !os.IsNotExist(err) {
+			c.log.Debugf("failed to read the memory of process %d: %v", pid, err)
+		}
+
+		sample := cpuSample{ticks: stat.cpuTicks, startTime: stat.startTime, time: now}
+		samples[pid] = sample
+
+		process := Process{
+			PID:      pid,
+			Command:  readCommand(procDir, stat.comm),
+			Cgroup:   cgroup,
+			RSSBytes: rss,
+			PSSBytes: pss,
+			CPU:      cpuUsage(c.previous[pid], sample),
+		}
+		processes = append(processes, process)
+
+		group, ok := cgroups[cgroup]
+		if !ok {
+			group = &Cgroup{Name: cgroup}
+			cgroups[cgroup] = group
+		}
+		group.Processes++
+		group.RSSBytes += process.RSSBytes
+		group.PSSBytes += process.PSSBytes
+		group.CPU += process.CPU
+	}
+
+	c.previous = samples
+	c.snapshot = newSnapshot(now, processes, cgroups, c.topN)
+	return c.snapshot, nil
+}
+
+// resolveCgroup returns the cgroup relative to the hierarchy root.
+// In a private cgroup namespace, the cgroups outside of the namespace root are shown relative to it (e.g. ../../system.slice).
+// They are resolved against the namespace root, the cgroup of the collector.
+func (c *Collector) resolveCgroup(cgroup string) (string, error) {
+	if cgroup != ".." && !strings.HasPrefix(cgroup, "../") {
+		return cgroup, nil
+	}
+
+	if len(c.namespaceRoot) == 0 {
+		namespaceRoot, err := c.findNamespaceRoot()
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve the cgroup %s of the private cgroup namespace: %w", cgroup, err)
+		}
+		c.namespaceRoot = namespaceRoot
+	}
+	return strings.TrimPrefix(path.Join("/", c.namespaceRoot, cgroup), "/"), nil
+}
+
+// findNamespaceRoot returns the cgroup of the collector relative to the hierarchy root.
+// The collector runs in a pod: the kubepods cgroup is searched for the cgroup containing the PID of the collector (same PID on the node with hostPID).
+func (c *Collector) findNamespaceRoot() (string, error) {
+	hierarchyRoot := c.cgroupRoot
+	if !c.cgroupsV2 {
+		hierarchyRoot = filepath.Join(c.cgroupRoot, string(cgroups.Memory))
+	}
+
+	pid := strconv.Itoa(c.pid)
+	var namespaceRoot string
+	err := filepath.Walk(filepath.Join(hierarchyRoot, c.kubepodsCgroupName), func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the cgroup has been removed in the meantime
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || len(namespaceRoot) > 0 {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, cgroupProcs))
+		if err != nil {
+			return nil
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.TrimSpace(line) == pid {
+				namespaceRoot, err = filepath.Rel(hierarchyRoot, dir)
+				if err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(namespaceRoot) == 0 {
+		return "", fmt.Errorf("process %d not found below the %s cgroup", c.pid, c.kubepodsCgroupName)
+	}
+	return filepath.ToSlash(namespaceRoot), nil
+}
+
+// isPodCgroup returns true if the cgroup (relative to the hierarchy root) is the kubepods cgroup or below
+func (c *Collector) isPodCgroup(cgroup string) bool {
+	return cgroup == c.kubepodsCgroupName || strings.HasPrefix(cgroup, c.kubepodsCgroupName+"/")
+}
+
+// Snapshot returns the snapshot of the last collection
+func (c *Collector) Snapshot() Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshot
+}
+
+// ServeHTTP serves the snapshot of the last collection as JSON
+func (c *Collector) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(c.Snapshot()); err != nil {
+		c.log.Warnf("failed to serve the process snapshot: %v", err)
+	}
+}
+
+// cpuUsage returns the CPU usage between the previous and the current sample relative to one core.
+// Returns 0 if there is no previous sample of the same process.
+func cpuUsage(previous, current cpuSample) float64 {
+	if previous.time.IsZero() || previous.startTime != current.startTime || current.ticks < previous.ticks {
+		return 0
+	}
+
+	elapsed := current.time.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	// the kernel reports the CPU times in USER_HZ regardless of the kernel tick rate (CONFIG_HZ).
+	// USER_HZ (sysconf(_SC_CLK_TCK)) is assumed to be 100, the value on all architectures supported by Kubernetes.
+	return float64(current.ticks-previous.ticks) / userHZ / elapsed
+}
+
+// newSnapshot returns a snapshot with the topN processes by PSS and CPU usage and the topN cgroups by PSS
+func newSnapshot(now time.Time, processes []Process, cgroups map[string]*Cgroup, topN int) Snapshot {
+	byMemory := append([]Process(nil), processes...)
+	sort.SliceStable(byMemory, func(i, j int) bool {
+		return byMemory[i].PSSBytes > byMemory[j].PSSBytes
+	})
+
+	byCPU := append([]Process(nil), processes...)
+	sort.SliceStable(byCPU, func(i, j int) bool {
+		return byCPU[i].CPU > byCPU[j].CPU
+	})
+
+	groups := make([]Cgroup, 0, len(cgroups))
+	for _, group := range cgroups {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].PSSBytes != groups[j].PSSBytes {
+			return groups[i].PSSBytes > groups[j].PSSBytes
+		}
+		return groups[i].Name < groups[j].Name
+	})
+
+	return Snapshot{
+		Time:      now,
+		TopMemory: truncate(byMemory, topN),
+		TopCPU:    truncate(byCPU, topN),
+		Cgroups:   truncateCgroups(groups, topN),
+	}
+}
+
+func truncate(processes []Process, n int) []Process {
+	if len(processes) > n {
+		return processes[:n]
+	}
+	return processes
+}
+
+func truncateCgroups(cgroups []Cgroup, n int) []Cgroup {
+	if len(cgroups) > n {
+		return cgroups[:n]
+	}
+	return cgroups
+}
+
+// LogSnapshot renders the top non-pod processes and cgroups as tables
+func LogSnapshot(snapshot Snapshot) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Non-pod processes", "PID", "Cgroup", "PSS", "RSS", "CPU"})
+
+	t.AppendRow(table.Row{"TOP MEMORY (PSS)"})
+	for _, process := range snapshot.TopMemory {
+		t.AppendRow(processRow(process))
+	}
+
+	t.AppendSeparator()
+	t.AppendRow(table.Row{"TOP CPU"})
+	for _, process := range snapshot.TopCPU {
+		t.AppendRow(processRow(process))
+	}
+
+	t.AppendSeparator()
+	t.AppendRow(table.Row{"TOP CGROUPS (PSS)", "Processes"})
+	for _, cgroup := range snapshot.Cgroups {
+		t.AppendRow(table.Row{cgroup.Name, cgroup.Processes, "", humanize.IBytes(uint64(cgroup.PSSBytes)), humanize.IBytes(uint64(cgroup.RSSBytes)), fmt.Sprintf("%.2f%%", cgroup.CPU*100)})
+	}
+	t.Render()
+}
+
+func processRow(process Process) table.Row {
+	return table.Row{process.Command, process.PID, process.Cgroup, humanize.IBytes(uint64(process.PSSBytes)), humanize.IBytes(uint64(process.RSSBytes)), fmt.Sprintf("%.2f%%", process.CPU*100)}
+}
@@ -0,0 +1,167 @@
+package process_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/process"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Collector", func() {
+	var procRoot, cgroupRoot string
+
+	// writeProcess writes a fake /proc/<pid> directory
+	writeProcess := func(pid int, comm, cmdline, cgroup string, rssKB, pssKB, ticks int) {
+		dir := filepath.Join(procRoot, fmt.Sprintf("%d", pid))
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+
+		stat := fmt.Sprintf("%d (%s) S 1 1 1 0 -1 4194560 100 0 0 0 %d 0 0 0 20 0 1 0 42 1000 10 18446744073709551615", pid, comm, ticks)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(strings.ReplaceAll(cmdline, " ", "\x00")), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0644)).To(Succeed())
+
+		smaps := ""
+		if rssKB > 0 {
+			smaps = fmt.Sprintf("55d7a0000000-7ffc00000000 ---p 00000000 00:00 0 [rollup]\nRss: %d kB\nPss: %d kB\nShared_Clean: 0 kB\n", rssKB, pssKB)
+		}
+		Expect(ioutil.WriteFile(filepath.Join(dir, "smaps_rollup"), []byte(smaps), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		procRoot, err = ioutil.TempDir("", "proc")
+		Expect(err).ToNot(HaveOccurred())
+		cgroupRoot, err = ioutil.TempDir("", "cgroup")
+		Expect(err).ToNot(HaveOccurred())
+
+		writeProcess(1, "systemd", "/sbin/init", "0::/init.scope\n", 10000, 8000, 100)
+		writeProcess(2, "kthreadd", "", "0::/\n", 0, 0, 50)
+		writeProcess(100, "containerd", "/usr/bin/containerd --config /etc/containerd/config.toml", "0::/system.slice/containerd.service\n", 80000, 60000, 500)
+		writeProcess(101, "journald (x)", "/lib/systemd/systemd-journald", "0::/system.slice/systemd-journald.service\n", 40000, 30000, 10)
+		writeProcess(200, "nginx", "nginx -g daemon off;", "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-poda.slice/cri-containerd-b.scope\n", 90000, 90000, 900)
+		Expect(os.MkdirAll(filepath.Join(procRoot, "sys"), 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(procRoot)).To(Succeed())
+		Expect(os.RemoveAll(cgroupRoot)).To(Succeed())
+	})
+
+	It("should report the top non-pod processes and cgroups", func() {
+		collector := process.NewCollector(logrus.New(), procRoot, cgroupRoot, true, "kubepods.slice", 2)
+
+		snapshot, err := collector.Collect()
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(snapshot.TopMemory).To(HaveLen(2))
+		Expect(snapshot.TopMemory[0]).To(Equal(process.Process{
+			PID:      100,
+			Command:  "/usr/bin/containerd --config /etc/containerd/config.toml",
+			Cgroup:   "system.slice/containerd.service",
+			RSSBytes: 80000 * 1024,
+			PSSBytes: 60000 * 1024,
+		}))
+		Expect(snapshot.TopMemory[1].PID).To(Equal(101))
+
+		Expect(snapshot.Cgroups).To(HaveLen(2))
+		Expect(snapshot.Cgroups[0].Name).To(Equal("system.slice/containerd.service"))
+		Expect(snapshot.Cgroups[0].Processes).To(Equal(1))
+		Expect(snapshot.Cgroups[1].Name).To(Equal("system.slice/systemd-journald.service"))
+	})
+
+	It("should name kernel threads in brackets", func() {
+		collector := process.NewCollector(logrus.New(), procRoot, cgroupRoot, true, "kubepods.slice", 10)
+
+		snapshot, err := collector.Collect()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(snapshot.TopMemory).To(HaveLen(4))
+		Expect(snapshot.TopMemory[3].Command).To(Equal("[kthreadd]"))
+	})
+
+	It("should calculate the CPU usage since the previous collection", func() {
+		collector := process.NewCollector(logrus.New(), procRoot, cgroupRoot, true, "kubepods.slice", 1)
+
+		snapshot, err := collector.Collect()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(snapshot.TopCPU[0].CPU).To(Equal(float64(0)))
+
+		writeProcess(101, "journald (x)", "/lib/systemd/systemd-journald", "0::/system.slice/systemd-journald.service\n", 40000, 30000, 20)
+
+		snapshot, err = collector.Collect()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(snapshot.TopCPU[0].PID).To(Equal(101))
+		Expect(snapshot.TopCPU[0].CPU).To(BeNumerically(">", 0))
+	})
+
+	Context("private cgroup namespace", func() {
+		BeforeEach(func() {
+			// the collector runs in a container below kubepods, the namespace root
+			container := filepath.Join(cgroupRoot, "kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-podx.slice", "cri-containerd-y.scope")
+			Expect(os.MkdirAll(container, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(container, "cgroup.procs"), []byte(fmt.Sprintf("1234\n%d\n", os.Getpid())), 0644)).To(Succeed())
+
+			writeProcess(300, "pause", "/pause", "0::/../../kubepods-besteffort.slice/kubepods-besteffort-podc.slice/cri-containerd-d.scope\n", 500, 500, 1)
+			writeProcess(301, "sshd", "/usr/sbin/sshd -D", "0::/../../../../system.slice/ssh.service\n", 5000, 4000, 1)
+			writeProcess(302, "conmon", "/usr/bin/conmon", "0::/../../../../podman.slice/conmon.scope\n", 3000, 2000, 1)
+		})
+
+		It("should resolve the cgroups against the namespace root", func() {
+			collector := process.NewCollector(logrus.New(), procRoot, cgroupRoot, true, "kubepods.slice", 10)
+
+			snapshot, err := collector.Collect()
+			Expect(err).ToNot(HaveOccurred())
+
+			var pids []int
+			var cgroups []string
+			for _, p := range snapshot.TopMemory {
+				pids = append(pids, p.PID)
+				cgroups = append(cgroups, p.Cgroup)
+			}
+			Expect(pids).ToNot(ContainElement(300))
+			Expect(cgroups).To(ContainElement("system.slice/ssh.service"))
+			// not a pod cgroup despite the name
+			Expect(cgroups).To(ContainElement("podman.slice/conmon.scope"))
+		})
+
+		It("should fail if the namespace root cannot be found", func() {
+			collector := process.NewCollector(logrus.New(), procRoot, cgroupRoot, true, "kubepods", 10)
+
+			_, err := collector.Collect()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("should use the memory hierarchy on cgroupsv1", func() {
+		writeProcess(100, "containerd", "/usr/bin/containerd", "12:cpu,cpuacct:/system.slice/containerd.service\n5:memory:/system.slice/containerd.service\n1:name=systemd:/system.slice/containerd.service\n", 1000, 1000, 1)
+		writeProcess(200, "nginx", "nginx", "5:memory:/kubepods/burstable/poda/b\n1:name=systemd:/kubepods/burstable/poda/b\n", 1000, 1000, 1)
+		collector := process.NewCollector(logrus.New(), procRoot, cgroupRoot, false, "kubepods", 10)
+
+		snapshot, err := collector.Collect()
+		Expect(err).ToNot(HaveOccurred())
+		for _, p := range snapshot.TopMemory {
+			Expect(p.PID).ToNot(Equal(200))
+		}
+	})
+
+	It("should serve the last snapshot", func() {
+		collector := process.NewCollector(logrus.New(), procRoot, cgroupRoot, true, "kubepods.slice", 1)
+		_, err := collector.Collect()
+		Expect(err).ToNot(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		collector.ServeHTTP(recorder, httptest.NewRequest("GET", "/processes", nil))
+
+		snapshot := process.Snapshot{}
+		Expect(json.NewDecoder(recorder.Body).Decode(&snapshot)).To(Succeed())
+		Expect(snapshot.TopMemory).To(HaveLen(1))
+		Expect(snapshot.TopMemory[0].PID).To(Equal(100))
+	})
+})
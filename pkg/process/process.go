@@ -0,0 +1,173 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProcRoot is the mount point of the proc filesystem. With hostPID, it contains the processes of the node.
+	ProcRoot = "/proc"
+	// userHZ is the number of clock ticks per second used for the CPU times in /proc/<pid>/stat (USER_HZ, 100 on all common architectures)
+	userHZ = 100
+	// cgroupProcs lists the PIDs of the processes in a cgroup
+	cgroupProcs = "cgroup.procs"
+	// maxCommandLength is the maximum length of the command line of a process that is reported
+	maxCommandLength = 120
+)
+
+// stat are the fields of /proc/<pid>/stat required for the CPU usage
+type stat struct {
+	// comm is the file name of the executable
+	comm string
+	// cpuTicks is the CPU time (user + system) consumed by the process in clock ticks
+	cpuTicks uint64
+	// startTime is the time the process started after system boot in clock ticks.
+	// Distinguishes a reused PID from the previous process.
+	startTime uint64
+}
+
+// readStat reads /proc/<pid>/stat
+func readStat(procDir string) (stat, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return stat{}, err
+	}
+	return parseStat(string(content))
+}
+
+// parseStat parses the content of /proc/<pid>/stat.
+// The comm field (2) is enclosed in parentheses and can contain spaces and parentheses itself.
+func parseStat(content string) (stat, error) {
+	start := strings.IndexByte(content, '(')
+	end := strings.LastIndexByte(content, ')')
+	if start < 0 || end < start {
+		return stat{}, fmt.Errorf("invalid stat: %q", content)
+	}
+
+	// fields after comm starting with field 3 (state)
+	fields := strings.Fields(content[end+1:])
+	if len(fields) < 20 {
+		return stat{}, fmt.Errorf("invalid stat: expected at least 22 fields, got %d", len(fields)+2)
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return stat{}, fmt.Errorf("invalid utime: %w", err)
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return stat{}, fmt.Errorf("invalid stime: %w", err)
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return stat{}, fmt.Errorf("invalid starttime: %w", err)
+	}
+
+	return stat{
+		comm:      content[start+1 : end],
+		cpuTicks:  utime + stime,
+		startTime: startTime,
+	}, nil
+}
+
+// readMemory reads the RSS and PSS in bytes from /proc/<pid>/smaps_rollup.
+// Kernel threads do not have any memory mappings (empty file).
+func readMemory(procDir string) (int64, int64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procDir, "smaps_rollup"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseSmapsRollup(bytes.NewReader(content))
+}
+
+// parseSmapsRollup returns the Rss and Pss in bytes from the content of /proc/<pid>/smaps_rollup
+func parseSmapsRollup(r io.Reader) (int64, int64, error) {
+	var rss, pss int64
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+
+		var target *int64
+		switch fields[0] {
+		case "Rss:":
+			target = &rss
+		case "Pss:":
+			target = &pss
+		default:
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid value for %s in smaps_rollup: %w", fields[0], err)
+		}
+		*target = value * 1024
+	}
+	return rss, pss, scanner.Err()
+}
+
+// readCgroup reads the cgroup of the process from /proc/<pid>/cgroup
+func readCgroup(procDir string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procDir, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	return parseCgroup(string(content)), nil
+}
+
+// parseCgroup returns the cgroup path (relative to the hierarchy root) from the content of /proc/<pid>/cgroup.
+// Each line has the format "hierarchy-ID:controller-list:cgroup-path".
+// For cgroupsv1, the path in the memory hierarchy is returned, for cgroupsv2 the path in the unified hierarchy ("0::").
+func parseCgroup(content string) string {
+	var unified, first string
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		path := strings.TrimPrefix(parts[2], "/")
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				return path
+			}
+		}
+
+		if parts[0] == "0" && parts[1] == "" {
+			unified = path
+		} else if len(first) == 0 {
+			first = path
+		}
+	}
+
+	if len(unified) > 0 {
+		return unified
+	}
+	return first
+}
+
+// readCommand returns the command line of the process.
+// Kernel threads do not have a command line, their name is returned in brackets (same as ps).
+func readCommand(procDir, comm string) string {
+	content, err := ioutil.ReadFile(filepath.Join(procDir, "cmdline"))
+	if err != nil || len(content) == 0 {
+		return fmt.Sprintf("[%s]", comm)
+	}
+
+	command := strings.TrimSpace(strings.ReplaceAll(string(content), "\x00", " "))
+	if len(command) > maxCommandLength {
+		command = command[:maxCommandLength] + "..."
+	}
+	return command
+}
@@ -0,0 +1,127 @@
+package psi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ProcPressureMemory is the file containing the system-wide memory pressure stall information
+	ProcPressureMemory = "/proc/pressure/memory"
+	// CgroupV2MemoryPressure is the name of the cgroupsv2 file containing the memory pressure stall information of a cgroup
+	CgroupV2MemoryPressure = "memory.pressure"
+)
+
+// Line is one line of a pressure file.
+// The averages are the percentage of wall time in which tasks were stalled over the last 10, 60 and 300 seconds.
+type Line struct {
+	Avg10  float64
+	Avg60  float64
+	Avg300 float64
+	// Total is the total stall time
+	Total time.Duration
+}
+
+// Stats is the pressure stall information of a resource.
+// "some" is the share of time in which at least one task was stalled,
+// "full" the share of time in which all non-idle tasks were stalled simultaneously.
+type Stats struct {
+	Some Line
+	Full Line
+}
+
+// ReadFile reads a pressure file such as /proc/pressure/memory or <cgroup>/memory.pressure
+func ReadFile(path string) (Stats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer f.Close()
+
+	stats, err := Parse(f)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return stats, nil
+}
+
+// Parse parses the content of a pressure file:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func Parse(r io.Reader) (Stats, error) {
+	var stats Stats
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		line, err := parseLine(fields[1:])
+		if err != nil {
+			return Stats{}, err
+		}
+
+		switch fields[0] {
+		case "some":
+			stats.Some = line
+		case "full":
+			stats.Full = line
+		default:
+			return Stats{}, fmt.Errorf("unknown pressure type %q", fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Stats{}, err
+	}
+	return stats, nil
+}
+
+// parseLine parses the key=value pairs of a single line
+func parseLine(fields []string) (Line, error) {
+	var line Line
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return Line{}, fmt.Errorf("invalid field %q", field)
+		}
+
+		switch kv[0] {
+		case "avg10", "avg60", "avg300":
+			value, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return Line{}, fmt.Errorf("invalid value for %s: %w", kv[0], err)
+			}
+
+			switch kv[0] {
+			case "avg10":
+				line.Avg10 = value
+			case "avg60":
+				line.Avg60 = value
+			default:
+				line.Avg300 = value
+			}
+		case "total":
+			// the total stall time is given in microseconds
+			value, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return Line{}, fmt.Errorf("invalid value for total: %w", err)
+			}
+			line.Total = time.Duration(value) * time.Microsecond
+		}
+	}
+	return line, nil
+}
+
+// Available returns true if the kernel exposes pressure stall information (requires Linux >= 4.20 with PSI enabled)
+func Available() bool {
+	_, err := os.Stat(ProcPressureMemory)
+	return err == nil
+}
@@ -0,0 +1,13 @@
+package psi_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPSI(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PSI Suite")
+}
@@ -0,0 +1,35 @@
+package psi_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/psi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PSI", func() {
+	It("should parse the pressure stall information", func() {
+		stats, err := psi.Parse(strings.NewReader("some avg10=1.50 avg60=12.25 avg300=3.00 total=123456\nfull avg10=0.50 avg60=2.00 avg300=0.10 total=1000\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(stats.Some).To(Equal(psi.Line{Avg10: 1.5, Avg60: 12.25, Avg300: 3, Total: 123456 * time.Microsecond}))
+		Expect(stats.Full).To(Equal(psi.Line{Avg10: 0.5, Avg60: 2, Avg300: 0.1, Total: time.Millisecond}))
+	})
+
+	It("should parse pressure files without full line", func() {
+		// the system-wide cpu pressure file on older kernels only contains the "some" line
+		stats, err := psi.Parse(strings.NewReader("some avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Full).To(Equal(psi.Line{}))
+	})
+
+	It("should fail for invalid content", func() {
+		_, err := psi.Parse(strings.NewReader("some avg10=abc avg60=0.00 avg300=0.00 total=0\n"))
+		Expect(err).To(HaveOccurred())
+
+		_, err = psi.Parse(strings.NewReader("partial avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"))
+		Expect(err).To(HaveOccurred())
+	})
+})
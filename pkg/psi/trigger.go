@@ -0,0 +1,79 @@
+package psi
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// minTriggerWindow and maxTriggerWindow are the bounds of the trigger window accepted by the kernel
+	minTriggerWindow = 500 * time.Millisecond
+	maxTriggerWindow = 10 * time.Second
+)
+
+// Trigger is a PSI trigger registered on a pressure file.
+// The kernel notifies the trigger as soon as tasks were stalled for at least the threshold within the window
+// instead of requiring the pressure file to be polled (see https://docs.kernel.org/accounting/psi.html).
+type Trigger struct {
+	fd int
+}
+
+// NewTrigger registers a trigger for the given kind ("some" or "full") on a pressure file such as /proc/pressure/memory.
+// The window must be between 500ms and 10s.
+func NewTrigger(path, kind string, threshold, window time.Duration) (*Trigger, error) {
+	if kind != "some" && kind != "full" {
+		return nil, fmt.Errorf("invalid pressure type %q: must be \"some\" or \"full\"", kind)
+	}
+	if window < minTriggerWindow || window > maxTriggerWindow {
+		return nil, fmt.Errorf("invalid window %s: must be between %s and %s", window, minTriggerWindow, maxTriggerWindow)
+	}
+	if threshold <= 0 || threshold > window {
+		return nil, fmt.Errorf("invalid threshold %s: must be positive and not larger than the window %s", threshold, window)
+	}
+
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	// the trigger stays registered as long as the file descriptor is open
+	if _, err := unix.Write(fd, []byte(fmt.Sprintf("%s %d %d", kind, threshold.Microseconds(), window.Microseconds()))); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to register the trigger on %s: %w", path, err)
+	}
+	return NewTriggerFromFd(fd), nil
+}
+
+// NewTriggerFromFd creates a Trigger from the file descriptor of an already registered trigger.
+// The Trigger takes ownership of the file descriptor. The trigger fires when the file descriptor signals POLLPRI.
+func NewTriggerFromFd(fd int) *Trigger {
+	return &Trigger{fd: fd}
+}
+
+// Wait blocks until the trigger fires or the timeout expires.
+// Returns true if the trigger fired.
+func (t *Trigger) Wait(timeout time.Duration) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLPRI}}
+	n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	if err == unix.EINTR {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to wait for the trigger: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if fds[0].Revents&unix.POLLERR != 0 {
+		return false, fmt.Errorf("the trigger is no longer valid")
+	}
+	return fds[0].Revents&unix.POLLPRI != 0, nil
+}
+
+// Close unregisters the trigger
+func (t *Trigger) Close() error {
+	return unix.Close(t.fd)
+}
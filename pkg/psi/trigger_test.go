@@ -0,0 +1,53 @@
+package psi_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/danielfoehrkn/better-kube-reserved/pkg/psi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Trigger", func() {
+	It("should reject invalid triggers", func() {
+		_, err := psi.NewTrigger(psi.ProcPressureMemory, "partial", 100*time.Millisecond, time.Second)
+		Expect(err).To(HaveOccurred())
+
+		_, err = psi.NewTrigger(psi.ProcPressureMemory, "some", 100*time.Millisecond, 100*time.Millisecond)
+		Expect(err).To(HaveOccurred())
+
+		_, err = psi.NewTrigger(psi.ProcPressureMemory, "some", 100*time.Millisecond, time.Minute)
+		Expect(err).To(HaveOccurred())
+
+		_, err = psi.NewTrigger(psi.ProcPressureMemory, "some", 2*time.Second, time.Second)
+		Expect(err).To(HaveOccurred())
+
+		_, err = psi.NewTrigger(psi.ProcPressureMemory, "some", 0, time.Second)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should register the trigger on the pressure file", func() {
+		dir, err := ioutil.TempDir("", "pressure")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "memory")
+		Expect(ioutil.WriteFile(path, nil, 0644)).To(Succeed())
+
+		trigger, err := psi.NewTrigger(path, "some", 150*time.Millisecond, time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		defer trigger.Close()
+
+		content, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(content)).To(Equal("some 150000 1000000"))
+
+		// a regular file never signals POLLPRI
+		fired, err := trigger.Wait(10 * time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fired).To(BeFalse())
+	})
+})
@@ -1,9 +1,10 @@
 package types
 
 const (
-	// DefaultkubepodsCgroupName is the default cgroup name for kubepods
-	// TODO: Should be based on cgroup driver (systemd: kubepods.slice, cgroups: kubepods)
+	// DefaultkubepodsCgroupName is the default cgroup name for kubepods when using the cgroupfs cgroup driver
 	DefaultkubepodsCgroupName = "kubepods"
+	// SystemdKubepodsCgroupName is the default cgroup name for kubepods when using the systemd cgroup driver
+	SystemdKubepodsCgroupName = "kubepods.slice"
 	// SystemSliceCgroupName is the default cgroup name for system.slice
 	SystemSliceCgroupName = "system.slice"
 	// DefaultDockerCgroupName is the default cgroup name for the docker container runtime